@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"log"
 
+	"go.uber.org/zap"
+
 	"github.com/sudeeya/metrics-harvester/internal/logging"
 	repo "github.com/sudeeya/metrics-harvester/internal/repository"
 	"github.com/sudeeya/metrics-harvester/internal/repository/database"
@@ -45,7 +47,25 @@ func main() {
 		repository = storage.NewMemStorage()
 	}
 
+	if cfg.MigrateOnly {
+		server.Migrate(logger, repository)
+		closeRepository(logger, repository)
+		return
+	}
+	if cfg.ImportOnly {
+		server.Import(logger, cfg, repository)
+		closeRepository(logger, repository)
+		return
+	}
+
 	logger.Info("Starting metrics-harvester")
 	server := server.NewServer(logger, cfg, repository)
 	server.Run()
 }
+
+// closeRepository closes the repository used by a one-off command, such as a migration or an import.
+func closeRepository(logger *zap.Logger, repository repo.Repository) {
+	if err := repository.Close(); err != nil {
+		logger.Error(err.Error())
+	}
+}
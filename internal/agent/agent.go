@@ -3,21 +3,29 @@ package agent
 import (
 	"bytes"
 	"compress/gzip"
-	"crypto/hmac"
-	"crypto/sha256"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
 	"encoding/hex"
 	"encoding/json"
-	"os"
+	"errors"
+	"net"
 	"os/signal"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/go-resty/resty/v2"
 	"go.uber.org/zap"
+	"google.golang.org/grpc"
 
+	"github.com/sudeeya/metrics-harvester/internal/encryption"
 	"github.com/sudeeya/metrics-harvester/internal/metric"
+	pb "github.com/sudeeya/metrics-harvester/internal/proto"
 )
 
 type Agent struct {
@@ -25,6 +33,12 @@ type Agent struct {
 	logger          *zap.Logger
 	client          *resty.Client
 	backoffSchedule []time.Duration
+	publicKey       *rsa.PublicKey
+	grpcConn        *grpc.ClientConn
+	grpcClient      pb.MetricsClient
+	realIP          string
+
+	signatureMismatches atomic.Int64
 }
 
 func NewAgent(logger *zap.Logger, cfg *Config) *Agent {
@@ -32,12 +46,56 @@ func NewAgent(logger *zap.Logger, cfg *Config) *Agent {
 	client := resty.New().SetBaseURL(cfg.Address)
 	logger.Info("Initializing backoff schedule")
 	backoffSchedule := initializeBackoffSchedule(logger, cfg)
+	publicKey := initializePublicKey(logger, cfg)
+	grpcConn, grpcClient := initializeGRPCClient(logger, cfg)
+	logger.Info("Initializing outbound address")
+	realIP := initializeRealIP(logger, cfg)
 	return &Agent{
 		cfg:             cfg,
 		logger:          logger,
 		client:          client,
 		backoffSchedule: backoffSchedule,
+		publicKey:       publicKey,
+		grpcConn:        grpcConn,
+		grpcClient:      grpcClient,
+		realIP:          realIP,
+	}
+}
+
+func initializeRealIP(logger *zap.Logger, cfg *Config) string {
+	address := strings.TrimPrefix(cfg.Address, "http://")
+	if cfg.Transport != TransportHTTP {
+		address = cfg.GRPCAddress
+	}
+	ip, err := outboundIP(address)
+	if err != nil {
+		logger.Warn("Could not determine outbound address: " + err.Error())
+		return ""
+	}
+	return ip
+}
+
+// outboundIP returns the address of the interface used to reach the server.
+// Dialing UDP sends no packets, it only selects the route.
+func outboundIP(address string) (string, error) {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return "", err
 	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP.String(), nil
+}
+
+func initializePublicKey(logger *zap.Logger, cfg *Config) *rsa.PublicKey {
+	if cfg.CryptoKey == "" {
+		return nil
+	}
+	logger.Info("Initializing public key")
+	publicKey, err := encryption.LoadPublicKey(cfg.CryptoKey)
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+	return publicKey
 }
 
 func initializeBackoffSchedule(logger *zap.Logger, cfg *Config) []time.Duration {
@@ -53,90 +111,260 @@ func initializeBackoffSchedule(logger *zap.Logger, cfg *Config) []time.Duration
 	return backoffSchedule
 }
 
+// Run polls and reports metrics until SIGINT, SIGTERM or SIGQUIT is received.
+// Then it shuts the agent down gracefully.
+//
+// Collectors update metrics on every poll interval,
+// and every report interval a snapshot of metrics is queued as a job.
+// Jobs are sent by RateLimit workers, so at most RateLimit requests are in flight.
 func (a *Agent) Run() {
 	a.logger.Info("Agent is running")
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	defer stop()
+	sendCtx, cancelSends := context.WithCancel(context.Background())
+	defer cancelSends()
 	var (
-		metrics      = NewMetrics()
-		pollTicker   = time.NewTicker(time.Duration(a.cfg.PollInterval) * time.Second)
-		reportTicker = time.NewTicker(time.Duration(a.cfg.ReportInterval) * time.Second)
-		sigChan      = make(chan os.Signal, 1)
+		metrics    = NewMetrics()
+		jobs       = make(chan []metric.Metric, a.cfg.RateLimit)
+		producers  sync.WaitGroup
+		workers    sync.WaitGroup
+		pollPeriod = time.Duration(a.cfg.PollInterval) * time.Second
 	)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	go func() {
-		for range pollTicker.C {
-			a.logger.Info("Updating metric values")
-			go func() {
-				metrics.Update()
-			}()
-			go func() {
-				if err := metrics.UpdatePSUtil(); err != nil {
-					a.logger.Error(err.Error())
-				}
-			}()
+	producers.Add(3)
+	go a.collect(ctx, &producers, pollPeriod, func() error {
+		metrics.Update()
+		return nil
+	})
+	go a.collect(ctx, &producers, pollPeriod, metrics.UpdatePSUtil)
+	go a.report(ctx, &producers, metrics, jobs)
+	workers.Add(int(a.cfg.RateLimit))
+	for range a.cfg.RateLimit {
+		go a.work(sendCtx, &workers, metrics, jobs)
+	}
+
+	<-ctx.Done()
+	a.logger.Info("Agent is shutting down")
+	stop()
+	producers.Wait()
+	close(jobs)
+	a.finish(metrics, &workers, cancelSends)
+}
+
+// finish waits for the workers to send the queued jobs and then shuts the agent down.
+// The shutdown timeout is split between the two,
+// so a slow drain does not leave the final report without time.
+// Sends still running when the drain time is up are cancelled,
+// and their counter deltas are given back to metrics for the final report.
+func (a *Agent) finish(metrics *Metrics, workers *sync.WaitGroup, cancelSends context.CancelFunc) {
+	timeout := time.Duration(a.cfg.ShutdownTimeout) * time.Second
+	drainCtx, cancelDrain := context.WithTimeout(context.Background(), timeout/2)
+	context.AfterFunc(drainCtx, cancelSends)
+	workers.Wait()
+	cancelDrain()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout-timeout/2)
+	defer cancel()
+	a.Shutdown(shutdownCtx, metrics)
+}
+
+// collect calls update every period until ctx is done.
+func (a *Agent) collect(ctx context.Context, wg *sync.WaitGroup, period time.Duration, update func() error) {
+	defer wg.Done()
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := update(); err != nil {
+				a.logger.Error(err.Error())
+			}
 		}
-	}()
-	go func() {
-		for range reportTicker.C {
-			a.logger.Info("Sending all metrics")
-			a.SendMetrics(metrics)
+	}
+}
+
+// report queues a snapshot of metrics every report interval until ctx is done.
+// If all workers are busy and the queue is full, it waits for a free slot.
+func (a *Agent) report(ctx context.Context, wg *sync.WaitGroup, metrics *Metrics, jobs chan<- []metric.Metric) {
+	defer wg.Done()
+	ticker := time.NewTicker(time.Duration(a.cfg.ReportInterval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			a.logger.Info("Queueing all metrics")
+			mSlice := metrics.Take()
+			select {
+			case <-ctx.Done():
+				metrics.Restore(mSlice)
+				return
+			case jobs <- mSlice:
+			}
 		}
-	}()
-	go func() {
-		<-sigChan
-		a.logger.Info("Agent is shutting down")
-		a.Shutdown()
-	}()
-	select {}
+	}
 }
 
-func (a *Agent) SendMetrics(metrics *Metrics) {
-	mSlice := metrics.List()
-	for _, backoff := range a.backoffSchedule {
-		if err := a.trySend(mSlice); err != nil {
-			a.logger.Error(err.Error())
-			time.Sleep(backoff)
-			continue
+// work sends queued jobs until the queue is closed.
+// Counter deltas of jobs that could not be delivered are given back to metrics.
+func (a *Agent) work(ctx context.Context, wg *sync.WaitGroup, metrics *Metrics, jobs <-chan []metric.Metric) {
+	defer wg.Done()
+	for mSlice := range jobs {
+		a.logger.Info("Sending all metrics")
+		if err := a.sendBatch(ctx, mSlice); !delivered(err) {
+			metrics.Restore(mSlice)
 		}
-		return
 	}
 }
 
-func (a *Agent) trySend(mSlice []metric.Metric) error {
-	var buf bytes.Buffer
-	gzipWriter, err := gzip.NewWriterLevel(&buf, gzip.BestSpeed)
-	if err != nil {
-		return err
+// SendMetrics sends all metrics to the server, retrying according to the backoff schedule.
+// It gives up when ctx is done.
+// Counters are reset only if the server acknowledges the metrics.
+func (a *Agent) SendMetrics(ctx context.Context, metrics *Metrics) {
+	mSlice := metrics.Take()
+	if err := a.sendBatch(ctx, mSlice); !delivered(err) {
+		metrics.Restore(mSlice)
 	}
-	err = json.NewEncoder(gzipWriter).Encode(mSlice)
+}
+
+// delivered reports whether the server applied the metrics sent with the given result.
+// A response with a mismatched signature is successful, so its metrics have been applied.
+func delivered(err error) bool {
+	return err == nil || errors.Is(err, errSignatureMismatch)
+}
+
+// sendBatch sends the metrics, retrying retryable failures according to the backoff schedule.
+// The same metrics are sent on every attempt with the same batch key,
+// so the server applies them once even if a response is lost.
+// Returns the last error if the metrics were not delivered,
+// or errSignatureMismatch if they were, but the response signature does not match.
+func (a *Agent) sendBatch(ctx context.Context, mSlice []metric.Metric) error {
+	key, err := newBatchKey()
 	if err != nil {
 		return err
 	}
-	err = gzipWriter.Close()
+	err = a.trySend(ctx, key, mSlice)
+	maxBackoff := slices.Max(append([]time.Duration{0}, a.backoffSchedule...))
+	for _, backoff := range a.backoffSchedule {
+		if err == nil {
+			return nil
+		}
+		delay, retry := retryDelay(err, backoff, maxBackoff)
+		if !retry {
+			break
+		}
+		a.logger.Error(err.Error())
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		err = a.trySend(ctx, key, mSlice)
+	}
+	switch {
+	case errors.Is(err, errSignatureMismatch):
+		a.logger.Error("Metrics were delivered, but the response is not trusted: " + err.Error())
+	case err != nil:
+		a.logger.Error("Metrics were not delivered: " + err.Error())
+	}
+	return err
+}
+
+// newBatchKey returns a random key identifying a batch.
+func newBatchKey() (string, error) {
+	key := make([]byte, 16)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(key), nil
+}
+
+func (a *Agent) trySend(ctx context.Context, key string, mSlice []metric.Metric) error {
+	switch a.cfg.Transport {
+	case TransportGRPC:
+		return a.trySendGRPC(ctx, key, mSlice)
+	case TransportGRPCStream:
+		return a.trySendGRPCStream(ctx, key, mSlice)
+	default:
+		return a.trySendHTTP(ctx, key, mSlice)
+	}
+}
+
+func (a *Agent) trySendHTTP(ctx context.Context, key string, mSlice []metric.Metric) error {
+	body, err := encodeBody(mSlice)
 	if err != nil {
-		return err
+		return &permanentError{err: err}
 	}
-	body := buf.Bytes()
 	request := a.client.R().
+		SetContext(ctx).
 		SetHeader("Content-Type", "application/json").
 		SetHeader("Content-Encoding", "gzip").
-		SetHeader("Accept-Encoding", "gzip")
-	if a.cfg.Key != "" {
-		h := hmac.New(sha256.New, []byte(a.cfg.Key))
-		if _, err := h.Write(body); err != nil {
-			return err
+		SetHeader("Accept-Encoding", "gzip").
+		SetHeader("Idempotency-Key", key)
+	if a.realIP != "" {
+		request.SetHeader("X-Real-IP", a.realIP)
+	}
+	// The body is compressed, then encrypted, then signed,
+	// so the server verifies the signature before decrypting.
+	if a.publicKey != nil {
+		body, err = encryption.Encrypt(a.publicKey, body)
+		if err != nil {
+			return &permanentError{err: err}
 		}
-		request.SetHeader("HashSHA256", hex.EncodeToString(h.Sum(nil)))
+		request.SetHeader(encryption.Header, encryption.Scheme)
+	}
+	if a.cfg.Key != "" {
+		request.SetHeader("HashSHA256", hex.EncodeToString(a.sign(body)))
 	}
 	response, err := request.
+		SetDoNotParseResponse(true).
 		SetBody(body).
 		Post("/updates/")
 	if err != nil {
 		return err
 	}
 	defer response.RawResponse.Body.Close()
-	return nil
+	rawBody, responseBody, err := readBody(response)
+	if err != nil {
+		return err
+	}
+	// Only a successful response marks the metrics as delivered, so only it must be signed.
+	// The server does not sign error responses, such as the rejection of a request with a wrong signature.
+	if err := checkResponse(response, responseBody); err != nil {
+		return err
+	}
+	return a.verifyResponse(response.Header().Get("HashSHA256"), rawBody)
 }
 
-func (a *Agent) Shutdown() {
-	os.Exit(0)
+// encodeBody returns the metrics encoded as gzipped JSON.
+func encodeBody(mSlice []metric.Metric) ([]byte, error) {
+	var buf bytes.Buffer
+	gzipWriter, err := gzip.NewWriterLevel(&buf, gzip.BestSpeed)
+	if err != nil {
+		return nil, err
+	}
+	err = json.NewEncoder(gzipWriter).Encode(mSlice)
+	if err != nil {
+		return nil, err
+	}
+	err = gzipWriter.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Shutdown sends the metrics collected since the last report
+// until ctx is done and closes the connections.
+// It must be called after polling and reporting have stopped.
+func (a *Agent) Shutdown(ctx context.Context, metrics *Metrics) {
+	a.logger.Info("Sending all metrics before exit")
+	a.SendMetrics(ctx, metrics)
+	if a.grpcConn != nil {
+		if err := a.grpcConn.Close(); err != nil {
+			a.logger.Error(err.Error())
+		}
+	}
+	a.logger.Info("Agent is stopped")
 }
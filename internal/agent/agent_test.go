@@ -0,0 +1,377 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/sudeeya/metrics-harvester/internal/metric"
+	"github.com/sudeeya/metrics-harvester/internal/middleware"
+)
+
+func newTestConfig(address string) *Config {
+	return &Config{
+		Address:         address,
+		BackoffSchedule: "0",
+		RateLimit:       2,
+		Transport:       TransportHTTP,
+	}
+}
+
+func TestWork(t *testing.T) {
+	var (
+		inFlight    atomic.Int64
+		maxInFlight atomic.Int64
+		received    atomic.Int64
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			observed := maxInFlight.Load()
+			if current <= observed || maxInFlight.CompareAndSwap(observed, current) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		received.Add(1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	cfg := newTestConfig(ts.URL)
+	a := NewAgent(zap.NewNop(), cfg)
+	jobs := make(chan []metric.Metric, 10)
+	for range 10 {
+		jobs <- NewMetrics().List()
+	}
+	close(jobs)
+
+	var workers sync.WaitGroup
+	workers.Add(int(cfg.RateLimit))
+	for range cfg.RateLimit {
+		go a.work(context.Background(), &workers, NewMetrics(), jobs)
+	}
+	workers.Wait()
+
+	require.Equal(t, int64(10), received.Load())
+	require.LessOrEqual(t, maxInFlight.Load(), cfg.RateLimit)
+}
+
+func TestSendMetrics(t *testing.T) {
+	var fail atomic.Bool
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	a := NewAgent(zap.NewNop(), newTestConfig(ts.URL))
+	metrics := NewMetrics()
+	metrics.Update()
+
+	fail.Store(true)
+	a.SendMetrics(context.Background(), metrics)
+	require.Equal(t, int64(1), pollCount(t, metrics.List()))
+
+	fail.Store(false)
+	a.SendMetrics(context.Background(), metrics)
+	require.Equal(t, int64(0), pollCount(t, metrics.List()))
+}
+
+func TestFinish_SlowDrain(t *testing.T) {
+	var (
+		requests  atomic.Int64
+		delivered atomic.Int64
+	)
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			// The queued job hangs until the drain time is up.
+			select {
+			case <-r.Context().Done():
+			case <-release:
+			}
+			return
+		}
+		delivered.Add(1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	cfg := newTestConfig(ts.URL)
+	cfg.RateLimit = 1
+	cfg.ShutdownTimeout = 1
+	a := NewAgent(zap.NewNop(), cfg)
+	metrics := NewMetrics()
+	metrics.Update()
+	jobs := make(chan []metric.Metric, 1)
+	jobs <- metrics.Take()
+	close(jobs)
+	metrics.Update()
+
+	sendCtx, cancelSends := context.WithCancel(context.Background())
+	defer cancelSends()
+	var workers sync.WaitGroup
+	workers.Add(1)
+	go a.work(sendCtx, &workers, metrics, jobs)
+	a.finish(metrics, &workers, cancelSends)
+
+	require.Equal(t, int64(1), delivered.Load(), "the final report must have its own time")
+	require.Equal(t, int64(0), pollCount(t, metrics.List()))
+}
+
+func TestSendBatch(t *testing.T) {
+	tests := []struct {
+		name       string
+		statuses   []int
+		retryAfter string
+		attempts   int64
+		delivered  bool
+	}{
+		{
+			name:      "success",
+			statuses:  []int{http.StatusOK},
+			attempts:  1,
+			delivered: true,
+		},
+		{
+			name:      "retry after server error",
+			statuses:  []int{http.StatusInternalServerError, http.StatusOK},
+			attempts:  2,
+			delivered: true,
+		},
+		{
+			name:       "retry after too many requests",
+			statuses:   []int{http.StatusTooManyRequests, http.StatusOK},
+			retryAfter: "0",
+			attempts:   2,
+			delivered:  true,
+		},
+		{
+			name:       "retry after is capped at the longest backoff",
+			statuses:   []int{http.StatusServiceUnavailable, http.StatusOK},
+			retryAfter: "3600",
+			attempts:   2,
+			delivered:  true,
+		},
+		{
+			name:     "no retry after bad request",
+			statuses: []int{http.StatusBadRequest, http.StatusOK},
+			attempts: 1,
+		},
+		{
+			name:     "retries are exhausted",
+			statuses: []int{http.StatusBadGateway, http.StatusBadGateway, http.StatusOK},
+			attempts: 2,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var attempts atomic.Int64
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				attempt := attempts.Add(1)
+				if test.retryAfter != "" {
+					w.Header().Set("Retry-After", test.retryAfter)
+				}
+				w.WriteHeader(test.statuses[attempt-1])
+			}))
+			defer ts.Close()
+
+			a := NewAgent(zap.NewNop(), newTestConfig(ts.URL))
+			err := a.sendBatch(context.Background(), NewMetrics().List())
+			require.Equal(t, test.delivered, err == nil)
+			require.Equal(t, test.attempts, attempts.Load())
+		})
+	}
+}
+
+func TestSendBatch_Key(t *testing.T) {
+	var (
+		mutex sync.Mutex
+		keys  []string
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		keys = append(keys, r.Header.Get("Idempotency-Key"))
+		if len(keys) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	a := NewAgent(zap.NewNop(), newTestConfig(ts.URL))
+	require.NoError(t, a.sendBatch(context.Background(), NewMetrics().List()))
+	require.NoError(t, a.sendBatch(context.Background(), NewMetrics().List()))
+	require.Len(t, keys, 3)
+	require.NotEmpty(t, keys[0])
+	require.Equal(t, keys[0], keys[1], "retries must reuse the key")
+	require.NotEqual(t, keys[1], keys[2], "batches must have different keys")
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, time.October, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		value  string
+		result time.Duration
+	}{
+		{
+			name:   "seconds",
+			value:  "3",
+			result: 3 * time.Second,
+		},
+		{
+			name:   "HTTP date",
+			value:  now.Add(5 * time.Second).Format(http.TimeFormat),
+			result: 5 * time.Second,
+		},
+		{
+			name:   "date in the past",
+			value:  now.Add(-5 * time.Second).Format(http.TimeFormat),
+			result: 0,
+		},
+		{
+			name:   "malformed value",
+			value:  "dummy",
+			result: 0,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			require.Equal(t, test.result, parseRetryAfter(test.value, now))
+		})
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		name  string
+		err   error
+		delay time.Duration
+		retry bool
+	}{
+		{
+			name:  "transport error",
+			err:   errors.New("connection refused"),
+			delay: time.Second,
+			retry: true,
+		},
+		{
+			name:  "retry after",
+			err:   &retryableError{err: errors.New("unavailable"), retryAfter: 2 * time.Second},
+			delay: 2 * time.Second,
+			retry: true,
+		},
+		{
+			name:  "retry after above the longest backoff",
+			err:   &retryableError{err: errors.New("unavailable"), retryAfter: time.Hour},
+			delay: 5 * time.Second,
+			retry: true,
+		},
+		{
+			name: "request is not built",
+			err:  &permanentError{err: errors.New("encryption failed")},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			delay, retry := retryDelay(test.err, time.Second, 5*time.Second)
+			require.Equal(t, test.retry, retry)
+			require.Equal(t, test.delay, delay)
+		})
+	}
+}
+
+func TestResponseSignature(t *testing.T) {
+	var attempts atomic.Int64
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("first part, "))
+		_, _ = w.Write([]byte("second part"))
+	})
+	tests := []struct {
+		name      string
+		serverKey string
+		agentKey  string
+		delivered bool
+		// rejected means the server rejects the request signature,
+		// so the metrics are not retried and no mismatch is counted.
+		rejected bool
+	}{
+		{
+			name:      "matching keys",
+			serverKey: "secret",
+			agentKey:  "secret",
+			delivered: true,
+		},
+		{
+			name:      "unsigned response",
+			serverKey: "",
+			agentKey:  "secret",
+		},
+		{
+			name:      "different keys",
+			serverKey: "server",
+			agentKey:  "agent",
+			rejected:  true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ts := httptest.NewServer(middleware.WithSigning([]byte(test.serverKey), middleware.WithCompressing(handler)))
+			defer ts.Close()
+
+			cfg := newTestConfig(ts.URL)
+			cfg.Key = test.agentKey
+			cfg.BackoffSchedule = "0,0,0"
+			a := NewAgent(zap.NewNop(), cfg)
+			attempts.Store(0)
+			requests := 0
+			a.client.OnBeforeRequest(func(*resty.Client, *resty.Request) error {
+				requests++
+				return nil
+			})
+			err := a.sendBatch(context.Background(), NewMetrics().List())
+			require.Equal(t, test.delivered, err == nil, err)
+			switch {
+			case test.rejected:
+				var permanent *permanentError
+				require.ErrorAs(t, err, &permanent)
+				require.NotErrorIs(t, err, errSignatureMismatch)
+				require.Equal(t, 1, requests)
+				require.Equal(t, int64(0), attempts.Load(), "the request must be rejected by the server")
+				require.Equal(t, int64(0), a.signatureMismatches.Load())
+			case !test.delivered:
+				// The server has applied the metrics, so they must not be sent again.
+				require.ErrorIs(t, err, errSignatureMismatch)
+				require.Equal(t, 1, requests)
+				require.Equal(t, int64(1), attempts.Load())
+				require.Equal(t, int64(1), a.signatureMismatches.Load())
+
+				metrics := NewMetrics()
+				metrics.Update()
+				a.SendMetrics(context.Background(), metrics)
+				require.Equal(t, int64(2), attempts.Load())
+				require.Equal(t, int64(0), pollCount(t, metrics.List()), "applied counters must not be restored")
+			}
+		})
+	}
+}
@@ -2,44 +2,76 @@ package agent
 
 import (
 	"flag"
+	"fmt"
 	"strings"
 
 	"github.com/caarlos0/env/v11"
 )
 
+// Transports between agent and server.
+const (
+	TransportHTTP       = "http"
+	TransportGRPC       = "grpc"
+	TransportGRPCStream = "grpc-stream"
+)
+
 const (
 	defaultAddress         string = "localhost:8080"
 	defaultBackoffSchedule string = "1,3,5"
+	defaultCryptoKey       string = ""
+	defaultGRPCAddress     string = "localhost:3200"
 	defaultKey             string = ""
 	defaultLogLevel        string = "info"
 	defaultPollInterval    int64  = 2
 	defaultRateLimit       int64  = 16
 	defaultReportInterval  int64  = 10
+	defaultShutdownTimeout int64  = 5
+	defaultTransport       string = TransportHTTP
 )
 
 type Config struct {
 	Address         string `env:"ADDRESS"`
 	BackoffSchedule string `env:"BACKOFF_SCHEDULE"`
+	CryptoKey       string `env:"CRYPTO_KEY"`
+	GRPCAddress     string `env:"GRPC_ADDRESS"`
 	Key             string `env:"KEY"`
 	LogLevel        string `env:"LOG_LEVEL"`
 	PollInterval    int64  `env:"POLL_INTERVAL"`
 	RateLimit       int64  `env:"RATE_LIMIT"`
 	ReportInterval  int64  `env:"REPORT_INTERVAL"`
+	ShutdownTimeout int64  `env:"SHUTDOWN_TIMEOUT"`
+	Transport       string `env:"TRANSPORT"`
 }
 
 func NewConfig() (*Config, error) {
 	var cfg Config
 	flag.StringVar(&cfg.Address, "a", defaultAddress, "Server IP address and port")
 	flag.StringVar(&cfg.BackoffSchedule, "b", defaultBackoffSchedule, "Backoff schedule in seconds separated by commas")
+	flag.StringVar(&cfg.CryptoKey, "crypto-key", defaultCryptoKey, "Path to the PEM file with the RSA public key for payload encryption")
+	flag.StringVar(&cfg.GRPCAddress, "g", defaultGRPCAddress, "Server gRPC IP address and port")
 	flag.StringVar(&cfg.Key, "k", defaultKey, "Key for HMAC hash")
 	flag.StringVar(&cfg.LogLevel, "ll", defaultLogLevel, "Log level: info, error, fatal")
 	flag.Int64Var(&cfg.PollInterval, "p", defaultPollInterval, "Polling interval in seconds")
-	flag.Int64Var(&cfg.RateLimit, "l", defaultRateLimit, "Limit of requests")
+	flag.Int64Var(&cfg.RateLimit, "l", defaultRateLimit, "Maximum number of concurrent requests to the server")
 	flag.Int64Var(&cfg.ReportInterval, "r", defaultReportInterval, "Report interval in seconds")
+	flag.Int64Var(&cfg.ShutdownTimeout, "st", defaultShutdownTimeout, "The time in seconds given to the queued and final reports on shutdown, split evenly")
+	flag.StringVar(&cfg.Transport, "t", defaultTransport, "Transport to the server: http, grpc, grpc-stream")
 	flag.Parse()
 	if err := env.Parse(&cfg); err != nil {
 		return nil, err
 	}
+	if cfg.RateLimit < 1 {
+		return nil, fmt.Errorf("rate limit must be positive: %d", cfg.RateLimit)
+	}
+	switch cfg.Transport {
+	case TransportHTTP, TransportGRPC, TransportGRPCStream:
+	default:
+		return nil, fmt.Errorf("unknown transport: %s", cfg.Transport)
+	}
+	// The gRPC transport has no encryption of its own, so metrics would be sent in plaintext.
+	if cfg.Transport != TransportHTTP && cfg.CryptoKey != "" {
+		return nil, fmt.Errorf("transport %s does not encrypt metrics: use %s with the crypto key set", cfg.Transport, TransportHTTP)
+	}
 	if !strings.HasPrefix(cfg.Address, "http://") {
 		cfg.Address = "http://" + cfg.Address
 	}
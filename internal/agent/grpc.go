@@ -0,0 +1,112 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/sudeeya/metrics-harvester/internal/interceptor"
+	"github.com/sudeeya/metrics-harvester/internal/metric"
+	pb "github.com/sudeeya/metrics-harvester/internal/proto"
+	"github.com/sudeeya/metrics-harvester/internal/service"
+)
+
+const limitInSeconds = 10
+
+func initializeGRPCClient(logger *zap.Logger, cfg *Config) (*grpc.ClientConn, pb.MetricsClient) {
+	if cfg.Transport == TransportHTTP {
+		return nil, nil
+	}
+	logger.Info("Initializing gRPC client")
+	conn, err := grpc.NewClient(cfg.GRPCAddress,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.UseCompressor(gzip.Name)),
+	)
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+	return conn, pb.NewMetricsClient(conn)
+}
+
+// outgoingContext attaches the agent address, the batch key
+// and the signature of the messages to the outgoing metadata.
+func (a *Agent) outgoingContext(ctx context.Context, key string, messages ...any) (context.Context, error) {
+	ctx = metadata.AppendToOutgoingContext(ctx, service.IdempotencyKey, key)
+	if a.realIP != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, interceptor.RealIPKey, a.realIP)
+	}
+	if a.cfg.Key == "" {
+		return ctx, nil
+	}
+	signature, err := interceptor.Sign([]byte(a.cfg.Key), messages...)
+	if err != nil {
+		return nil, err
+	}
+	return metadata.AppendToOutgoingContext(ctx, interceptor.HashKey, signature), nil
+}
+
+func (a *Agent) trySendGRPC(ctx context.Context, key string, mSlice []metric.Metric) error {
+	ctx, cancel := context.WithTimeout(ctx, limitInSeconds*time.Second)
+	defer cancel()
+
+	request := &pb.UpdateMetricsRequest{
+		Metrics: make([]*pb.Metric, len(mSlice)),
+	}
+	for i, m := range mSlice {
+		request.Metrics[i] = pb.FromMetric(m)
+	}
+	ctx, err := a.outgoingContext(ctx, key, request)
+	if err != nil {
+		return &permanentError{err: err}
+	}
+	var header metadata.MD
+	response, err := a.grpcClient.UpdateMetrics(ctx, request, grpc.Header(&header))
+	if err != nil {
+		return checkStatus(err)
+	}
+	return a.verifyMetadata(header, response)
+}
+
+func (a *Agent) trySendGRPCStream(ctx context.Context, key string, mSlice []metric.Metric) error {
+	ctx, cancel := context.WithTimeout(ctx, limitInSeconds*time.Second)
+	defer cancel()
+
+	messages := make([]any, len(mSlice))
+	for i, m := range mSlice {
+		messages[i] = pb.FromMetric(m)
+	}
+	ctx, err := a.outgoingContext(ctx, key, messages...)
+	if err != nil {
+		return &permanentError{err: err}
+	}
+	stream, err := a.grpcClient.StreamMetrics(ctx)
+	if err != nil {
+		return err
+	}
+	for _, message := range messages {
+		err := stream.Send(message.(*pb.Metric))
+		// On io.EOF the server has ended the call and the status is returned by CloseAndRecv.
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	response, err := stream.CloseAndRecv()
+	if err != nil {
+		return checkStatus(err)
+	}
+	header, err := stream.Header()
+	if err != nil {
+		return err
+	}
+	return a.verifyMetadata(header, response)
+}
@@ -11,6 +11,8 @@ import (
 	"github.com/sudeeya/metrics-harvester/internal/metric"
 )
 
+// Metrics stores the latest values of the agent metrics.
+// Counters hold deltas that have not been delivered to the server yet.
 type Metrics struct {
 	mutex  sync.RWMutex
 	values map[string]*metric.Metric
@@ -55,16 +57,59 @@ func NewMetrics() *Metrics {
 	}
 }
 
+// List returns a copy of all metrics.
 func (m *Metrics) List() []metric.Metric {
-	metrics := make([]metric.Metric, 0)
+	metrics := make([]metric.Metric, 0, len(m.values))
 	m.mutex.RLock()
 	defer m.mutex.RUnlock()
-	for _, m := range m.values {
-		metrics = append(metrics, *m)
+	for _, value := range m.values {
+		metrics = append(metrics, clone(*value))
 	}
 	return metrics
 }
 
+// Take returns a copy of all metrics and resets counters,
+// so the returned counters hold the deltas accumulated since the previous Take.
+// If the metrics are not delivered, the deltas must be given back with Restore.
+func (m *Metrics) Take() []metric.Metric {
+	metrics := make([]metric.Metric, 0, len(m.values))
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, value := range m.values {
+		metrics = append(metrics, clone(*value))
+		if value.MType == metric.Counter {
+			*value.Delta = 0
+		}
+	}
+	return metrics
+}
+
+// Restore adds counter deltas of undelivered metrics back,
+// so they are sent with the next Take.
+func (m *Metrics) Restore(metrics []metric.Metric) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, um := range metrics {
+		value, ok := m.values[um.ID]
+		if !ok || um.MType != metric.Counter || um.Delta == nil {
+			continue
+		}
+		*value.Delta += *um.Delta
+	}
+}
+
+func clone(m metric.Metric) metric.Metric {
+	if m.Delta != nil {
+		delta := *m.Delta
+		m.Delta = &delta
+	}
+	if m.Value != nil {
+		value := *m.Value
+		m.Value = &value
+	}
+	return m
+}
+
 func (m *Metrics) Update() {
 	var memStats runtime.MemStats
 	runtime.ReadMemStats(&memStats)
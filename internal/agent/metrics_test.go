@@ -1,6 +1,12 @@
 package agent
 
-import "testing"
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sudeeya/metrics-harvester/internal/metric"
+)
 
 func BenchmarkMetricsUpdate(b *testing.B) {
 	b.StopTimer()
@@ -19,3 +25,31 @@ func BenchmarkMetricsUpdate(b *testing.B) {
 		}
 	})
 }
+
+func pollCount(t *testing.T, metrics []metric.Metric) int64 {
+	for _, m := range metrics {
+		if m.ID == "PollCount" {
+			return *m.Delta
+		}
+	}
+	t.Fatal("PollCount is missing")
+	return 0
+}
+
+func TestTakeRestore(t *testing.T) {
+	metrics := NewMetrics()
+	metrics.Update()
+	metrics.Update()
+
+	first := metrics.Take()
+	require.Equal(t, int64(2), pollCount(t, first))
+	require.Equal(t, int64(0), pollCount(t, metrics.List()))
+
+	metrics.Update()
+	second := metrics.Take()
+	require.Equal(t, int64(1), pollCount(t, second))
+
+	metrics.Restore(first)
+	metrics.Update()
+	require.Equal(t, int64(3), pollCount(t, metrics.Take()))
+}
@@ -0,0 +1,107 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// permanentError is returned when the server rejected the metrics
+// and sending them again will not help.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// retryableError is returned when the server could not process the metrics
+// and asked to retry them later.
+type retryableError struct {
+	err        error
+	retryAfter time.Duration
+}
+
+func (e *retryableError) Error() string {
+	return e.err.Error()
+}
+
+func (e *retryableError) Unwrap() error {
+	return e.err
+}
+
+// checkResponse classifies the HTTP response.
+// It returns nil for 2xx, retryableError for 5xx and 429 and permanentError otherwise.
+func checkResponse(response *resty.Response, body []byte) error {
+	if response.IsSuccess() {
+		return nil
+	}
+	err := fmt.Errorf("server responded with status %s: %s", response.Status(), body)
+	code := response.StatusCode()
+	if code == http.StatusTooManyRequests || code >= http.StatusInternalServerError {
+		return &retryableError{
+			err:        err,
+			retryAfter: parseRetryAfter(response.Header().Get("Retry-After"), time.Now()),
+		}
+	}
+	return &permanentError{err: err}
+}
+
+// parseRetryAfter parses the Retry-After header given either in seconds or as an HTTP date.
+// It returns 0 if the header is missing or malformed.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
+
+// checkStatus classifies the gRPC call error the same way as checkResponse.
+func checkStatus(err error) error {
+	if err == nil {
+		return nil
+	}
+	switch status.Code(err) {
+	case codes.InvalidArgument, codes.NotFound, codes.AlreadyExists, codes.PermissionDenied,
+		codes.FailedPrecondition, codes.OutOfRange, codes.Unimplemented, codes.Unauthenticated:
+		return &permanentError{err: err}
+	default:
+		return err
+	}
+}
+
+// retryDelay returns how long to wait before the next attempt.
+// The delay asked by the server is capped at maxBackoff,
+// so a long Retry-After does not stall the sender.
+// Permanent errors are not retried.
+func retryDelay(err error, backoff, maxBackoff time.Duration) (time.Duration, bool) {
+	var permanent *permanentError
+	if errors.As(err, &permanent) {
+		return 0, false
+	}
+	var retryable *retryableError
+	if errors.As(err, &retryable) && retryable.retryAfter > 0 {
+		return min(retryable.retryAfter, maxBackoff), true
+	}
+	return backoff, true
+}
@@ -0,0 +1,89 @@
+package agent
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/go-resty/resty/v2"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/sudeeya/metrics-harvester/internal/interceptor"
+)
+
+// errSignatureMismatch is returned when a successful server response is not signed with the shared key.
+// The server has already applied the metrics by then,
+// so they are neither retried nor given back to metrics, the mismatch is only logged and counted.
+var errSignatureMismatch = errors.New("response signature mismatch")
+
+// sign returns the HMAC-SHA256 of the body.
+func (a *Agent) sign(body []byte) []byte {
+	h := hmac.New(sha256.New, []byte(a.cfg.Key))
+	h.Write(body)
+	return h.Sum(nil)
+}
+
+// verifyResponse checks the HashSHA256 header of the response against the raw body.
+// If the key is empty does nothing.
+func (a *Agent) verifyResponse(hexHash string, rawBody []byte) error {
+	if a.cfg.Key == "" {
+		return nil
+	}
+	expected, err := hex.DecodeString(hexHash)
+	if err != nil || hexHash == "" || !hmac.Equal(expected, a.sign(rawBody)) {
+		return a.signatureMismatch()
+	}
+	return nil
+}
+
+// verifyMetadata checks the hashsha256 header metadata of the gRPC response.
+// If the key is empty does nothing.
+func (a *Agent) verifyMetadata(header metadata.MD, response any) error {
+	if a.cfg.Key == "" {
+		return nil
+	}
+	expected, err := interceptor.Sign([]byte(a.cfg.Key), response)
+	if err != nil {
+		return err
+	}
+	values := header.Get(interceptor.HashKey)
+	if len(values) == 0 || !hmac.Equal([]byte(values[0]), []byte(expected)) {
+		return a.signatureMismatch()
+	}
+	return nil
+}
+
+// signatureMismatch counts the mismatch and returns errSignatureMismatch.
+func (a *Agent) signatureMismatch() error {
+	count := a.signatureMismatches.Add(1)
+	return &permanentError{
+		err: fmt.Errorf("%w (%d in total)", errSignatureMismatch, count),
+	}
+}
+
+// readBody reads the raw response body, as the signature covers the body as sent.
+// It returns the raw body and the body decompressed if needed.
+func readBody(response *resty.Response) ([]byte, []byte, error) {
+	rawBody, err := io.ReadAll(response.RawResponse.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !strings.Contains(response.Header().Get("Content-Encoding"), "gzip") || len(rawBody) == 0 {
+		return rawBody, rawBody, nil
+	}
+	gzipReader, err := gzip.NewReader(bytes.NewReader(rawBody))
+	if err != nil {
+		return nil, nil, err
+	}
+	body, err := io.ReadAll(gzipReader)
+	if err != nil {
+		return nil, nil, err
+	}
+	return rawBody, body, nil
+}
@@ -0,0 +1,158 @@
+// Package encryption provides hybrid RSA encryption of message bodies.
+//
+// A message is encrypted with a random AES-256-GCM key,
+// and the key itself is encrypted with RSA-OAEP (SHA-256).
+// The encrypted message has the following layout:
+//
+//	| key length (2 bytes, big endian) | encrypted key | nonce | ciphertext |
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Header is the name of the header that marks an encrypted body.
+const Header = "Content-Encryption"
+
+// Scheme is the value of Header for bodies encrypted by this package.
+const Scheme = "rsa-oaep-aes256-gcm"
+
+const (
+	aesKeySize   = 32
+	keyLenPrefix = 2
+)
+
+// ErrMalformed is returned when the encrypted message cannot be parsed.
+var ErrMalformed = errors.New("malformed encrypted message")
+
+// LoadPublicKey reads a PEM encoded RSA public key from the file.
+// Both PKIX ("PUBLIC KEY") and PKCS #1 ("RSA PUBLIC KEY") formats are supported.
+func LoadPublicKey(path string) (*rsa.PublicKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	switch block.Type {
+	case "PUBLIC KEY":
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("%s: not an RSA public key", path)
+		}
+		return rsaKey, nil
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("%s: unexpected PEM block type %q", path, block.Type)
+	}
+}
+
+// LoadPrivateKey reads a PEM encoded RSA private key from the file.
+// Both PKCS #8 ("PRIVATE KEY") and PKCS #1 ("RSA PRIVATE KEY") formats are supported.
+func LoadPrivateKey(path string) (*rsa.PrivateKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		rsaKey, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("%s: not an RSA private key", path)
+		}
+		return rsaKey, nil
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("%s: unexpected PEM block type %q", path, block.Type)
+	}
+}
+
+func readPEM(path string) (*pem.Block, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data found", path)
+	}
+	return block, nil
+}
+
+// Encrypt encrypts the plaintext for the owner of the private key matching the public key.
+func Encrypt(key *rsa.PublicKey, plaintext []byte) ([]byte, error) {
+	aesKey := make([]byte, aesKeySize)
+	if _, err := rand.Read(aesKey); err != nil {
+		return nil, err
+	}
+	encryptedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, key, aesKey, nil)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(aesKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	message := make([]byte, keyLenPrefix, keyLenPrefix+len(encryptedKey)+len(nonce)+len(plaintext)+gcm.Overhead())
+	binary.BigEndian.PutUint16(message, uint16(len(encryptedKey)))
+	message = append(message, encryptedKey...)
+	message = append(message, nonce...)
+	return gcm.Seal(message, nonce, plaintext, nil), nil
+}
+
+// Decrypt decrypts the message produced by Encrypt.
+func Decrypt(key *rsa.PrivateKey, message []byte) ([]byte, error) {
+	if len(message) < keyLenPrefix {
+		return nil, ErrMalformed
+	}
+	keyLen := int(binary.BigEndian.Uint16(message))
+	message = message[keyLenPrefix:]
+	if len(message) < keyLen {
+		return nil, ErrMalformed
+	}
+	aesKey, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, key, message[:keyLen], nil)
+	if err != nil {
+		return nil, err
+	}
+	message = message[keyLen:]
+	gcm, err := newGCM(aesKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(message) < gcm.NonceSize() {
+		return nil, ErrMalformed
+	}
+	nonce, ciphertext := message[:gcm.NonceSize()], message[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
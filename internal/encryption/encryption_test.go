@@ -0,0 +1,122 @@
+package encryption
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writePEM(t *testing.T, blockType string, data []byte) string {
+	path := filepath.Join(t.TempDir(), "key.pem")
+	err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: data}), 0600)
+	require.NoError(t, err)
+	return path
+}
+
+func TestLoadKeys(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	require.NoError(t, err)
+	pkix, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		private bool
+		path    string
+	}{
+		{
+			name:    "PKCS #1 private key",
+			private: true,
+			path:    writePEM(t, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(privateKey)),
+		},
+		{
+			name:    "PKCS #8 private key",
+			private: true,
+			path:    writePEM(t, "PRIVATE KEY", pkcs8),
+		},
+		{
+			name: "PKCS #1 public key",
+			path: writePEM(t, "RSA PUBLIC KEY", x509.MarshalPKCS1PublicKey(&privateKey.PublicKey)),
+		},
+		{
+			name: "PKIX public key",
+			path: writePEM(t, "PUBLIC KEY", pkix),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.private {
+				key, err := LoadPrivateKey(test.path)
+				require.NoError(t, err)
+				require.True(t, privateKey.Equal(key))
+				return
+			}
+			key, err := LoadPublicKey(test.path)
+			require.NoError(t, err)
+			require.True(t, privateKey.PublicKey.Equal(key))
+		})
+	}
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	plaintext := []byte(`[{"id":"PollCount","type":"counter","delta":5}]`)
+
+	message, err := Encrypt(&privateKey.PublicKey, plaintext)
+	require.NoError(t, err)
+	tampered := append([]byte(nil), message...)
+	tampered[len(tampered)-1] ^= 0xff
+
+	tests := []struct {
+		name    string
+		key     *rsa.PrivateKey
+		message []byte
+		wantErr bool
+	}{
+		{
+			name:    "matching key",
+			key:     privateKey,
+			message: message,
+		},
+		{
+			name:    "other key",
+			key:     otherKey,
+			message: message,
+			wantErr: true,
+		},
+		{
+			name:    "tampered message",
+			key:     privateKey,
+			message: tampered,
+			wantErr: true,
+		},
+		{
+			name:    "truncated message",
+			key:     privateKey,
+			message: message[:10],
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			decrypted, err := Decrypt(test.key, test.message)
+			if test.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, plaintext, decrypted)
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"go.uber.org/zap"
+
+	"github.com/sudeeya/metrics-harvester/internal/metric"
+	repo "github.com/sudeeya/metrics-harvester/internal/repository"
+)
+
+// Batch modes of the /updates/ endpoint.
+// The mode is selected by the mode query parameter or the Batch-Mode header.
+const (
+	// BatchAtomic updates either all metrics of the batch or none of them.
+	BatchAtomic = "atomic"
+
+	// BatchPartial updates every valid metric of the batch
+	// and reports the status of each metric in the response.
+	BatchPartial = "partial"
+)
+
+// BatchModeHeader is the header selecting the batch mode.
+const BatchModeHeader = "Batch-Mode"
+
+// IdempotencyKeyHeader is the header carrying a unique key of the batch.
+// Batches with a key already applied are answered with the original result,
+// but the metrics are not applied again.
+// A key reused for other metrics is rejected with 422 (Unprocessable Entity).
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// maxIdempotencyKeyLength is the maximum length of an idempotency key in bytes.
+const maxIdempotencyKeyLength = 255
+
+// Statuses of a metric in a partial batch.
+const (
+	// StatusAccepted means the metric is stored.
+	StatusAccepted = "accepted"
+
+	// StatusRejected means the metric is invalid or conflicts with the stored one.
+	// Sending it again does not help.
+	StatusRejected = "rejected"
+
+	// StatusFailed means the metric could not be stored because of a server error.
+	// It may be sent again.
+	StatusFailed = "failed"
+)
+
+// ItemResult is the status of a metric in a partial batch.
+type ItemResult struct {
+	ID     string        `json:"id"`
+	MType  string        `json:"type"`
+	Labels metric.Labels `json:"labels,omitempty"`
+	Status string        `json:"status"`
+	Reason string        `json:"reason,omitempty"`
+}
+
+// BatchResult is the response to a partial batch.
+// Results are in the order of the metrics in the request.
+type BatchResult struct {
+	Results []ItemResult `json:"results"`
+}
+
+func batchMode(r *http.Request) string {
+	if mode := r.URL.Query().Get("mode"); mode != "" {
+		return mode
+	}
+	if mode := r.Header.Get(BatchModeHeader); mode != "" {
+		return mode
+	}
+	return BatchAtomic
+}
+
+// putBatch puts metrics with PutBatchOnce if the key is set and with PutBatch otherwise.
+// A duplicate batch is not an error, since it has already been applied.
+func putBatch(ctx context.Context, logger *zap.Logger, repository repo.Repository, key string, metrics []metric.Metric) error {
+	if key == "" {
+		return repository.PutBatch(ctx, metrics)
+	}
+	err := repository.PutBatchOnce(ctx, key, metrics)
+	if errors.Is(err, repo.ErrDuplicateBatch) {
+		logger.Info("Batch " + key + " has already been applied")
+		return nil
+	}
+	return err
+}
+
+// putPartial stores every valid metric and returns the status of each one.
+// Valid metrics of a batch without a key are put in one batch first.
+// If the batch fails, they are put one by one to find out which ones are rejected.
+// Valid metrics of a batch with a key are put with PutPartialOnce, which rejects the conflicting ones
+// and records them with the key, so a replayed batch gets the same result as the original one.
+// If it fails, all valid metrics fail and the batch can be retried safely.
+// The only error returned is ErrBatchKeyReused, since the result of the original batch does not fit the metrics.
+func putPartial(ctx context.Context, logger *zap.Logger, repository repo.Repository, key string, metrics []metric.Metric) (BatchResult, error) {
+	result := BatchResult{Results: make([]ItemResult, len(metrics))}
+	valid := make([]metric.Metric, 0, len(metrics))
+	validIndexes := make([]int, 0, len(metrics))
+	for i, m := range metrics {
+		result.Results[i] = ItemResult{ID: m.ID, MType: m.MType, Labels: m.Labels, Status: StatusAccepted}
+		if err := m.Validate(); err != nil {
+			result.Results[i].Status = StatusRejected
+			result.Results[i].Reason = err.Error()
+			continue
+		}
+		valid = append(valid, m)
+		validIndexes = append(validIndexes, i)
+	}
+
+	if key != "" {
+		rejections, err := repository.PutPartialOnce(ctx, key, valid)
+		switch {
+		case errors.Is(err, repo.ErrDuplicateBatch):
+			logger.Info("Batch " + key + " has already been applied")
+		case errors.Is(err, repo.ErrBatchKeyReused):
+			return BatchResult{}, err
+		case err != nil:
+			logger.Error(err.Error())
+			for _, i := range validIndexes {
+				result.Results[i].Status = StatusFailed
+				result.Results[i].Reason = err.Error()
+			}
+			return result, nil
+		}
+		for _, rejection := range rejections {
+			// The rejections come from the repository, so they are not trusted to fit the batch.
+			if rejection.Index < 0 || rejection.Index >= len(validIndexes) {
+				logger.Error(fmt.Sprintf("Batch %s has a rejection of metric %d out of %d", key, rejection.Index, len(validIndexes)))
+				continue
+			}
+			i := validIndexes[rejection.Index]
+			result.Results[i].Status = StatusRejected
+			result.Results[i].Reason = rejection.Reason
+		}
+		return result, nil
+	}
+
+	err := repository.PutBatch(ctx, valid)
+	if err == nil {
+		return result, nil
+	}
+	logger.Error(err.Error())
+	for j, m := range valid {
+		err := repository.PutMetric(ctx, m)
+		if err == nil {
+			continue
+		}
+		i := validIndexes[j]
+		result.Results[i].Reason = err.Error()
+		if metric.IsConflict(err) {
+			result.Results[i].Status = StatusRejected
+		} else {
+			result.Results[i].Status = StatusFailed
+		}
+	}
+	return result, nil
+}
+
+// statusCode returns 200 (OK) if all metrics are accepted and 207 (Multi-Status) otherwise.
+func (br BatchResult) statusCode() int {
+	for _, item := range br.Results {
+		if item.Status != StatusAccepted {
+			return http.StatusMultiStatus
+		}
+	}
+	return http.StatusOK
+}
@@ -36,15 +36,16 @@ const htmlTemplate = `
 <body>
     <ul>
         {{range .Metrics}}
-        <li>{{.ID}}: {{.Value}}</li>
+        <li>{{.ID}}{{with .Labels}}{{"{"}}{{.}}{{"}"}}{{end}}: {{.Value}}</li>
         {{end}}
     </ul>
 </body>
 `
 
 type htmlMetric struct {
-	ID    string
-	Value string
+	ID     string
+	Labels string
+	Value  string
 }
 
 func responseOnError(logger *zap.Logger, err error, w http.ResponseWriter, statusCode int) {
@@ -52,11 +53,47 @@ func responseOnError(logger *zap.Logger, err error, w http.ResponseWriter, statu
 	w.WriteHeader(statusCode)
 }
 
+// responseOnInvalid responds with 400 (Bad Request)
+// and the list of invalid fields in the JSON body.
+func responseOnInvalid(logger *zap.Logger, err error, w http.ResponseWriter) {
+	logger.Error(err.Error())
+	var verr *metric.ValidationError
+	if !errors.As(err, &verr) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	if err := json.NewEncoder(w).Encode(verr); err != nil {
+		logger.Error(err.Error())
+	}
+}
+
+// putStatusCode returns the status code of a failed update.
+// Updates conflicting with the stored metric type or histogram buckets are rejected with 409 (Conflict),
+// and batches reusing the key of a batch of other metrics with 422 (Unprocessable Entity).
+func putStatusCode(err error) int {
+	if metric.IsConflict(err) {
+		return http.StatusConflict
+	}
+	if errors.Is(err, repo.ErrBatchKeyReused) {
+		return http.StatusUnprocessableEntity
+	}
+	return http.StatusInternalServerError
+}
+
 // NewAllMetricsHandler returns an http.HandlerFunc that generates
 // an HTML list of all metrics from the Repository and writes it to the response.
+// If the label query parameters are set, only the metrics having all of the labels are listed.
 // If an error occurs while retrieving the metrics, it logs the error and returns an appropriate HTTP status code.
 func NewAllMetricsHandler(logger *zap.Logger, repository repo.Repository) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		selector, err := parseLabels(r.URL.Query())
+		if err != nil {
+			http.Error(w, "malformed label: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
 		ctx, cancel := context.WithTimeout(context.Background(), limitInSeconds*time.Second)
 		defer cancel()
 
@@ -69,10 +106,16 @@ func NewAllMetricsHandler(logger *zap.Logger, repository repo.Repository) http.H
 			return
 		}
 
-		metrics := make([]htmlMetric, len(allMetrics))
-		for i, m := range allMetrics {
-			metrics[i].ID = m.ID
-			metrics[i].Value = m.GetValue()
+		metrics := make([]htmlMetric, 0, len(allMetrics))
+		for _, m := range allMetrics {
+			if !m.Labels.Match(selector) {
+				continue
+			}
+			metrics = append(metrics, htmlMetric{
+				ID:     m.ID,
+				Labels: m.Labels.String(),
+				Value:  m.GetValue(),
+			})
 		}
 		data := struct {
 			Metrics []htmlMetric
@@ -90,7 +133,8 @@ func NewAllMetricsHandler(logger *zap.Logger, repository repo.Repository) http.H
 }
 
 // NewValueHandler returns an http.HandlerFunc that writes the value of a specified metric to the response.
-// The metric type and name are extracted from the URL parameters.
+// The metric type and name are extracted from the URL parameters
+// and its labels from the label query parameters.
 // If the metric type is not supported or an error occurs while retrieving the metric,
 // it logs the error and returns an appropriate HTTP status code.
 func NewValueHandler(logger *zap.Logger, repository repo.Repository) http.HandlerFunc {
@@ -99,9 +143,14 @@ func NewValueHandler(logger *zap.Logger, repository repo.Repository) http.Handle
 			metricType = chi.URLParam(r, "metricType")
 			metricName = chi.URLParam(r, "metricName")
 		)
+		labels, err := parseLabels(r.URL.Query())
+		if err != nil {
+			http.Error(w, "malformed label: "+err.Error(), http.StatusBadRequest)
+			return
+		}
 		switch metricType {
-		case metric.Gauge, metric.Counter:
-			m, err := repository.GetMetric(context.Background(), metricName)
+		case metric.Gauge, metric.Counter, metric.Histogram:
+			m, err := repository.GetMetric(context.Background(), metricType, metricName, labels)
 			if err != nil {
 				responseOnError(logger, err, w, http.StatusNotFound)
 				return
@@ -123,7 +172,7 @@ func NewValueHandler(logger *zap.Logger, repository repo.Repository) http.Handle
 // If the repository is an in-memory storage, it returns an error indicating that the database is not in use.
 func NewPingHandler(logger *zap.Logger, repository repo.Repository) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		switch v := repository.(type) {
+		switch v := repo.Unwrap(repository).(type) {
 		case *database.Database:
 			if err := databaseResponse(logger, v, w); err != nil {
 				logger.Error(err.Error())
@@ -151,8 +200,11 @@ func databaseResponse(logger *zap.Logger, db *database.Database, w http.Response
 }
 
 // NewUpdateHandler returns an http.HandlerFunc that updates a specified metric.
-// The metric type, name and value are extracted from the URL parameters.
-// If the metric type is not supported or an error occurs while updating the metric,
+// The metric type, name and value are extracted from the URL parameters
+// and its labels from the label query parameters.
+// Histograms are updated with JSON only, since their buckets do not fit in the URL.
+// If the metric is invalid, it responds with 400 (Bad Request) and the list of invalid fields.
+// If an error occurs while updating the metric,
 // it logs the error and returns an appropriate HTTP status code.
 func NewUpdateHandler(logger *zap.Logger, repository repo.Repository) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -161,6 +213,12 @@ func NewUpdateHandler(logger *zap.Logger, repository repo.Repository) http.Handl
 			metricName  = chi.URLParam(r, "metricName")
 			metricValue = chi.URLParam(r, "metricValue")
 		)
+		labels, err := parseLabels(r.URL.Query())
+		if err != nil {
+			http.Error(w, "malformed label: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		m := metric.Metric{ID: metricName, MType: metricType, Labels: labels}
 		switch metricType {
 		case metric.Gauge:
 			value, err := strconv.ParseFloat(metricValue, 64)
@@ -168,37 +226,34 @@ func NewUpdateHandler(logger *zap.Logger, repository repo.Repository) http.Handl
 				responseOnError(logger, err, w, http.StatusBadRequest)
 				return
 			}
-
-			if err := repository.PutMetric(context.Background(), metric.Metric{ID: metricName, MType: metricType, Value: &value}); err != nil {
-				responseOnError(logger, err, w, http.StatusInternalServerError)
-				return
-			}
-
-			w.Header().Set("Content-Type", "text/plain")
-			w.WriteHeader(http.StatusOK)
+			m.Value = &value
 		case metric.Counter:
 			delta, err := strconv.ParseInt(metricValue, 0, 64)
 			if err != nil {
 				responseOnError(logger, err, w, http.StatusBadRequest)
 				return
 			}
+			m.Delta = &delta
+		}
+		if err := m.Validate(); err != nil {
+			responseOnInvalid(logger, err, w)
+			return
+		}
 
-			if err := repository.PutMetric(context.Background(), metric.Metric{ID: metricName, MType: metricType, Delta: &delta}); err != nil {
-				responseOnError(logger, err, w, http.StatusInternalServerError)
-				return
-			}
-
-			w.Header().Set("Content-Type", "text/plain")
-			w.WriteHeader(http.StatusOK)
-		default:
-			w.WriteHeader(http.StatusBadRequest)
+		if err := repository.PutMetric(context.Background(), m); err != nil {
+			responseOnError(logger, err, w, putStatusCode(err))
+			return
 		}
+
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusOK)
 	}
 }
 
 // NewJSONUpdateHandler returns an http.HandlerFunc that updates a specified metric.
 // The metric is extracted from the JSON body of the request.
-// If the metric type is not supported or an error occurs while updating the metric,
+// If the metric is invalid, it responds with 400 (Bad Request) and the list of invalid fields.
+// If an error occurs while updating the metric,
 // it logs the error and returns an appropriate HTTP status code.
 // After updating the metric, it retrieves the updated metric and returns it in the response.
 func NewJSONUpdateHandler(logger *zap.Logger, repository repo.Repository) http.HandlerFunc {
@@ -208,16 +263,20 @@ func NewJSONUpdateHandler(logger *zap.Logger, repository repo.Repository) http.H
 			responseOnError(logger, err, w, http.StatusBadRequest)
 			return
 		}
+		if err := m.Validate(); err != nil {
+			responseOnInvalid(logger, err, w)
+			return
+		}
 
 		ctx, cancel := context.WithTimeout(context.Background(), limitInSeconds*time.Second)
 		defer cancel()
 
 		if err := repository.PutMetric(ctx, m); err != nil {
-			responseOnError(logger, err, w, http.StatusInternalServerError)
+			responseOnError(logger, err, w, putStatusCode(err))
 			return
 		}
 
-		m, err := repository.GetMetric(ctx, m.ID)
+		m, err := repository.GetMetric(ctx, m.MType, m.ID, m.Labels)
 		if err != nil {
 			responseOnError(logger, err, w, http.StatusInternalServerError)
 			return
@@ -233,10 +292,33 @@ func NewJSONUpdateHandler(logger *zap.Logger, repository repo.Repository) http.H
 
 // NewBatchHandler returns an http.HandlerFunc that updates a batch os metrics.
 // Metrics are extracted from the JSON body of the request.
-// If the metric type is not supported or an error occurs while updating the metric,
+//
+// In the BatchAtomic mode, which is the default, either all metrics are updated or none.
+// If any metric is invalid, it responds with 400 (Bad Request)
+// and the list of invalid fields of all metrics.
+// If an error occurs while updating the metrics,
 // it logs the error and returns an appropriate HTTP status code.
+//
+// In the BatchPartial mode every valid metric is updated
+// and the status of each metric is returned as BatchResult in the JSON body.
+// The response status code is 200 (OK) if all metrics are accepted and 207 (Multi-Status) otherwise.
+//
+// If the request has the Idempotency-Key header, the batch is applied only once
+// and repeated requests with the same key get the original result.
+// A request reusing the key for other metrics gets 422 (Unprocessable Entity).
 func NewBatchHandler(logger *zap.Logger, repository repo.Repository) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		mode := batchMode(r)
+		if mode != BatchAtomic && mode != BatchPartial {
+			http.Error(w, "unknown batch mode: "+mode, http.StatusBadRequest)
+			return
+		}
+		key := r.Header.Get(IdempotencyKeyHeader)
+		if len(key) > maxIdempotencyKeyLength {
+			http.Error(w, "idempotency key is too long", http.StatusBadRequest)
+			return
+		}
+
 		var metrics []metric.Metric
 		if err := json.NewDecoder(r.Body).Decode(&metrics); err != nil {
 			responseOnError(logger, err, w, http.StatusBadRequest)
@@ -246,8 +328,30 @@ func NewBatchHandler(logger *zap.Logger, repository repo.Repository) http.Handle
 		ctx, cancel := context.WithTimeout(context.Background(), limitInSeconds*time.Second)
 		defer cancel()
 
-		if err := repository.PutBatch(ctx, metrics); err != nil {
-			responseOnError(logger, err, w, http.StatusInternalServerError)
+		if mode == BatchPartial {
+			result, err := putPartial(ctx, logger, repository, key, metrics)
+			if err != nil {
+				responseOnError(logger, err, w, putStatusCode(err))
+				return
+			}
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				logger.Error(ctx.Err().Error())
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(result.statusCode())
+			if err := json.NewEncoder(w).Encode(result); err != nil {
+				logger.Error(err.Error())
+			}
+			return
+		}
+
+		if err := metric.ValidateBatch(metrics); err != nil {
+			responseOnInvalid(logger, err, w)
+			return
+		}
+		if err := putBatch(ctx, logger, repository, key, metrics); err != nil {
+			responseOnError(logger, err, w, putStatusCode(err))
 			return
 		}
 		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
@@ -260,7 +364,7 @@ func NewBatchHandler(logger *zap.Logger, repository repo.Repository) http.Handle
 }
 
 // NewJSONValueHandler returns an http.HandlerFunc that writes the JSON of a specified metric to the response.
-// The metric type and name are extracted from the JSON body of the request.
+// The metric type, name and labels are extracted from the JSON body of the request.
 // If the metric type is not supported or an error occurs while updating the metric,
 // it logs the error and returns an appropriate HTTP status code.
 func NewJSONValueHandler(logger *zap.Logger, repository repo.Repository) http.HandlerFunc {
@@ -272,7 +376,7 @@ func NewJSONValueHandler(logger *zap.Logger, repository repo.Repository) http.Ha
 			return
 		}
 
-		m, err := repository.GetMetric(context.Background(), requestedMetric.ID)
+		m, err := repository.GetMetric(context.Background(), requestedMetric.MType, requestedMetric.ID, requestedMetric.Labels)
 		if err != nil {
 			w.Header().Set("Content-Type", "application/json")
 			responseOnError(logger, err, w, http.StatusNotFound)
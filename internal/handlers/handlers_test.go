@@ -4,11 +4,13 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/golang/mock/gomock"
@@ -17,6 +19,7 @@ import (
 
 	"github.com/sudeeya/metrics-harvester/internal/metric"
 	"github.com/sudeeya/metrics-harvester/internal/mocks"
+	repo "github.com/sudeeya/metrics-harvester/internal/repository"
 )
 
 func testRequest(t *testing.T, ts *httptest.Server, method, path string, body io.Reader) (*http.Response, string) {
@@ -45,10 +48,12 @@ func TestAllMetricsHandler(t *testing.T) {
 	metrics := []metric.Metric{
 		{ID: "gauge", MType: metric.Gauge, Value: float64Ptr(12.12)},
 		{ID: "counter", MType: metric.Counter, Delta: int64Ptr(12)},
+		{ID: "requests", MType: metric.Counter, Delta: int64Ptr(3), Labels: metric.Labels{"host": "web1", "env": "prod"}},
 	}
 	repoMock.EXPECT().
 		GetAllMetrics(gomock.Any()).
-		Return(metrics, nil)
+		Return(metrics, nil).
+		AnyTimes()
 
 	logger := zap.NewNop()
 	router := chi.NewRouter()
@@ -57,7 +62,9 @@ func TestAllMetricsHandler(t *testing.T) {
 	defer ts.Close()
 
 	type result struct {
-		code int
+		code     int
+		contains []string
+		excludes []string
 	}
 	tests := []struct {
 		name   string
@@ -68,15 +75,46 @@ func TestAllMetricsHandler(t *testing.T) {
 			name: "simple test",
 			path: "/",
 			result: result{
-				code: http.StatusOK,
+				code:     http.StatusOK,
+				contains: []string{"gauge: 12.12", "counter: 12", "requests{env=&#34;prod&#34;,host=&#34;web1&#34;}: 3"},
+			},
+		},
+		{
+			name: "filter by labels",
+			path: "/?label=host:web1",
+			result: result{
+				code:     http.StatusOK,
+				contains: []string{"requests{"},
+				excludes: []string{"gauge:", "counter:"},
+			},
+		},
+		{
+			name: "filter by mismatching labels",
+			path: "/?label=host:web1&label=env:dev",
+			result: result{
+				code:     http.StatusOK,
+				excludes: []string{"gauge:", "counter:", "requests{"},
+			},
+		},
+		{
+			name: "try to filter by malformed label",
+			path: "/?label=host",
+			result: result{
+				code: http.StatusBadRequest,
 			},
 		},
 	}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			response, _ := testRequest(t, ts, "GET", test.path, nil)
+			response, body := testRequest(t, ts, "GET", test.path, nil)
 			defer response.Body.Close()
 			require.Equal(t, test.result.code, response.StatusCode)
+			for _, s := range test.result.contains {
+				require.Contains(t, body, s)
+			}
+			for _, s := range test.result.excludes {
+				require.NotContains(t, body, s)
+			}
 		})
 	}
 }
@@ -88,14 +126,18 @@ func TestValueHandler(t *testing.T) {
 	gauge := metric.Metric{ID: "gauge", MType: metric.Gauge, Value: float64Ptr(12.12)}
 	counter := metric.Metric{ID: "counter", MType: metric.Counter, Delta: int64Ptr(12)}
 	repoMock.EXPECT().
-		GetMetric(gomock.Any(), "gauge").
+		GetMetric(gomock.Any(), "gauge", "gauge", gomock.Nil()).
 		Return(gauge, nil)
 	repoMock.EXPECT().
-		GetMetric(gomock.Any(), "counter").
+		GetMetric(gomock.Any(), "counter", "counter", gomock.Nil()).
 		Return(counter, nil)
 	repoMock.EXPECT().
-		GetMetric(gomock.Any(), "dummy").
+		GetMetric(gomock.Any(), "gauge", "dummy", gomock.Nil()).
 		Return(metric.Metric{}, errors.New("dummy"))
+	labeled := metric.Metric{ID: "gauge", MType: metric.Gauge, Value: float64Ptr(3.5), Labels: metric.Labels{"host": "web1"}}
+	repoMock.EXPECT().
+		GetMetric(gomock.Any(), "gauge", "gauge", metric.Labels{"host": "web1"}).
+		Return(labeled, nil)
 
 	logger := zap.NewNop()
 	router := chi.NewRouter()
@@ -144,6 +186,22 @@ func TestValueHandler(t *testing.T) {
 				body: "",
 			},
 		},
+		{
+			name: "get labeled gauge",
+			path: "/value/gauge/gauge?label=host:web1",
+			result: result{
+				code: http.StatusOK,
+				body: "3.5",
+			},
+		},
+		{
+			name: "try to get metric with malformed label",
+			path: "/value/gauge/gauge?label=web1",
+			result: result{
+				code: http.StatusBadRequest,
+				body: `malformed label: "web1" is not name:value`,
+			},
+		},
 	}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
@@ -167,6 +225,10 @@ func TestUpdateHandler(t *testing.T) {
 	repoMock.EXPECT().
 		PutMetric(gomock.Any(), counter).
 		Return(nil)
+	labeled := metric.Metric{ID: "counter", MType: metric.Counter, Delta: int64Ptr(12), Labels: metric.Labels{"host": "web1", "env": "prod"}}
+	repoMock.EXPECT().
+		PutMetric(gomock.Any(), labeled).
+		Return(nil)
 
 	logger := zap.NewNop()
 	router := chi.NewRouter()
@@ -217,6 +279,34 @@ func TestUpdateHandler(t *testing.T) {
 				code: http.StatusBadRequest,
 			},
 		},
+		{
+			name: "try to update gauge with NaN",
+			path: "/update/gauge/gauge/NaN",
+			result: result{
+				code: http.StatusBadRequest,
+			},
+		},
+		{
+			name: "try to update metric with invalid name",
+			path: "/update/gauge/gauge%20name/12.12",
+			result: result{
+				code: http.StatusBadRequest,
+			},
+		},
+		{
+			name: "update labeled counter",
+			path: "/update/counter/counter/12?label=host:web1&label=env:prod",
+			result: result{
+				code: http.StatusOK,
+			},
+		},
+		{
+			name: "try to update metric with invalid label name",
+			path: "/update/counter/counter/12?label=__host:web1",
+			result: result{
+				code: http.StatusBadRequest,
+			},
+		},
 	}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
@@ -238,7 +328,7 @@ func TestJSONUpdateHandler(t *testing.T) {
 			PutMetric(gomock.Any(), gauge).
 			Return(nil),
 		repoMock.EXPECT().
-			GetMetric(gomock.Any(), "gauge").
+			GetMetric(gomock.Any(), "gauge", "gauge", gomock.Nil()).
 			Return(gauge, nil),
 	)
 	gomock.InOrder(
@@ -246,9 +336,36 @@ func TestJSONUpdateHandler(t *testing.T) {
 			PutMetric(gomock.Any(), counter).
 			Return(nil),
 		repoMock.EXPECT().
-			GetMetric(gomock.Any(), "counter").
+			GetMetric(gomock.Any(), "counter", "counter", gomock.Nil()).
 			Return(counter, nil),
 	)
+	labeled := metric.Metric{ID: "gauge", MType: metric.Gauge, Value: float64Ptr(3.5), Labels: metric.Labels{"service": "api"}}
+	gomock.InOrder(
+		repoMock.EXPECT().
+			PutMetric(gomock.Any(), labeled).
+			Return(nil),
+		repoMock.EXPECT().
+			GetMetric(gomock.Any(), "gauge", "gauge", labeled.Labels).
+			Return(labeled, nil),
+	)
+
+	histogram := metric.Metric{ID: "latency", MType: metric.Histogram, Histogram: &metric.HistogramValue{
+		Bounds: []float64{0.1, 0.5}, Counts: []int64{2, 1, 0}, Count: 3, Sum: 0.45,
+	}}
+	gomock.InOrder(
+		repoMock.EXPECT().
+			PutMetric(gomock.Any(), histogram).
+			Return(nil),
+		repoMock.EXPECT().
+			GetMetric(gomock.Any(), "histogram", "latency", gomock.Nil()).
+			Return(histogram, nil),
+	)
+	conflicting := metric.Metric{ID: "latency", MType: metric.Histogram, Histogram: &metric.HistogramValue{
+		Bounds: []float64{1}, Counts: []int64{1, 0}, Count: 1, Sum: 0.5,
+	}}
+	repoMock.EXPECT().
+		PutMetric(gomock.Any(), conflicting).
+		Return(metric.ErrBucketsConflict)
 
 	logger := zap.NewNop()
 	router := chi.NewRouter()
@@ -258,6 +375,9 @@ func TestJSONUpdateHandler(t *testing.T) {
 
 	jsonCounter, _ := json.Marshal(counter)
 	jsonGauge, _ := json.Marshal(gauge)
+	jsonLabeled, _ := json.Marshal(labeled)
+	jsonHistogram, _ := json.Marshal(histogram)
+	jsonConflicting, _ := json.Marshal(conflicting)
 	type result struct {
 		code int
 		body string
@@ -286,6 +406,69 @@ func TestJSONUpdateHandler(t *testing.T) {
 				body: string(jsonGauge),
 			},
 		},
+		{
+			name: "try to update gauge without value",
+			path: "/update/",
+			body: strings.NewReader(`{"id":"gauge","type":"gauge"}`),
+			result: result{
+				code: http.StatusBadRequest,
+				body: `{"errors":[{"field":"value","message":"is required for gauge"}]}`,
+			},
+		},
+		{
+			name: "try to update counter with value",
+			path: "/update/",
+			body: strings.NewReader(`{"id":"counter","type":"counter","delta":12,"value":12.12}`),
+			result: result{
+				code: http.StatusBadRequest,
+				body: `{"errors":[{"field":"value","message":"must be absent for counter"}]}`,
+			},
+		},
+		{
+			name: "update labeled gauge",
+			path: "/update/",
+			body: bytes.NewReader(jsonLabeled),
+			result: result{
+				code: http.StatusOK,
+				body: string(jsonLabeled),
+			},
+		},
+		{
+			name: "try to update gauge with empty label",
+			path: "/update/",
+			body: strings.NewReader(`{"id":"gauge","type":"gauge","value":1,"labels":{"env":""}}`),
+			result: result{
+				code: http.StatusBadRequest,
+				body: `{"errors":[{"field":"labels.env","message":"must not be empty"}]}`,
+			},
+		},
+		{
+			name: "update histogram",
+			path: "/update/",
+			body: bytes.NewReader(jsonHistogram),
+			result: result{
+				code: http.StatusOK,
+				body: string(jsonHistogram),
+			},
+		},
+		{
+			name: "try to update histogram with other buckets",
+			path: "/update/",
+			body: bytes.NewReader(jsonConflicting),
+			result: result{
+				code: http.StatusConflict,
+				body: "",
+			},
+		},
+		{
+			name: "try to update histogram with wrong count",
+			path: "/update/",
+			body: strings.NewReader(`{"id":"latency","type":"histogram","histogram":{"bounds":[1],"counts":[1,1],"count":1,"sum":2}}`),
+			result: result{
+				code: http.StatusBadRequest,
+				body: `{"errors":[{"field":"histogram.count","message":"must be the sum of counts"}]}`,
+			},
+		},
 	}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
@@ -318,6 +501,7 @@ func TestBatchHandler(t *testing.T) {
 	jsonMetrics, _ := json.Marshal(metrics)
 	type result struct {
 		code int
+		body string
 	}
 	tests := []struct {
 		name   string
@@ -333,12 +517,331 @@ func TestBatchHandler(t *testing.T) {
 				code: http.StatusOK,
 			},
 		},
+		{
+			name: "try to update batch with invalid metrics",
+			path: "/updates/",
+			body: strings.NewReader(`[{"id":"gauge","type":"gauge","value":12.12},{"id":"counter","type":"counter"},{"id":"dummy","type":"dummy"}]`),
+			result: result{
+				code: http.StatusBadRequest,
+				body: `{"errors":[{"field":"[1].delta","message":"is required for counter"},{"field":"[2].type","message":"must be gauge, counter or histogram"}]}`,
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response, body := testRequest(t, ts, "POST", test.path, test.body)
+			defer response.Body.Close()
+			require.Equal(t, test.result.code, response.StatusCode)
+			require.Equal(t, test.result.body, body)
+		})
+	}
+}
+
+func TestBatchHandler_Partial(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	repoMock := mocks.NewMockRepository(ctrl)
+	gauge := metric.Metric{ID: "gauge", MType: metric.Gauge, Value: float64Ptr(12.12)}
+	counter := metric.Metric{ID: "counter", MType: metric.Counter, Delta: int64Ptr(12)}
+	repoMock.EXPECT().
+		PutBatch(gomock.Any(), []metric.Metric{gauge}).
+		Return(nil)
+	gomock.InOrder(
+		repoMock.EXPECT().
+			PutBatch(gomock.Any(), []metric.Metric{gauge, counter}).
+			Return(metric.ErrTypeConflict),
+		repoMock.EXPECT().
+			PutMetric(gomock.Any(), gauge).
+			Return(nil),
+		repoMock.EXPECT().
+			PutMetric(gomock.Any(), counter).
+			Return(metric.ErrTypeConflict),
+	)
+
+	logger := zap.NewNop()
+	router := chi.NewRouter()
+	router.Post("/updates/", NewBatchHandler(logger, repoMock))
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	type result struct {
+		code int
+		body string
+	}
+	tests := []struct {
+		name   string
+		path   string
+		mode   string
+		body   string
+		result result
+	}{
+		{
+			name: "invalid metric is rejected",
+			path: "/updates/?mode=partial",
+			body: `[{"id":"gauge","type":"gauge","value":12.12},{"id":"counter","type":"counter"}]`,
+			result: result{
+				code: http.StatusMultiStatus,
+				body: `{"results":[{"id":"gauge","type":"gauge","status":"accepted"},` +
+					`{"id":"counter","type":"counter","status":"rejected","reason":"invalid metric: delta: is required for counter"}]}`,
+			},
+		},
+		{
+			name: "conflict is rejected",
+			path: "/updates/",
+			mode: BatchPartial,
+			body: `[{"id":"gauge","type":"gauge","value":12.12},{"id":"counter","type":"counter","delta":12}]`,
+			result: result{
+				code: http.StatusMultiStatus,
+				body: `{"results":[{"id":"gauge","type":"gauge","status":"accepted"},` +
+					`{"id":"counter","type":"counter","status":"rejected","reason":"metric type conflict"}]}`,
+			},
+		},
+		{
+			name: "unknown mode",
+			path: "/updates/?mode=dummy",
+			body: `[]`,
+			result: result{
+				code: http.StatusBadRequest,
+				body: "unknown batch mode: dummy",
+			},
+		},
 	}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			response, _ := testRequest(t, ts, "POST", test.path, test.body)
+			req, err := http.NewRequest("POST", ts.URL+test.path, strings.NewReader(test.body))
+			require.NoError(t, err)
+			if test.mode != "" {
+				req.Header.Set(BatchModeHeader, test.mode)
+			}
+			response, err := ts.Client().Do(req)
+			require.NoError(t, err)
 			defer response.Body.Close()
+			body, err := io.ReadAll(response.Body)
+			require.NoError(t, err)
 			require.Equal(t, test.result.code, response.StatusCode)
+			require.Equal(t, test.result.body, strings.TrimSpace(string(body)))
+		})
+	}
+}
+
+func TestBatchHandler_IdempotencyKey(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	repoMock := mocks.NewMockRepository(ctrl)
+	metrics := []metric.Metric{
+		{ID: "counter", MType: metric.Counter, Delta: int64Ptr(12)},
+	}
+	gomock.InOrder(
+		repoMock.EXPECT().
+			PutBatchOnce(gomock.Any(), "key", metrics).
+			Return(nil),
+		repoMock.EXPECT().
+			PutBatchOnce(gomock.Any(), "key", metrics).
+			Return(repo.ErrDuplicateBatch),
+	)
+
+	logger := zap.NewNop()
+	router := chi.NewRouter()
+	router.Post("/updates/", NewBatchHandler(logger, repoMock))
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	jsonMetrics, _ := json.Marshal(metrics)
+	for _, name := range []string{"first request", "replayed request"} {
+		t.Run(name, func(t *testing.T) {
+			req, err := http.NewRequest("POST", ts.URL+"/updates/", bytes.NewReader(jsonMetrics))
+			require.NoError(t, err)
+			req.Header.Set(IdempotencyKeyHeader, "key")
+			response, err := ts.Client().Do(req)
+			require.NoError(t, err)
+			defer response.Body.Close()
+			require.Equal(t, http.StatusOK, response.StatusCode)
+		})
+	}
+}
+
+func TestBatchHandler_PartialIdempotencyKey(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	repoMock := mocks.NewMockRepository(ctrl)
+	counter := metric.Metric{ID: "counter", MType: metric.Counter, Delta: int64Ptr(12)}
+	histogram := metric.Metric{ID: "latency", MType: metric.Histogram, Histogram: &metric.HistogramValue{
+		Bounds: []float64{1}, Counts: []int64{1, 0}, Count: 1, Sum: 0.5,
+	}}
+	rejections := []repo.Rejection{{Index: 1, Reason: "histogram buckets conflict: latency"}}
+	gomock.InOrder(
+		repoMock.EXPECT().
+			PutPartialOnce(gomock.Any(), "key", []metric.Metric{counter, histogram}).
+			Return(rejections, nil),
+		repoMock.EXPECT().
+			PutPartialOnce(gomock.Any(), "key", []metric.Metric{counter, histogram}).
+			Return(rejections, repo.ErrDuplicateBatch),
+	)
+
+	logger := zap.NewNop()
+	router := chi.NewRouter()
+	router.Post("/updates/", NewBatchHandler(logger, repoMock))
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	body := `[{"id":"counter","type":"counter","delta":12},{"id":"gauge","type":"gauge"},` +
+		`{"id":"latency","type":"histogram","histogram":{"bounds":[1],"counts":[1,0],"count":1,"sum":0.5}}]`
+	expected := `{"results":[{"id":"counter","type":"counter","status":"accepted"},` +
+		`{"id":"gauge","type":"gauge","status":"rejected","reason":"invalid metric: value: is required for gauge"},` +
+		`{"id":"latency","type":"histogram","status":"rejected","reason":"histogram buckets conflict: latency"}]}`
+	// The replayed request gets the result of the original one, although nothing is applied.
+	for _, name := range []string{"first request", "replayed request"} {
+		t.Run(name, func(t *testing.T) {
+			req, err := http.NewRequest("POST", ts.URL+"/updates/?mode=partial", strings.NewReader(body))
+			require.NoError(t, err)
+			req.Header.Set(IdempotencyKeyHeader, "key")
+			response, err := ts.Client().Do(req)
+			require.NoError(t, err)
+			defer response.Body.Close()
+			responseBody, err := io.ReadAll(response.Body)
+			require.NoError(t, err)
+			require.Equal(t, http.StatusMultiStatus, response.StatusCode)
+			require.Equal(t, expected, strings.TrimSpace(string(responseBody)))
+		})
+	}
+}
+
+func TestBatchHandler_ReusedIdempotencyKey(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	repoMock := mocks.NewMockRepository(ctrl)
+	counter := metric.Metric{ID: "counter", MType: metric.Counter, Delta: int64Ptr(12)}
+	repoMock.EXPECT().
+		PutBatchOnce(gomock.Any(), "reused", []metric.Metric{counter}).
+		Return(repo.ErrBatchKeyReused)
+	repoMock.EXPECT().
+		PutPartialOnce(gomock.Any(), "reused", []metric.Metric{counter}).
+		Return(nil, repo.ErrBatchKeyReused)
+	// The rejections of a replayed batch must not be trusted to fit the request.
+	repoMock.EXPECT().
+		PutPartialOnce(gomock.Any(), "replayed", []metric.Metric{counter}).
+		Return([]repo.Rejection{{Index: 3, Reason: "dummy"}}, repo.ErrDuplicateBatch)
+
+	logger := zap.NewNop()
+	router := chi.NewRouter()
+	router.Post("/updates/", NewBatchHandler(logger, repoMock))
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	tests := []struct {
+		name string
+		path string
+		key  string
+		code int
+	}{
+		{name: "atomic batch reusing key", path: "/updates/", key: "reused", code: http.StatusUnprocessableEntity},
+		{name: "partial batch reusing key", path: "/updates/?mode=partial", key: "reused", code: http.StatusUnprocessableEntity},
+		{name: "rejection out of range", path: "/updates/?mode=partial", key: "replayed", code: http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req, err := http.NewRequest("POST", ts.URL+test.path, strings.NewReader(`[{"id":"counter","type":"counter","delta":12}]`))
+			require.NoError(t, err)
+			req.Header.Set(IdempotencyKeyHeader, test.key)
+			response, err := ts.Client().Do(req)
+			require.NoError(t, err)
+			defer response.Body.Close()
+			require.Equal(t, test.code, response.StatusCode)
+		})
+	}
+}
+
+func TestHistoryHandler(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	repoMock := mocks.NewMockRepository(ctrl)
+	from := time.Date(2024, time.October, 1, 12, 0, 0, 0, time.UTC)
+	to := from.Add(time.Hour)
+	points := []metric.Point{
+		{Time: from.Add(10 * time.Second), Value: float64Ptr(1)},
+		{Time: from.Add(20 * time.Second), Value: float64Ptr(2)},
+		{Time: from.Add(70 * time.Second), Value: float64Ptr(3)},
+	}
+	repoMock.EXPECT().
+		GetHistory(gomock.Any(), "gauge", "gauge", gomock.Nil(), from, to).
+		Return(points, nil).
+		Times(2)
+	repoMock.EXPECT().
+		GetHistory(gomock.Any(), "gauge", "dummy", gomock.Nil(), gomock.Any(), gomock.Any()).
+		Return(nil, errors.New("dummy"))
+
+	logger := zap.NewNop()
+	router := chi.NewRouter()
+	router.Get("/history/{metricType}/{metricName}", NewHistoryHandler(logger, repoMock))
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	jsonHistory := func(points ...metric.Point) string {
+		history, _ := json.Marshal(History{ID: "gauge", MType: metric.Gauge, Points: points})
+		return string(history)
+	}
+	type result struct {
+		code int
+		body string
+	}
+	tests := []struct {
+		name   string
+		path   string
+		result result
+	}{
+		{
+			name: "all points",
+			path: "/history/gauge/gauge?from=2024-10-01T12:00:00Z&to=2024-10-01T13:00:00Z",
+			result: result{
+				code: http.StatusOK,
+				body: jsonHistory(points...),
+			},
+		},
+		{
+			name: "points with step in Unix seconds",
+			path: fmt.Sprintf("/history/gauge/gauge?from=%d&to=%d&step=1m", from.Unix(), to.Unix()),
+			result: result{
+				code: http.StatusOK,
+				body: jsonHistory(points[1], points[2]),
+			},
+		},
+		{
+			name: "try to get history of non-existent metric",
+			path: "/history/gauge/dummy",
+			result: result{
+				code: http.StatusNotFound,
+			},
+		},
+		{
+			name: "try to get history of metric of non-existent type",
+			path: "/history/dummy/dummy",
+			result: result{
+				code: http.StatusBadRequest,
+			},
+		},
+		{
+			name: "try to get history with malformed step",
+			path: "/history/gauge/gauge?step=dummy",
+			result: result{
+				code: http.StatusBadRequest,
+				body: `malformed step: time: invalid duration "dummy"`,
+			},
+		},
+		{
+			name: "try to get history with from after to",
+			path: "/history/gauge/gauge?from=2024-10-01T13:00:00Z&to=2024-10-01T12:00:00Z",
+			result: result{
+				code: http.StatusBadRequest,
+				body: "from is after to",
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response, body := testRequest(t, ts, "GET", test.path, nil)
+			defer response.Body.Close()
+			require.Equal(t, test.result.code, response.StatusCode)
+			require.Equal(t, test.result.body, body)
 		})
 	}
 }
@@ -350,10 +853,10 @@ func TestJSONValueHandler(t *testing.T) {
 	gauge := metric.Metric{ID: "gauge", MType: metric.Gauge, Value: float64Ptr(12.12)}
 	counter := metric.Metric{ID: "counter", MType: metric.Counter, Delta: int64Ptr(12)}
 	repoMock.EXPECT().
-		GetMetric(gomock.Any(), "gauge").
+		GetMetric(gomock.Any(), "gauge", "gauge", gomock.Nil()).
 		Return(gauge, nil)
 	repoMock.EXPECT().
-		GetMetric(gomock.Any(), "counter").
+		GetMetric(gomock.Any(), "counter", "counter", gomock.Nil()).
 		Return(counter, nil)
 
 	logger := zap.NewNop()
@@ -404,3 +907,212 @@ func TestJSONValueHandler(t *testing.T) {
 		})
 	}
 }
+
+func TestPrometheusHandler(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	repoMock := mocks.NewMockRepository(ctrl)
+	metrics := []metric.Metric{
+		{ID: "1requests.total", MType: metric.Counter, Delta: int64Ptr(3), Labels: metric.Labels{"host": `web "1"`}},
+		{ID: "Alloc", MType: metric.Gauge, Value: float64Ptr(2)},
+		{ID: "latency", MType: metric.Histogram, Histogram: &metric.HistogramValue{
+			Bounds: []float64{0.1, 1}, Counts: []int64{1, 2, 1}, Count: 4, Sum: 3.5,
+		}},
+		{ID: "latency", MType: metric.Gauge, Value: float64Ptr(1)},
+	}
+	repoMock.EXPECT().
+		GetAllMetrics(gomock.Any()).
+		Return(metrics, nil).
+		AnyTimes()
+
+	logger := zap.NewNop()
+	router := chi.NewRouter()
+	router.Get("/metrics", NewPrometheusHandler(logger, repoMock))
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	type result struct {
+		contentType string
+		body        string
+	}
+	tests := []struct {
+		name   string
+		accept string
+		result result
+	}{
+		{
+			name: "text format",
+			result: result{
+				contentType: "text/plain; version=0.0.4; charset=utf-8",
+				body: `# TYPE Alloc gauge
+Alloc 2
+# TYPE _1requests_total counter
+_1requests_total{host="web \"1\""} 3
+# TYPE latency histogram
+latency_bucket{le="0.1"} 1
+latency_bucket{le="1"} 3
+latency_bucket{le="+Inf"} 4
+latency_sum 3.5
+latency_count 4`,
+			},
+		},
+		{
+			name:   "OpenMetrics",
+			accept: "application/openmetrics-text;version=1.0.0,text/plain;version=0.0.4;q=0.5,*/*;q=0.1",
+			result: result{
+				contentType: "application/openmetrics-text; version=1.0.0; charset=utf-8",
+				body: `# TYPE Alloc gauge
+Alloc 2.0
+# TYPE _1requests counter
+_1requests_total{host="web \"1\""} 3
+# TYPE latency histogram
+latency_bucket{le="0.1"} 1
+latency_bucket{le="1.0"} 3
+latency_bucket{le="+Inf"} 4
+latency_sum 3.5
+latency_count 4
+# EOF`,
+			},
+		},
+		{
+			name:   "text format preferred",
+			accept: "application/openmetrics-text;q=0.5,text/plain",
+			result: result{
+				contentType: "text/plain; version=0.0.4; charset=utf-8",
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req, err := http.NewRequest("GET", ts.URL+"/metrics", nil)
+			require.NoError(t, err)
+			if test.accept != "" {
+				req.Header.Set("Accept", test.accept)
+			}
+			response, err := ts.Client().Do(req)
+			require.NoError(t, err)
+			defer response.Body.Close()
+			body, err := io.ReadAll(response.Body)
+			require.NoError(t, err)
+			require.Equal(t, http.StatusOK, response.StatusCode)
+			require.Equal(t, test.result.contentType, response.Header.Get("Content-Type"))
+			if test.result.body != "" {
+				require.Equal(t, test.result.body, strings.TrimSpace(string(body)))
+			}
+		})
+	}
+}
+
+func TestPrometheusHandler_Collisions(t *testing.T) {
+	tests := []struct {
+		name    string
+		accept  string
+		metrics []metric.Metric
+		body    string
+	}{
+		{
+			name: "sanitized names",
+			metrics: []metric.Metric{
+				{ID: "a.b", MType: metric.Gauge, Value: float64Ptr(1)},
+				{ID: "a_b", MType: metric.Gauge, Value: float64Ptr(2)},
+				{ID: "a_b", MType: metric.Gauge, Value: float64Ptr(3), Labels: metric.Labels{"host": "web"}},
+			},
+			body: `# TYPE a_b gauge
+a_b 1
+a_b{host="web"} 3`,
+		},
+		{
+			name:   "OpenMetrics counter suffix",
+			accept: "application/openmetrics-text",
+			metrics: []metric.Metric{
+				{ID: "x", MType: metric.Counter, Delta: int64Ptr(1)},
+				{ID: "x_total", MType: metric.Counter, Delta: int64Ptr(2)},
+			},
+			body: `# TYPE x counter
+x_total 1
+# EOF`,
+		},
+		{
+			name: "histogram samples",
+			metrics: []metric.Metric{
+				{ID: "h", MType: metric.Histogram, Histogram: &metric.HistogramValue{
+					Bounds: []float64{1}, Counts: []int64{1, 0}, Count: 1, Sum: 0.5,
+				}},
+				{ID: "h_sum", MType: metric.Gauge, Value: float64Ptr(1)},
+			},
+			body: `# TYPE h histogram
+h_bucket{le="1"} 1
+h_bucket{le="+Inf"} 1
+h_sum 0.5
+h_count 1`,
+		},
+		{
+			name: "family name of histogram sample",
+			metrics: []metric.Metric{
+				{ID: "foo_count", MType: metric.Gauge, Value: float64Ptr(1), Labels: metric.Labels{"host": "web"}},
+				{ID: "foo", MType: metric.Histogram, Histogram: &metric.HistogramValue{
+					Bounds: []float64{1}, Counts: []int64{1, 0}, Count: 1, Sum: 0.5,
+				}},
+				{ID: "foo_bucket", MType: metric.Counter, Delta: int64Ptr(1), Labels: metric.Labels{"host": "web"}},
+			},
+			// The histogram is not exposed, so its names are left to the counter.
+			body: `# TYPE foo_bucket counter
+foo_bucket{host="web"} 1
+# TYPE foo_count gauge
+foo_count{host="web"} 1`,
+		},
+		{
+			name: "histogram sample name of family",
+			metrics: []metric.Metric{
+				{ID: "foo", MType: metric.Histogram, Histogram: &metric.HistogramValue{
+					Bounds: []float64{1}, Counts: []int64{1, 0}, Count: 1, Sum: 0.5,
+				}},
+				{ID: "foo_sum", MType: metric.Gauge, Value: float64Ptr(1), Labels: metric.Labels{"host": "web"}},
+			},
+			body: `# TYPE foo histogram
+foo_bucket{le="1"} 1
+foo_bucket{le="+Inf"} 1
+foo_sum 0.5
+foo_count 1`,
+		},
+		{
+			name: "histogram with bucket label",
+			metrics: []metric.Metric{
+				{ID: "h", MType: metric.Histogram, Labels: metric.Labels{"le": "x"}, Histogram: &metric.HistogramValue{
+					Bounds: []float64{0.5}, Counts: []int64{1, 0}, Count: 1, Sum: 0.25,
+				}},
+				{ID: "g", MType: metric.Gauge, Value: float64Ptr(1), Labels: metric.Labels{"le": "x"}},
+			},
+			body: `# TYPE g gauge
+g{le="x"} 1`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			repoMock := mocks.NewMockRepository(ctrl)
+			repoMock.EXPECT().
+				GetAllMetrics(gomock.Any()).
+				Return(test.metrics, nil)
+
+			router := chi.NewRouter()
+			router.Get("/metrics", NewPrometheusHandler(zap.NewNop(), repoMock))
+			ts := httptest.NewServer(router)
+			defer ts.Close()
+
+			req, err := http.NewRequest("GET", ts.URL+"/metrics", nil)
+			require.NoError(t, err)
+			if test.accept != "" {
+				req.Header.Set("Accept", test.accept)
+			}
+			response, err := ts.Client().Do(req)
+			require.NoError(t, err)
+			defer response.Body.Close()
+			body, err := io.ReadAll(response.Body)
+			require.NoError(t, err)
+			require.Equal(t, http.StatusOK, response.StatusCode)
+			require.Equal(t, test.body, strings.TrimSpace(string(body)))
+		})
+	}
+}
@@ -0,0 +1,131 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"go.uber.org/zap"
+
+	"github.com/sudeeya/metrics-harvester/internal/metric"
+	repo "github.com/sudeeya/metrics-harvester/internal/repository"
+)
+
+// defaultHistoryRange is the range of history returned if from is not specified.
+const defaultHistoryRange = time.Hour
+
+// History is the response of the history endpoint.
+type History struct {
+	ID     string         `json:"id"`
+	MType  string         `json:"type"`
+	Labels metric.Labels  `json:"labels,omitempty"`
+	Points []metric.Point `json:"points"`
+}
+
+// NewHistoryHandler returns an http.HandlerFunc that writes the history of a specified metric as JSON.
+// The metric type and name are extracted from the URL parameters
+// and its labels from the label query parameters.
+// The range is set by the from and to query parameters,
+// given as RFC 3339 timestamps or Unix seconds.
+// By default, to is the current time and from is one hour earlier.
+// If the step query parameter is set, as a duration like 1m or in seconds,
+// only the last point of every step is returned.
+// If the parameters are malformed, it returns 400 (Bad Request),
+// and if the metric could not be found, it returns 404 (Not Found).
+func NewHistoryHandler(logger *zap.Logger, repository repo.Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			metricType = chi.URLParam(r, "metricType")
+			metricName = chi.URLParam(r, "metricName")
+			query      = r.URL.Query()
+		)
+		if metricType != metric.Gauge && metricType != metric.Counter && metricType != metric.Histogram {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		labels, err := parseLabels(query)
+		if err != nil {
+			http.Error(w, "malformed label: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		to, err := parseTime(query.Get("to"), time.Now())
+		if err != nil {
+			http.Error(w, "malformed to: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		from, err := parseTime(query.Get("from"), to.Add(-defaultHistoryRange))
+		if err != nil {
+			http.Error(w, "malformed from: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if from.After(to) {
+			http.Error(w, "from is after to", http.StatusBadRequest)
+			return
+		}
+		step, err := parseStep(query.Get("step"))
+		if err != nil {
+			http.Error(w, "malformed step: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), limitInSeconds*time.Second)
+		defer cancel()
+
+		points, err := repository.GetHistory(ctx, metricType, metricName, labels, from, to)
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			logger.Error(ctx.Err().Error())
+		}
+		if err != nil {
+			responseOnError(logger, err, w, http.StatusNotFound)
+			return
+		}
+
+		history := History{
+			ID:     metricName,
+			MType:  metricType,
+			Labels: labels,
+			Points: metric.Downsample(points, from, step),
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(history); err != nil {
+			logger.Error(err.Error())
+		}
+	}
+}
+
+// parseTime parses an RFC 3339 timestamp or Unix seconds.
+// Returns def if the value is empty.
+func parseTime(value string, def time.Time) (time.Time, error) {
+	if value == "" {
+		return def, nil
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0).UTC(), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// parseStep parses a duration like 1m or a number of seconds.
+// Returns zero if the value is empty.
+func parseStep(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		value = strconv.FormatInt(seconds, 10) + "s"
+	}
+	step, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if step < 0 {
+		return 0, errors.New("step must not be negative")
+	}
+	return step, nil
+}
@@ -0,0 +1,38 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/sudeeya/metrics-harvester/internal/metric"
+)
+
+// labelParam is the query parameter setting a label as name:value.
+// It may be repeated to set several labels.
+const labelParam = "label"
+
+// parseLabels returns the labels set by the label query parameters.
+// Returns nil if there are none, so unlabeled requests select unlabeled metrics.
+func parseLabels(query url.Values) (metric.Labels, error) {
+	params := query[labelParam]
+	if len(params) == 0 {
+		return nil, nil
+	}
+	labels := make(metric.Labels, len(params))
+	for _, param := range params {
+		name, value, ok := strings.Cut(param, ":")
+		if !ok {
+			return nil, fmt.Errorf("%q is not name:value", param)
+		}
+		if name == "" {
+			return nil, errors.New("label name is empty")
+		}
+		if _, ok := labels[name]; ok {
+			return nil, fmt.Errorf("label %s is repeated", name)
+		}
+		labels[name] = value
+	}
+	return labels, nil
+}
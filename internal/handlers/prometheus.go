@@ -0,0 +1,297 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/sudeeya/metrics-harvester/internal/metric"
+	repo "github.com/sudeeya/metrics-harvester/internal/repository"
+)
+
+// Content types of the exposition formats.
+const (
+	prometheusContentType  = "text/plain; version=0.0.4; charset=utf-8"
+	openMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+	openMetricsMediaType   = "application/openmetrics-text"
+)
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// family is a group of metrics exposed under the same name.
+type family struct {
+	name    string
+	mType   string
+	metrics []metric.Metric
+}
+
+// NewPrometheusHandler returns an http.HandlerFunc that writes all metrics from the Repository
+// in the Prometheus text exposition format, or in OpenMetrics if the Accept header prefers it.
+// Gauges, counters and histograms are exposed as the matching Prometheus types and keep their labels.
+// Characters of the names not allowed by Prometheus are replaced with '_'.
+// If several metrics get the same name with different types, expose the same series
+// or use the names of each other's samples, only the first one is exposed.
+// Histograms with the le label are not exposed, since their bucket samples would repeat it.
+// If an error occurs while retrieving the metrics, it logs the error and returns an appropriate HTTP status code.
+func NewPrometheusHandler(logger *zap.Logger, repository repo.Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(context.Background(), limitInSeconds*time.Second)
+		defer cancel()
+
+		allMetrics, err := repository.GetAllMetrics(ctx)
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			logger.Error(ctx.Err().Error())
+		}
+		if err != nil {
+			responseOnError(logger, err, w, http.StatusInternalServerError)
+			return
+		}
+
+		openMetrics := prefersOpenMetrics(r.Header.Get("Accept"))
+		var b bytes.Buffer
+		for _, f := range groupFamilies(logger, allMetrics, openMetrics) {
+			f.write(&b, openMetrics)
+		}
+		contentType := prometheusContentType
+		if openMetrics {
+			b.WriteString("# EOF\n")
+			contentType = openMetricsContentType
+		}
+
+		w.Header().Set("Content-Type", contentType)
+		w.WriteHeader(http.StatusOK)
+		if _, err := w.Write(b.Bytes()); err != nil {
+			logger.Error(err.Error())
+		}
+	}
+}
+
+// prefersOpenMetrics reports whether the Accept header gives OpenMetrics
+// a higher quality than the Prometheus text format.
+func prefersOpenMetrics(accept string) bool {
+	var openMetrics, text float64
+	for _, mediaRange := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(mediaRange)
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if value, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(value, 64); err != nil {
+				continue
+			}
+		}
+		switch mediaType {
+		case openMetricsMediaType:
+			openMetrics = max(openMetrics, q)
+		case "text/plain", "text/*", "*/*":
+			text = max(text, q)
+		}
+	}
+	return openMetrics > text
+}
+
+// groupFamilies groups the metrics by their exposed names and sorts the families by name.
+// A metric whose samples have the name and the labels of the samples of an earlier metric is skipped,
+// since sanitizing may give several names the same form.
+// So is a metric whose family or sample names are used by another family,
+// like a gauge foo_count next to a histogram foo, since parsers would mix up their samples.
+// A histogram with the label reserved for its buckets is skipped too.
+func groupFamilies(logger *zap.Logger, metrics []metric.Metric, openMetrics bool) []*family {
+	byName := make(map[string]*family)
+	families := make([]*family, 0, len(metrics))
+	// exposedBy maps every exposed series, which is a sample name with labels, to its metric.
+	exposedBy := make(map[string]metric.Metric)
+	// usedBy maps the family and sample names to the family using them.
+	usedBy := make(map[string]*family)
+	for _, m := range metrics {
+		// Such a histogram may have been stored before the label was reserved.
+		if _, ok := m.Labels[metric.BucketLabel]; ok && m.MType == metric.Histogram {
+			logger.Error(fmt.Sprintf("%s %s is not exposed, since its label %s is reserved", m.MType, m.ID, metric.BucketLabel))
+			continue
+		}
+		name := familyName(m, openMetrics)
+		f, ok := byName[name]
+		if ok && f.mType != m.MType {
+			logger.Error(fmt.Sprintf("%s %s is not exposed, since %s is %s", m.MType, m.ID, name, f.mType))
+			continue
+		}
+		samples := sampleNames(name, m.MType, openMetrics)
+		if other := nameClash(usedBy, f, append([]string{name}, samples...)); other != nil {
+			logger.Error(fmt.Sprintf("%s %s is not exposed, since its names clash with %s %s",
+				m.MType, m.ID, other.mType, other.name))
+			continue
+		}
+		series := make([]string, 0, len(samples))
+		for _, sample := range samples {
+			series = append(series, sample+"{"+m.Labels.String()+"}")
+		}
+		if owner, collides := collision(exposedBy, series); collides {
+			logger.Error(fmt.Sprintf("%s %s is not exposed, since %s %s is exposed as %s",
+				m.MType, m.ID, owner.MType, owner.ID, name))
+			continue
+		}
+		for _, s := range series {
+			exposedBy[s] = m
+		}
+		if !ok {
+			f = &family{name: name, mType: m.MType}
+			byName[name] = f
+			families = append(families, f)
+			usedBy[name] = f
+			for _, sample := range samples {
+				usedBy[sample] = f
+			}
+		}
+		f.metrics = append(f.metrics, m)
+	}
+	slices.SortFunc(families, func(a, b *family) int {
+		return strings.Compare(a.name, b.name)
+	})
+	return families
+}
+
+// familyName returns the sanitized name of the metric.
+// In OpenMetrics the _total suffix of a counter belongs to its samples, not to the family.
+func familyName(m metric.Metric, openMetrics bool) string {
+	name := sanitizeName(m.ID)
+	if openMetrics && m.MType == metric.Counter {
+		name = strings.TrimSuffix(name, "_total")
+	}
+	return name
+}
+
+// sampleNames returns the names of the samples of a metric of the type in the family.
+func sampleNames(name, mType string, openMetrics bool) []string {
+	switch {
+	case mType == metric.Counter && openMetrics:
+		return []string{name + "_total"}
+	case mType == metric.Histogram:
+		return []string{name + "_bucket", name + "_sum", name + "_count"}
+	}
+	return []string{name}
+}
+
+// collision returns the metric which already exposes any of the series.
+func collision(exposedBy map[string]metric.Metric, series []string) (metric.Metric, bool) {
+	for _, s := range series {
+		if owner, ok := exposedBy[s]; ok {
+			return owner, true
+		}
+	}
+	return metric.Metric{}, false
+}
+
+// nameClash returns the family other than f which uses any of the names.
+// f is nil if the family of the names does not exist yet.
+func nameClash(usedBy map[string]*family, f *family, names []string) *family {
+	for _, name := range names {
+		if other, ok := usedBy[name]; ok && other != f {
+			return other
+		}
+	}
+	return nil
+}
+
+// sanitizeName replaces the characters not allowed in Prometheus names with '_'
+// and prefixes a name starting with a digit with '_'.
+func sanitizeName(id string) string {
+	var b strings.Builder
+	for i, r := range id {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_', r == ':':
+		case r >= '0' && r <= '9':
+			if i == 0 {
+				b.WriteByte('_')
+			}
+		default:
+			r = '_'
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func (f *family) write(b *bytes.Buffer, openMetrics bool) {
+	fmt.Fprintf(b, "# TYPE %s %s\n", f.name, f.mType)
+	for _, m := range f.metrics {
+		switch m.MType {
+		case metric.Gauge:
+			writeSample(b, f.name, m.Labels, "", "", formatFloat(*m.Value, openMetrics))
+		case metric.Counter:
+			name := f.name
+			if openMetrics {
+				name += "_total"
+			}
+			writeSample(b, name, m.Labels, "", "", strconv.FormatInt(*m.Delta, 10))
+		case metric.Histogram:
+			h := m.Histogram
+			var cumulative int64
+			for i, count := range h.Counts {
+				cumulative += count
+				bound := math.Inf(1)
+				if i < len(h.Bounds) {
+					bound = h.Bounds[i]
+				}
+				writeSample(b, f.name+"_bucket", m.Labels, metric.BucketLabel, formatFloat(bound, openMetrics), strconv.FormatInt(cumulative, 10))
+			}
+			writeSample(b, f.name+"_sum", m.Labels, "", "", formatFloat(h.Sum, openMetrics))
+			writeSample(b, f.name+"_count", m.Labels, "", "", strconv.FormatInt(h.Count, 10))
+		}
+	}
+}
+
+// writeSample writes a sample line with the labels of the metric
+// and the extra label, such as le of a histogram bucket, if its name is set.
+func writeSample(b *bytes.Buffer, name string, labels metric.Labels, extraName, extraValue, value string) {
+	b.WriteString(name)
+	names := make([]string, 0, len(labels))
+	for labelName := range labels {
+		names = append(names, labelName)
+	}
+	slices.Sort(names)
+	if len(names) > 0 || extraName != "" {
+		b.WriteByte('{')
+		for i, labelName := range names {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			fmt.Fprintf(b, `%s="%s"`, labelName, labelValueReplacer.Replace(labels[labelName]))
+		}
+		if extraName != "" {
+			if len(names) > 0 {
+				b.WriteByte(',')
+			}
+			fmt.Fprintf(b, `%s="%s"`, extraName, extraValue)
+		}
+		b.WriteByte('}')
+	}
+	b.WriteByte(' ')
+	b.WriteString(value)
+	b.WriteByte('\n')
+}
+
+// formatFloat formats the value like Prometheus does.
+// OpenMetrics requires integral values to have a fractional part, like 1.0.
+func formatFloat(value float64, openMetrics bool) string {
+	s := strconv.FormatFloat(value, 'g', -1, 64)
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case openMetrics && !strings.ContainsAny(s, ".eN"):
+		return s + ".0"
+	}
+	return s
+}
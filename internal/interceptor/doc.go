@@ -0,0 +1,4 @@
+// Package interceptor provides a collection of gRPC server interceptors.
+// They mirror the HTTP middleware from the middleware package,
+// such as logging, signing and trusted subnet checks, for the gRPC transport.
+package interceptor
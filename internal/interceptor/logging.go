@@ -0,0 +1,44 @@
+package interceptor
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// UnaryLogging provides an interceptor that handles logging of unary gRPC calls.
+// The following details are logged for each call:
+// - Full method name
+// - Status code
+// - Time taken to respond
+func UnaryLogging(logger *zap.Logger) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		logCall(logger, info.FullMethod, err, time.Since(start))
+		return resp, err
+	}
+}
+
+// StreamLogging provides an interceptor that handles logging of streaming gRPC calls.
+// The same details as in UnaryLogging are logged.
+func StreamLogging(logger *zap.Logger) grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		start := time.Now()
+		err := handler(srv, ss)
+		logCall(logger, info.FullMethod, err, time.Since(start))
+		return err
+	}
+}
+
+func logCall(logger *zap.Logger, method string, err error, duration time.Duration) {
+	sugar := logger.Sugar()
+	sugar.Infoln(
+		"method", method,
+		"status", status.Code(err).String(),
+		"duration", duration,
+	)
+}
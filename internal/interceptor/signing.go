@@ -0,0 +1,180 @@
+package interceptor
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// HashKey is the metadata key carrying the HMAC signature.
+// It is the gRPC counterpart of the HashSHA256 HTTP header.
+const HashKey = "hashsha256"
+
+var errNotProto = errors.New("message is not a protobuf message")
+
+// Sign returns the hex encoded HMAC-SHA256 of the messages.
+// Each message is marshaled deterministically and the results are hashed in order,
+// so a client stream is signed as the sequence of all its messages.
+func Sign(key []byte, messages ...any) (string, error) {
+	h := hmac.New(sha256.New, key)
+	for _, message := range messages {
+		if err := writeMessage(h, message); err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func writeMessage(h hash.Hash, message any) error {
+	pm, ok := message.(proto.Message)
+	if !ok {
+		return errNotProto
+	}
+	data, err := proto.MarshalOptions{Deterministic: true}.Marshal(pm)
+	if err != nil {
+		return err
+	}
+	_, err = h.Write(data)
+	return err
+}
+
+// expectedHash returns the signature from the incoming metadata.
+// If the call is unsigned, it fails in strict mode and logs the call otherwise.
+func expectedHash(ctx context.Context, logger *zap.Logger, strict bool, method string) ([]byte, error) {
+	var hexHash string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(HashKey); len(values) > 0 {
+			hexHash = values[0]
+		}
+	}
+	if hexHash == "" {
+		if strict {
+			return nil, status.Error(codes.InvalidArgument, "call must be signed")
+		}
+		logger.Sugar().Warnln("unsigned call", "method", method)
+		return nil, nil
+	}
+	expected, err := hex.DecodeString(hexHash)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "malformed signature")
+	}
+	return expected, nil
+}
+
+// UnarySigning provides an interceptor that handles signing of unary gRPC calls.
+// If the key is empty does nothing.
+// Otherwise, it checks the hashsha256 metadata of the request.
+// If the signature is malformed or incorrect, the call fails with codes.InvalidArgument.
+// Unsigned calls fail the same way if strict is set and are logged otherwise.
+// The response is signed in the hashsha256 header metadata.
+func UnarySigning(logger *zap.Logger, key []byte, strict bool) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if len(key) == 0 {
+			return handler(ctx, req)
+		}
+
+		expected, err := expectedHash(ctx, logger, strict, info.FullMethod)
+		if err != nil {
+			return nil, err
+		}
+		if expected != nil {
+			h := hmac.New(sha256.New, key)
+			if err := writeMessage(h, req); err != nil {
+				return nil, status.Error(codes.Internal, err.Error())
+			}
+			if !hmac.Equal(expected, h.Sum(nil)) {
+				return nil, status.Error(codes.InvalidArgument, "signature mismatch")
+			}
+		}
+
+		resp, err := handler(ctx, req)
+		if err != nil {
+			return resp, err
+		}
+		signature, err := Sign(key, resp)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		if err := grpc.SetHeader(ctx, metadata.Pairs(HashKey, signature)); err != nil {
+			return nil, err
+		}
+		return resp, nil
+	}
+}
+
+type signedServerStream struct {
+	grpc.ServerStream
+	key      []byte
+	expected []byte
+	h        hash.Hash
+}
+
+// RecvMsg hashes every received message and verifies the signature
+// once the client closes its side of the stream.
+func (s *signedServerStream) RecvMsg(m any) error {
+	err := s.ServerStream.RecvMsg(m)
+	if errors.Is(err, io.EOF) {
+		if s.expected != nil && !hmac.Equal(s.expected, s.h.Sum(nil)) {
+			return status.Error(codes.InvalidArgument, "signature mismatch")
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if s.expected != nil {
+		if err := writeMessage(s.h, m); err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+	}
+	return nil
+}
+
+// SendMsg signs the response message in the header metadata.
+func (s *signedServerStream) SendMsg(m any) error {
+	signature, err := Sign(s.key, m)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	if err := s.SetHeader(metadata.Pairs(HashKey, signature)); err != nil {
+		return err
+	}
+	return s.ServerStream.SendMsg(m)
+}
+
+// StreamSigning provides an interceptor that handles signing of streaming gRPC calls.
+// If the key is empty does nothing.
+// Otherwise, the hashsha256 metadata is checked against all received messages
+// when the client closes the stream, so handlers must not apply
+// the received messages before io.EOF.
+// If the signature is incorrect, receiving fails with codes.InvalidArgument.
+// Unsigned calls are handled the same way as in UnarySigning.
+func StreamSigning(logger *zap.Logger, key []byte, strict bool) grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if len(key) == 0 {
+			return handler(srv, ss)
+		}
+
+		expected, err := expectedHash(ss.Context(), logger, strict, info.FullMethod)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &signedServerStream{
+			ServerStream: ss,
+			key:          key,
+			expected:     expected,
+			h:            hmac.New(sha256.New, key),
+		})
+	}
+}
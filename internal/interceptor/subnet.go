@@ -0,0 +1,55 @@
+package interceptor
+
+import (
+	"context"
+	"net"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// RealIPKey is the metadata key carrying the client address.
+// It is the gRPC counterpart of the X-Real-IP HTTP header.
+const RealIPKey = "x-real-ip"
+
+func checkSubnet(ctx context.Context, subnet *net.IPNet) error {
+	if subnet == nil {
+		return nil
+	}
+	var ip net.IP
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(RealIPKey); len(values) > 0 {
+			ip = net.ParseIP(values[0])
+		}
+	}
+	if ip == nil || !subnet.Contains(ip) {
+		return status.Error(codes.PermissionDenied, "client is outside the trusted subnet")
+	}
+	return nil
+}
+
+// UnaryTrustedSubnet provides an interceptor that restricts unary calls to clients from the trusted subnet.
+// If the subnet is nil does nothing.
+// Otherwise, it checks the x-real-ip metadata of the request.
+// If the address is missing or outside the subnet, the call fails with codes.PermissionDenied.
+func UnaryTrustedSubnet(subnet *net.IPNet) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if err := checkSubnet(ctx, subnet); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamTrustedSubnet provides an interceptor that restricts streaming calls to clients from the trusted subnet.
+// It behaves the same way as UnaryTrustedSubnet.
+func StreamTrustedSubnet(subnet *net.IPNet) grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := checkSubnet(ss.Context(), subnet); err != nil {
+			return err
+		}
+		return handler(srv, ss)
+	}
+}
@@ -0,0 +1,117 @@
+package metric
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MaxBuckets is the maximum number of bucket bounds of a histogram.
+const MaxBuckets = 64
+
+// ErrBucketsConflict is returned when a histogram is merged with a histogram of other buckets.
+var ErrBucketsConflict = errors.New("histogram buckets conflict")
+
+// ErrHistogramOverflow is returned when merging histograms overflows a count or makes the sum infinite.
+var ErrHistogramOverflow = errors.New("histogram overflow")
+
+// HistogramValue is the distribution of observed values over buckets.
+// Like the delta of a counter, an update carries the observations made since the previous one,
+// and the stored histogram accumulates them.
+type HistogramValue struct {
+	// Bounds are the inclusive upper bounds of the buckets in ascending order.
+	Bounds []float64 `json:"bounds"`
+
+	// Counts are the numbers of observations in each bucket, not cumulative.
+	// The last bucket has no upper bound, so there is one count more than bounds.
+	Counts []int64 `json:"counts"`
+
+	// Count is the total number of observations.
+	Count int64 `json:"count"`
+
+	// Sum is the sum of the observed values.
+	Sum float64 `json:"sum"`
+}
+
+// NewHistogramValue returns an empty histogram with the bounds.
+func NewHistogramValue(bounds []float64) *HistogramValue {
+	return &HistogramValue{
+		Bounds: slices.Clone(bounds),
+		Counts: make([]int64, len(bounds)+1),
+	}
+}
+
+// Observe adds the value to the bucket with the lowest bound not less than it.
+func (h *HistogramValue) Observe(value float64) {
+	h.Counts[sort.SearchFloat64s(h.Bounds, value)]++
+	h.Count++
+	h.Sum += value
+}
+
+// merge returns a new histogram with the observations of both histograms.
+// Returns ErrBucketsConflict if the bounds differ
+// and ErrHistogramOverflow if a count overflows or the sum is not finite.
+func (h *HistogramValue) merge(update *HistogramValue) (*HistogramValue, error) {
+	if !slices.Equal(h.Bounds, update.Bounds) {
+		return nil, ErrBucketsConflict
+	}
+	merged := &HistogramValue{
+		Bounds: slices.Clone(h.Bounds),
+		Counts: make([]int64, len(h.Counts)),
+		Sum:    h.Sum + update.Sum,
+	}
+	if math.IsInf(merged.Sum, 0) || math.IsNaN(merged.Sum) {
+		return nil, ErrHistogramOverflow
+	}
+	var ok bool
+	if merged.Count, ok = addCounts(h.Count, update.Count); !ok {
+		return nil, ErrHistogramOverflow
+	}
+	for i := range merged.Counts {
+		if merged.Counts[i], ok = addCounts(h.Counts[i], update.Counts[i]); !ok {
+			return nil, ErrHistogramOverflow
+		}
+	}
+	return merged, nil
+}
+
+// addCounts returns the sum of the counts and false if it overflows int64.
+func addCounts(a, b int64) (int64, bool) {
+	sum := a + b
+	return sum, (b >= 0) == (sum >= a)
+}
+
+// clone returns a deep copy of the histogram.
+func (h *HistogramValue) clone() *HistogramValue {
+	return &HistogramValue{
+		Bounds: slices.Clone(h.Bounds),
+		Counts: slices.Clone(h.Counts),
+		Count:  h.Count,
+		Sum:    h.Sum,
+	}
+}
+
+// String returns the count, the sum and the count of every bucket by its bound,
+// like count=3 sum=1.5 buckets=[0.5:2 1:1 +Inf:0].
+func (h *HistogramValue) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "count=%d sum=%v buckets=[", h.Count, h.Sum)
+	for i, count := range h.Counts {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		if i < len(h.Bounds) {
+			b.WriteString(strconv.FormatFloat(h.Bounds[i], 'g', -1, 64))
+		} else {
+			b.WriteString("+Inf")
+		}
+		b.WriteByte(':')
+		b.WriteString(strconv.FormatInt(count, 10))
+	}
+	b.WriteByte(']')
+	return b.String()
+}
@@ -0,0 +1,45 @@
+package metric
+
+import "time"
+
+// Point is the state of a metric at some moment.
+// For a counter or a histogram it holds the total after the update, not the delta of the update.
+type Point struct {
+	// Time is the moment the metric was updated.
+	Time time.Time `json:"time"`
+
+	// Delta stores a pointer if the type is Counter. Otherwise it is nil.
+	Delta *int64 `json:"delta,omitempty"`
+
+	// Value stores a pointer if the type is Gauge. Otherwise it is nil.
+	Value *float64 `json:"value,omitempty"`
+
+	// Histogram stores a pointer if the type is Histogram. Otherwise it is nil.
+	Histogram *HistogramValue `json:"histogram,omitempty"`
+}
+
+// Point returns the current state of the metric at the moment t.
+func (m Metric) Point(t time.Time) Point {
+	return Point{Time: t, Delta: m.Delta, Value: m.Value, Histogram: m.Histogram}
+}
+
+// Downsample keeps the last point of every step long interval starting at from.
+// The points must be sorted by time and must not be earlier than from.
+// If step is not positive, the points are returned as is.
+func Downsample(points []Point, from time.Time, step time.Duration) []Point {
+	if step <= 0 || len(points) == 0 {
+		return points
+	}
+	result := make([]Point, 0, len(points))
+	bucket := int64(-1)
+	for _, p := range points {
+		current := int64(p.Time.Sub(from) / step)
+		if current == bucket {
+			result[len(result)-1] = p
+			continue
+		}
+		bucket = current
+		result = append(result, p)
+	}
+	return result
+}
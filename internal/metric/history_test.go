@@ -0,0 +1,50 @@
+package metric
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDownsample(t *testing.T) {
+	from := time.Date(2024, time.October, 1, 12, 0, 0, 0, time.UTC)
+	points := []Point{
+		{Time: from, Value: float64Ptr(1)},
+		{Time: from.Add(20 * time.Second), Value: float64Ptr(2)},
+		{Time: from.Add(70 * time.Second), Value: float64Ptr(3)},
+		{Time: from.Add(100 * time.Second), Value: float64Ptr(4)},
+		{Time: from.Add(200 * time.Second), Value: float64Ptr(5)},
+	}
+	tests := []struct {
+		name   string
+		step   time.Duration
+		result []float64
+	}{
+		{
+			name:   "no step",
+			step:   0,
+			result: []float64{1, 2, 3, 4, 5},
+		},
+		{
+			name:   "minute step",
+			step:   time.Minute,
+			result: []float64{2, 4, 5},
+		},
+		{
+			name:   "step longer than the range",
+			step:   time.Hour,
+			result: []float64{5},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			downsampled := Downsample(points, from, test.step)
+			values := make([]float64, len(downsampled))
+			for i, p := range downsampled {
+				values[i] = *p.Value
+			}
+			require.Equal(t, test.result, values)
+		})
+	}
+}
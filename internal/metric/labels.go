@@ -0,0 +1,53 @@
+package metric
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Labels are the dimensions of a metric, such as host, service or env.
+// Metrics with the same type and name but different labels are different metrics,
+// and a metric without labels is the same as before labels were introduced.
+// Labels must not be modified once the metric is stored.
+type Labels map[string]string
+
+// String returns the canonical form of the labels:
+// pairs like name="value" sorted by name and separated by commas.
+// Values are quoted as Go strings. Empty labels give an empty string.
+func (l Labels) String() string {
+	if len(l) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	for i, name := range l.names() {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteByte('=')
+		b.WriteString(strconv.Quote(l[name]))
+	}
+	return b.String()
+}
+
+// names returns the label names in ascending order.
+func (l Labels) names() []string {
+	names := make([]string, 0, len(l))
+	for name := range l {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// Match reports whether the labels have every pair of the selector.
+// An empty selector matches any labels.
+func (l Labels) Match(selector Labels) bool {
+	for name, value := range selector {
+		if v, ok := l[name]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
@@ -1,14 +1,38 @@
 // Package metric provides methods for working with metrics.
 package metric
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+)
 
 // Types of metrics.
 const (
-	Gauge   = "gauge"
-	Counter = "counter"
+	Gauge     = "gauge"
+	Counter   = "counter"
+	Histogram = "histogram"
 )
 
+// ErrTypeConflict is returned when a metric is merged with a metric of another type.
+var ErrTypeConflict = errors.New("metric type conflict")
+
+// IsConflict reports whether the error is a conflict of an update with the stored metric,
+// either of the type or of the histogram buckets, or an update overflowing the stored histogram.
+// Such an update is rejected every time it is sent.
+func IsConflict(err error) bool {
+	return errors.Is(err, ErrTypeConflict) || errors.Is(err, ErrBucketsConflict) ||
+		errors.Is(err, ErrHistogramOverflow)
+}
+
+// Key identifies a metric.
+// Metrics of different types or labels may have the same name.
+type Key struct {
+	MType string
+	ID    string
+	// Labels is the canonical form of the labels.
+	Labels string
+}
+
 // Metric contains metric parameters.
 type Metric struct {
 	// ID identifies the metric.
@@ -22,20 +46,85 @@ type Metric struct {
 
 	// Value stores a pointer if the type is Gauge. Otherwise it is nil.
 	Value *float64 `json:"value,omitempty"`
+
+	// Histogram stores a pointer if the type is Histogram. Otherwise it is nil.
+	Histogram *HistogramValue `json:"histogram,omitempty"`
+
+	// Labels are the optional dimensions of the metric.
+	Labels Labels `json:"labels,omitempty"`
+}
+
+// Key returns the identity of the metric.
+func (m Metric) Key() Key {
+	return Key{MType: m.MType, ID: m.ID, Labels: m.Labels.String()}
 }
 
-// Update changes the value depending on the type of metric.
+// Update changes the value depending on the type of metric:
+// a gauge takes a float64, a counter adds an int64 and a histogram observes a float64.
+// Updates of the wrong type are ignored.
 func (m *Metric) Update(update any) {
 	switch m.MType {
 	case Gauge:
-		newValue := update.(float64)
-		m.Value = &newValue
+		if newValue, ok := update.(float64); ok {
+			m.Value = &newValue
+		}
 	case Counter:
-		delta := update.(int64)
-		*m.Delta += delta
+		if delta, ok := update.(int64); ok {
+			*m.Delta += delta
+		}
+	case Histogram:
+		if value, ok := update.(float64); ok {
+			m.Histogram.Observe(value)
+		}
 	}
 }
 
+// Merge applies the update to the metric depending on the type of metric:
+// a gauge takes the new value, a counter adds the delta
+// and a histogram adds the observations of every bucket, the count and the sum.
+// The pointers of the metric are replaced rather than modified,
+// so copies of the metric made before Merge are not affected.
+// Returns ErrTypeConflict if the types differ, ErrBucketsConflict if histograms have different bounds
+// and ErrHistogramOverflow if the merged histogram overflows.
+func (m *Metric) Merge(update Metric) error {
+	if m.MType != update.MType {
+		return fmt.Errorf("%w: %s is %s, not %s", ErrTypeConflict, m.ID, m.MType, update.MType)
+	}
+	switch m.MType {
+	case Gauge:
+		if update.Value == nil {
+			return fmt.Errorf("gauge %s has no value", update.ID)
+		}
+		value := *update.Value
+		m.Value = &value
+	case Counter:
+		if update.Delta == nil {
+			return fmt.Errorf("counter %s has no delta", update.ID)
+		}
+		delta := *update.Delta
+		if m.Delta != nil {
+			delta += *m.Delta
+		}
+		m.Delta = &delta
+	case Histogram:
+		if update.Histogram == nil {
+			return fmt.Errorf("histogram %s has no buckets", update.ID)
+		}
+		if m.Histogram == nil {
+			m.Histogram = update.Histogram.clone()
+			return nil
+		}
+		merged, err := m.Histogram.merge(update.Histogram)
+		if err != nil {
+			return fmt.Errorf("%w: %s", err, m.ID)
+		}
+		m.Histogram = merged
+	default:
+		return fmt.Errorf("unknown metric type: %s", m.MType)
+	}
+	return nil
+}
+
 // GetValue returns the value in string format depending on the type of metric.
 func (m Metric) GetValue() string {
 	var value string
@@ -44,6 +133,30 @@ func (m Metric) GetValue() string {
 		value = fmt.Sprintf("%v", *m.Value)
 	case Counter:
 		value = fmt.Sprintf("%v", *m.Delta)
+	case Histogram:
+		value = m.Histogram.String()
 	}
 	return value
 }
+
+// Collapse merges the updates of the same metric, so every metric occurs once:
+// a gauge keeps the last value, the deltas of a counter are summed
+// and the observations of a histogram are added up.
+// Metrics are returned in the order of their first occurrence.
+// Merge errors, such as a gauge without a value, are returned as is.
+func Collapse(metrics []Metric) ([]Metric, error) {
+	indexes := make(map[Key]int, len(metrics))
+	collapsed := make([]Metric, 0, len(metrics))
+	for _, m := range metrics {
+		i, ok := indexes[m.Key()]
+		if !ok {
+			i = len(collapsed)
+			indexes[m.Key()] = i
+			collapsed = append(collapsed, Metric{ID: m.ID, MType: m.MType, Labels: m.Labels})
+		}
+		if err := collapsed[i].Merge(m); err != nil {
+			return nil, err
+		}
+	}
+	return collapsed, nil
+}
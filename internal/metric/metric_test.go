@@ -1,6 +1,8 @@
 package metric
 
 import (
+	"fmt"
+	"math"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -33,6 +35,14 @@ func TestUpdate(t *testing.T) {
 			update: int64(12),
 			result: &Metric{ID: "counter", MType: Counter, Delta: int64Ptr(24)},
 		},
+		{
+			name:   "update histogram",
+			m:      &Metric{ID: "histogram", MType: Histogram, Histogram: NewHistogramValue([]float64{0.5, 1})},
+			update: float64(0.5),
+			result: &Metric{ID: "histogram", MType: Histogram, Histogram: &HistogramValue{
+				Bounds: []float64{0.5, 1}, Counts: []int64{1, 0, 0}, Count: 1, Sum: 0.5,
+			}},
+		},
 	}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
@@ -41,3 +51,154 @@ func TestUpdate(t *testing.T) {
 		})
 	}
 }
+
+func TestMerge(t *testing.T) {
+	tests := []struct {
+		name    string
+		m       *Metric
+		update  Metric
+		result  string
+		wantErr error
+	}{
+		{
+			name:   "merge gauge",
+			m:      &Metric{ID: "gauge", MType: Gauge, Value: float64Ptr(12)},
+			update: Metric{ID: "gauge", MType: Gauge, Value: float64Ptr(12.12)},
+			result: "12.12",
+		},
+		{
+			name:   "merge counter",
+			m:      &Metric{ID: "counter", MType: Counter, Delta: int64Ptr(12)},
+			update: Metric{ID: "counter", MType: Counter, Delta: int64Ptr(12)},
+			result: "24",
+		},
+		{
+			name:    "merge counter into gauge",
+			m:       &Metric{ID: "dummy", MType: Gauge, Value: float64Ptr(12)},
+			update:  Metric{ID: "dummy", MType: Counter, Delta: int64Ptr(12)},
+			result:  "12",
+			wantErr: ErrTypeConflict,
+		},
+		{
+			name: "merge histogram",
+			m: &Metric{ID: "histogram", MType: Histogram, Histogram: &HistogramValue{
+				Bounds: []float64{0.5, 1}, Counts: []int64{1, 0, 2}, Count: 3, Sum: 5.25,
+			}},
+			update: Metric{ID: "histogram", MType: Histogram, Histogram: &HistogramValue{
+				Bounds: []float64{0.5, 1}, Counts: []int64{0, 1, 0}, Count: 1, Sum: 0.75,
+			}},
+			result: "count=4 sum=6 buckets=[0.5:1 1:1 +Inf:2]",
+		},
+		{
+			name: "merge histogram into empty histogram",
+			m:    &Metric{ID: "histogram", MType: Histogram},
+			update: Metric{ID: "histogram", MType: Histogram, Histogram: &HistogramValue{
+				Bounds: []float64{0.5}, Counts: []int64{0, 1}, Count: 1, Sum: 0.75,
+			}},
+			result: "count=1 sum=0.75 buckets=[0.5:0 +Inf:1]",
+		},
+		{
+			name: "merge histogram with other buckets",
+			m: &Metric{ID: "histogram", MType: Histogram, Histogram: &HistogramValue{
+				Bounds: []float64{0.5}, Counts: []int64{1, 0}, Count: 1, Sum: 0.25,
+			}},
+			update: Metric{ID: "histogram", MType: Histogram, Histogram: &HistogramValue{
+				Bounds: []float64{1}, Counts: []int64{1, 0}, Count: 1, Sum: 0.25,
+			}},
+			result:  "count=1 sum=0.25 buckets=[0.5:1 +Inf:0]",
+			wantErr: ErrBucketsConflict,
+		},
+		{
+			name: "merge histogram with infinite sum",
+			m: &Metric{ID: "histogram", MType: Histogram, Histogram: &HistogramValue{
+				Bounds: []float64{0.5}, Counts: []int64{0, 1}, Count: 1, Sum: math.MaxFloat64,
+			}},
+			update: Metric{ID: "histogram", MType: Histogram, Histogram: &HistogramValue{
+				Bounds: []float64{0.5}, Counts: []int64{0, 1}, Count: 1, Sum: math.MaxFloat64,
+			}},
+			result:  fmt.Sprintf("count=1 sum=%v buckets=[0.5:0 +Inf:1]", math.MaxFloat64),
+			wantErr: ErrHistogramOverflow,
+		},
+		{
+			name: "merge histogram with overflowing count",
+			m: &Metric{ID: "histogram", MType: Histogram, Histogram: &HistogramValue{
+				Bounds: []float64{0.5}, Counts: []int64{0, math.MaxInt64}, Count: math.MaxInt64, Sum: 1,
+			}},
+			update: Metric{ID: "histogram", MType: Histogram, Histogram: &HistogramValue{
+				Bounds: []float64{0.5}, Counts: []int64{0, 1}, Count: 1, Sum: 1,
+			}},
+			result:  fmt.Sprintf("count=%d sum=1 buckets=[0.5:0 +Inf:%d]", int64(math.MaxInt64), int64(math.MaxInt64)),
+			wantErr: ErrHistogramOverflow,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.m.Merge(test.update)
+			if test.wantErr != nil {
+				require.ErrorIs(t, err, test.wantErr)
+			} else {
+				require.NoError(t, err)
+			}
+			require.Equal(t, test.result, test.m.GetValue())
+		})
+	}
+}
+
+func TestCollapse(t *testing.T) {
+	metrics := []Metric{
+		{ID: "counter", MType: Counter, Delta: int64Ptr(1)},
+		{ID: "gauge", MType: Gauge, Value: float64Ptr(1)},
+		{ID: "counter", MType: Counter, Delta: int64Ptr(2)},
+		{ID: "gauge", MType: Gauge, Value: float64Ptr(2)},
+		{ID: "gauge", MType: Counter, Delta: int64Ptr(3)},
+	}
+	collapsed, err := Collapse(metrics)
+	require.NoError(t, err)
+	require.Len(t, collapsed, 3)
+	require.Equal(t, Key{MType: Counter, ID: "counter"}, collapsed[0].Key())
+	require.Equal(t, "3", collapsed[0].GetValue())
+	require.Equal(t, Key{MType: Gauge, ID: "gauge"}, collapsed[1].Key())
+	require.Equal(t, "2", collapsed[1].GetValue())
+	require.Equal(t, Key{MType: Counter, ID: "gauge"}, collapsed[2].Key())
+	require.Equal(t, "3", collapsed[2].GetValue())
+	require.Equal(t, int64(1), *metrics[0].Delta, "input must not be modified")
+
+	_, err = Collapse([]Metric{{ID: "gauge", MType: Gauge}})
+	require.Error(t, err)
+}
+
+func BenchmarkCollapse(b *testing.B) {
+	metrics := make([]Metric, 0, 3000)
+	for i := range 100 {
+		for j := range 30 {
+			id := fmt.Sprintf("metric%d", j)
+			if j%2 == 0 {
+				metrics = append(metrics, Metric{ID: id, MType: Gauge, Value: float64Ptr(float64(i))})
+			} else {
+				metrics = append(metrics, Metric{ID: id, MType: Counter, Delta: int64Ptr(int64(i))})
+			}
+		}
+	}
+	b.ResetTimer()
+	for range b.N {
+		if _, err := Collapse(metrics); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestLabels(t *testing.T) {
+	labels := Labels{"service": "api", "host": `web "1"`}
+	require.Equal(t, `host="web \"1\"",service="api"`, labels.String())
+	require.Equal(t, "", Labels(nil).String())
+
+	require.True(t, labels.Match(nil))
+	require.True(t, labels.Match(Labels{"host": `web "1"`}))
+	require.False(t, labels.Match(Labels{"host": "web2"}))
+	require.False(t, labels.Match(Labels{"env": "prod"}))
+
+	unlabeled := Metric{ID: "gauge", MType: Gauge}
+	labeled := Metric{ID: "gauge", MType: Gauge, Labels: labels}
+	require.NotEqual(t, unlabeled.Key(), labeled.Key())
+	require.Equal(t, unlabeled.Key(), Metric{ID: "gauge", MType: Gauge, Labels: Labels{}}.Key())
+}
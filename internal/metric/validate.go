@@ -0,0 +1,212 @@
+package metric
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+)
+
+// MaxIDLength is the maximum length of a metric name in bytes.
+const MaxIDLength = 255
+
+// MaxLabels is the maximum number of labels of a metric.
+const MaxLabels = 16
+
+// MaxLabelValueLength is the maximum length of a label value in bytes.
+const MaxLabelValueLength = 255
+
+// BucketLabel is the label of the bucket bound of a histogram sample in Prometheus,
+// so histograms must not have a label of that name.
+const BucketLabel = "le"
+
+// FieldError describes an invalid field of a metric.
+type FieldError struct {
+	// Field is the JSON name of the field.
+	// In a batch it is prefixed with the index of the metric, e.g. "[2].value".
+	Field string `json:"field"`
+
+	// Message explains why the field is invalid.
+	Message string `json:"message"`
+}
+
+// ValidationError lists all invalid fields of one or several metrics.
+type ValidationError struct {
+	Fields []FieldError `json:"errors"`
+}
+
+func (e *ValidationError) Error() string {
+	messages := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		messages[i] = f.Field + ": " + f.Message
+	}
+	return "invalid metric: " + strings.Join(messages, "; ")
+}
+
+func (e *ValidationError) add(field, message string) {
+	e.Fields = append(e.Fields, FieldError{Field: field, Message: message})
+}
+
+// Validate checks that the metric can be stored.
+// The type must be supported, the field matching the type must be set
+// and the other ones must be absent, a gauge value must be finite,
+// histogram bounds must be finite and strictly ascending, with a non-negative count per bucket
+// and one more bucket for the values above the last bound,
+// and the name must be a non-empty string of at most MaxIDLength
+// ASCII letters, digits, '_', '-' or '.'.
+// A metric may have at most MaxLabels labels. A label name must start with a letter or '_',
+// contain only ASCII letters, digits and '_', and must not start with "__",
+// and a label value must be a non-empty string of at most MaxLabelValueLength bytes.
+// Returns a *ValidationError listing every invalid field.
+func (m Metric) Validate() error {
+	var verr ValidationError
+	m.validate("", &verr)
+	if len(verr.Fields) > 0 {
+		return &verr
+	}
+	return nil
+}
+
+// ValidateBatch validates every metric of the batch.
+// Returns a *ValidationError listing the invalid fields of all metrics.
+func ValidateBatch(metrics []Metric) error {
+	var verr ValidationError
+	for i, m := range metrics {
+		m.validate(fmt.Sprintf("[%d].", i), &verr)
+	}
+	if len(verr.Fields) > 0 {
+		return &verr
+	}
+	return nil
+}
+
+func (m Metric) validate(prefix string, verr *ValidationError) {
+	switch {
+	case m.ID == "":
+		verr.add(prefix+"id", "must not be empty")
+	case len(m.ID) > MaxIDLength:
+		verr.add(prefix+"id", fmt.Sprintf("must be at most %d bytes long", MaxIDLength))
+	case strings.IndexFunc(m.ID, func(r rune) bool { return !isIDRune(r) }) >= 0:
+		verr.add(prefix+"id", "must contain only letters, digits, '_', '-' and '.'")
+	}
+
+	switch m.MType {
+	case Gauge:
+		switch {
+		case m.Value == nil:
+			verr.add(prefix+"value", "is required for gauge")
+		case math.IsNaN(*m.Value) || math.IsInf(*m.Value, 0):
+			verr.add(prefix+"value", "must be finite")
+		}
+		if m.Delta != nil {
+			verr.add(prefix+"delta", "must be absent for gauge")
+		}
+	case Counter:
+		if m.Delta == nil {
+			verr.add(prefix+"delta", "is required for counter")
+		}
+		if m.Value != nil {
+			verr.add(prefix+"value", "must be absent for counter")
+		}
+	case Histogram:
+		if m.Histogram == nil {
+			verr.add(prefix+"histogram", "is required for histogram")
+		} else {
+			m.Histogram.validate(prefix+"histogram.", verr)
+		}
+		if m.Delta != nil {
+			verr.add(prefix+"delta", "must be absent for histogram")
+		}
+		if m.Value != nil {
+			verr.add(prefix+"value", "must be absent for histogram")
+		}
+	default:
+		verr.add(prefix+"type", fmt.Sprintf("must be %s, %s or %s", Gauge, Counter, Histogram))
+	}
+	if m.MType != Histogram && m.Histogram != nil {
+		verr.add(prefix+"histogram", "must be absent for "+m.MType)
+	}
+
+	if len(m.Labels) > MaxLabels {
+		verr.add(prefix+"labels", fmt.Sprintf("must have at most %d labels", MaxLabels))
+	}
+	for _, name := range m.Labels.names() {
+		field := prefix + "labels." + name
+		switch {
+		case !isLabelName(name):
+			verr.add(field, "name must contain only letters, digits and '_' and must not start with a digit")
+		case strings.HasPrefix(name, "__"):
+			verr.add(field, "name must not start with '__'")
+		case m.MType == Histogram && name == BucketLabel:
+			verr.add(field, "name is reserved for the buckets of histogram")
+		}
+		switch value := m.Labels[name]; {
+		case value == "":
+			verr.add(field, "must not be empty")
+		case len(value) > MaxLabelValueLength:
+			verr.add(field, fmt.Sprintf("must be at most %d bytes long", MaxLabelValueLength))
+		}
+	}
+}
+
+// validate checks that the bounds are finite and ascending,
+// every bucket has a non-negative count and the count is the sum of them.
+func (h *HistogramValue) validate(prefix string, verr *ValidationError) {
+	switch {
+	case len(h.Bounds) > MaxBuckets:
+		verr.add(prefix+"bounds", fmt.Sprintf("must have at most %d bounds", MaxBuckets))
+	case slices.ContainsFunc(h.Bounds, func(b float64) bool { return math.IsNaN(b) || math.IsInf(b, 0) }):
+		verr.add(prefix+"bounds", "must be finite")
+	default:
+		for i := 1; i < len(h.Bounds); i++ {
+			if h.Bounds[i-1] >= h.Bounds[i] {
+				verr.add(prefix+"bounds", "must be strictly ascending")
+				break
+			}
+		}
+	}
+
+	var total int64
+	switch {
+	case len(h.Counts) != len(h.Bounds)+1:
+		verr.add(prefix+"counts", "must have one count more than bounds")
+	case slices.ContainsFunc(h.Counts, func(c int64) bool { return c < 0 }):
+		verr.add(prefix+"counts", "must not be negative")
+	default:
+		ok := true
+		for _, c := range h.Counts {
+			if total, ok = addCounts(total, c); !ok {
+				break
+			}
+		}
+		switch {
+		case !ok:
+			verr.add(prefix+"counts", "must not overflow the count")
+		case h.Count != total:
+			verr.add(prefix+"count", "must be the sum of counts")
+		}
+	}
+	if math.IsNaN(h.Sum) || math.IsInf(h.Sum, 0) {
+		verr.add(prefix+"sum", "must be finite")
+	}
+}
+
+func isLabelName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, r := range name {
+		isLetter := r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r == '_'
+		if !isLetter && (i == 0 || r < '0' || r > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+func isIDRune(r rune) bool {
+	return r >= 'a' && r <= 'z' ||
+		r >= 'A' && r <= 'Z' ||
+		r >= '0' && r <= '9' ||
+		r == '_' || r == '-' || r == '.'
+}
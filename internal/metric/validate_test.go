@@ -0,0 +1,165 @@
+package metric
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		m      Metric
+		fields []string
+	}{
+		{
+			name: "valid gauge",
+			m:    Metric{ID: "Alloc", MType: Gauge, Value: float64Ptr(12.12)},
+		},
+		{
+			name: "valid counter",
+			m:    Metric{ID: "PollCount", MType: Counter, Delta: int64Ptr(12)},
+		},
+		{
+			name:   "gauge without value",
+			m:      Metric{ID: "gauge", MType: Gauge},
+			fields: []string{"value"},
+		},
+		{
+			name:   "counter without delta",
+			m:      Metric{ID: "counter", MType: Counter},
+			fields: []string{"delta"},
+		},
+		{
+			name:   "counter with value",
+			m:      Metric{ID: "counter", MType: Counter, Delta: int64Ptr(12), Value: float64Ptr(12.12)},
+			fields: []string{"value"},
+		},
+		{
+			name:   "infinite gauge",
+			m:      Metric{ID: "gauge", MType: Gauge, Value: float64Ptr(math.Inf(1))},
+			fields: []string{"value"},
+		},
+		{
+			name:   "NaN gauge",
+			m:      Metric{ID: "gauge", MType: Gauge, Value: float64Ptr(math.NaN())},
+			fields: []string{"value"},
+		},
+		{
+			name:   "unknown type",
+			m:      Metric{ID: "dummy", MType: "dummy", Value: float64Ptr(12.12)},
+			fields: []string{"type"},
+		},
+		{
+			name:   "empty name",
+			m:      Metric{MType: Gauge, Value: float64Ptr(12.12)},
+			fields: []string{"id"},
+		},
+		{
+			name:   "name with forbidden characters",
+			m:      Metric{ID: "a b/c", MType: Gauge, Value: float64Ptr(12.12)},
+			fields: []string{"id"},
+		},
+		{
+			name:   "too long name",
+			m:      Metric{ID: strings.Repeat("a", MaxIDLength+1), MType: Gauge, Value: float64Ptr(12.12)},
+			fields: []string{"id"},
+		},
+		{
+			name: "valid histogram",
+			m: Metric{ID: "latency", MType: Histogram, Histogram: &HistogramValue{
+				Bounds: []float64{0.1, 0.5}, Counts: []int64{1, 2, 0}, Count: 3, Sum: 0.9,
+			}},
+		},
+		{
+			name:   "histogram without buckets",
+			m:      Metric{ID: "latency", MType: Histogram, Value: float64Ptr(12.12)},
+			fields: []string{"histogram", "value"},
+		},
+		{
+			name:   "gauge with histogram",
+			m:      Metric{ID: "gauge", MType: Gauge, Value: float64Ptr(12.12), Histogram: NewHistogramValue(nil)},
+			fields: []string{"histogram"},
+		},
+		{
+			name: "invalid histogram",
+			m: Metric{ID: "latency", MType: Histogram, Histogram: &HistogramValue{
+				Bounds: []float64{0.5, 0.5}, Counts: []int64{1, 2, 0}, Count: 2, Sum: math.NaN(),
+			}},
+			fields: []string{"histogram.bounds", "histogram.count", "histogram.sum"},
+		},
+		{
+			name: "histogram with counts wrapping around",
+			m: Metric{ID: "latency", MType: Histogram, Histogram: &HistogramValue{
+				Bounds: []float64{0.5, 1}, Counts: []int64{math.MaxInt64, math.MaxInt64, 2}, Count: 0,
+			}},
+			fields: []string{"histogram.counts"},
+		},
+		{
+			name: "histogram with wrong number of counts",
+			m: Metric{ID: "latency", MType: Histogram, Histogram: &HistogramValue{
+				Bounds: []float64{0.5}, Counts: []int64{1}, Count: 1,
+			}},
+			fields: []string{"histogram.counts"},
+		},
+		{
+			name: "valid labels",
+			m:    Metric{ID: "gauge", MType: Gauge, Value: float64Ptr(12.12), Labels: Labels{"host": "web1", "_env": "prod"}},
+		},
+		{
+			name: "invalid labels",
+			m: Metric{ID: "gauge", MType: Gauge, Value: float64Ptr(12.12), Labels: Labels{
+				"1host":   "web1",
+				"__name":  "gauge",
+				"env":     "",
+				"service": strings.Repeat("a", MaxLabelValueLength+1),
+			}},
+			fields: []string{"labels.1host", "labels.__name", "labels.env", "labels.service"},
+		},
+		{
+			name: "histogram with bucket label",
+			m: Metric{ID: "latency", MType: Histogram, Labels: Labels{"le": "0.5"}, Histogram: &HistogramValue{
+				Bounds: []float64{0.5}, Counts: []int64{1, 0}, Count: 1, Sum: 0.25,
+			}},
+			fields: []string{"labels.le"},
+		},
+		{
+			name: "gauge with bucket label",
+			m:    Metric{ID: "gauge", MType: Gauge, Value: float64Ptr(12.12), Labels: Labels{"le": "0.5"}},
+		},
+		{
+			name:   "several invalid fields",
+			m:      Metric{MType: Counter, Value: float64Ptr(12.12)},
+			fields: []string{"id", "delta", "value"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.m.Validate()
+			if test.fields == nil {
+				require.NoError(t, err)
+				return
+			}
+			var verr *ValidationError
+			require.ErrorAs(t, err, &verr)
+			fields := make([]string, len(verr.Fields))
+			for i, f := range verr.Fields {
+				fields[i] = f.Field
+			}
+			require.Equal(t, test.fields, fields)
+		})
+	}
+}
+
+func TestValidateBatch(t *testing.T) {
+	metrics := []Metric{
+		{ID: "gauge", MType: Gauge, Value: float64Ptr(12.12)},
+		{ID: "counter", MType: Counter},
+	}
+	var verr *ValidationError
+	require.ErrorAs(t, ValidateBatch(metrics), &verr)
+	require.Equal(t, []FieldError{{Field: "[1].delta", Message: "is required for counter"}}, verr.Fields)
+	require.NoError(t, ValidateBatch(metrics[:1]))
+}
@@ -0,0 +1,79 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"io"
+	"net/http"
+
+	"github.com/sudeeya/metrics-harvester/internal/encryption"
+)
+
+type decryptedKey struct{}
+
+// isDecrypted reports whether the request body has been decrypted by WithDecrypting.
+func isDecrypted(r *http.Request) bool {
+	decrypted, _ := r.Context().Value(decryptedKey{}).(bool)
+	return decrypted
+}
+
+// WithDecrypting provides middleware that handles decryption of HTTP request bodies.
+// If the key is nil does nothing.
+// If the Content-Encryption header of request is set, the request body is decrypted with the key.
+// If the body could not be decrypted, the response status code is 400 (Bad Request).
+// Unencrypted requests are passed through, use WithRequiredEncryption to reject them.
+// It must be placed after signature verification and before decompression.
+func WithDecrypting(key *rsa.PrivateKey, handler http.Handler) http.Handler {
+	decryptFunc := func(w http.ResponseWriter, r *http.Request) {
+		if key == nil {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		scheme := r.Header.Get(encryption.Header)
+		if scheme == "" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		if scheme != encryption.Scheme {
+			http.Error(w, "unsupported encryption scheme", http.StatusBadRequest)
+			return
+		}
+
+		message, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		body, err := encryption.Decrypt(key, message)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		r.Header.Del(encryption.Header)
+		r.ContentLength = int64(len(body))
+		r.Body = io.NopCloser(bytes.NewBuffer(body))
+		r = r.WithContext(context.WithValue(r.Context(), decryptedKey{}, true))
+		handler.ServeHTTP(w, r)
+	}
+	return http.HandlerFunc(decryptFunc)
+}
+
+// WithRequiredEncryption provides middleware that handles unencrypted HTTP request bodies.
+// It must be placed after WithDecrypting, on the update routes only,
+// so plaintext reads such as POST /value/ keep working.
+// If the key is nil or allowPlaintext is set does nothing.
+// Otherwise, requests with an unencrypted body are rejected with 400 (Bad Request).
+func WithRequiredEncryption(key *rsa.PrivateKey, allowPlaintext bool, handler http.Handler) http.Handler {
+	requireFunc := func(w http.ResponseWriter, r *http.Request) {
+		if key == nil || allowPlaintext || isDecrypted(r) || r.ContentLength == 0 {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		http.Error(w, "request body must be encrypted", http.StatusBadRequest)
+	}
+	return http.HandlerFunc(requireFunc)
+}
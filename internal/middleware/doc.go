@@ -1,4 +1,4 @@
 // Package middleware provides a collection of HTTP middleware wrappers for http.Handler.
 // These middleware functions can be used to add additional functionality to HTTP handlers,
-// such as logging, compression, and signing.
+// such as logging, compression, decryption, signing, and trusted subnet checks.
 package middleware
@@ -2,31 +2,65 @@ package middleware
 
 import (
 	"bytes"
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
 	"io"
 	"net/http"
+
+	"go.uber.org/zap"
 )
 
+type signedKey struct{}
+
+// isSigned reports whether the request signature has been verified by WithSigning.
+func isSigned(r *http.Request) bool {
+	signed, _ := r.Context().Value(signedKey{}).(bool)
+	return signed
+}
+
+// hmacResponseWriter buffers the response,
+// so the signature can be computed over the full body before anything is sent.
 type hmacResponseWriter struct {
 	http.ResponseWriter
-	key []byte
+	statusCode int
+	body       bytes.Buffer
+}
+
+func (w *hmacResponseWriter) Write(b []byte) (int, error) {
+	if w.statusCode == 0 {
+		w.statusCode = http.StatusOK
+	}
+	return w.body.Write(b)
 }
 
-func (w hmacResponseWriter) Write(b []byte) (int, error) {
-	h := hmac.New(sha256.New, w.key)
-	if _, err := h.Write(b); err != nil {
-		return 0, err
+func (w *hmacResponseWriter) WriteHeader(statusCode int) {
+	if w.statusCode == 0 {
+		w.statusCode = statusCode
 	}
+}
+
+// flush signs the buffered body and sends the response.
+func (w *hmacResponseWriter) flush(key []byte) error {
+	h := hmac.New(sha256.New, key)
+	h.Write(w.body.Bytes())
 	w.Header().Set("HashSHA256", hex.EncodeToString(h.Sum(nil)))
-	return w.ResponseWriter.Write(b)
+	if w.statusCode == 0 {
+		w.statusCode = http.StatusOK
+	}
+	w.ResponseWriter.WriteHeader(w.statusCode)
+	_, err := w.ResponseWriter.Write(w.body.Bytes())
+	return err
 }
 
-// WithLogging provides middleware that handles signing of HTTP requests and responses.
+// WithSigning provides middleware that handles signing of HTTP requests and responses.
 // If the key is empty does nothing.
 // Otherwise, it checks the HashSHA256 header of the request.
-// If the signature is incorrect, the response status code is 400 (Bad Request).
+// If the signature is malformed or incorrect, the response status code is 400 (Bad Request).
+// Unsigned requests are passed through, use WithRequiredSignature to reject them.
+// Every response is signed in the HashSHA256 header.
+// The signature covers the body as sent, so for compressed responses it is computed over the compressed bytes.
 func WithSigning(key []byte, handler http.Handler) http.Handler {
 	signFunc := func(w http.ResponseWriter, r *http.Request) {
 		if len(key) == 0 {
@@ -35,35 +69,66 @@ func WithSigning(key []byte, handler http.Handler) http.Handler {
 		}
 
 		hexHash := r.Header.Get("HashSHA256")
-		if hexHash == "" {
-			handler.ServeHTTP(w, r)
-			return
-		}
-		expected, err := hex.DecodeString(hexHash)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
+		if hexHash != "" {
+			expected, err := hex.DecodeString(hexHash)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
 
-		body, err := io.ReadAll(r.Body)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			h := hmac.New(sha256.New, key)
+			if _, err := h.Write(body); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			actual := h.Sum(nil)
+
+			if !hmac.Equal(expected, actual) {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			r.Body = io.NopCloser(bytes.NewBuffer(body))
+			r = r.WithContext(context.WithValue(r.Context(), signedKey{}, true))
 		}
-		h := hmac.New(sha256.New, key)
-		if _, err := h.Write(body); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+
+		hw := &hmacResponseWriter{ResponseWriter: w}
+		handler.ServeHTTP(hw, r)
+		// The status is already sent, so a failed write only means the client has gone.
+		_ = hw.flush(key)
+	}
+	return http.HandlerFunc(signFunc)
+}
+
+// WithRequiredSignature provides middleware that handles unsigned HTTP requests.
+// It must be placed after WithSigning, usually on mutating routes only.
+// If the key is empty does nothing.
+// If strict is set, unsigned requests are rejected with 400 (Bad Request).
+// Otherwise, they are logged and passed through,
+// which allows migrating agents to signing without downtime.
+func WithRequiredSignature(logger *zap.Logger, key []byte, strict bool, handler http.Handler) http.Handler {
+	requireFunc := func(w http.ResponseWriter, r *http.Request) {
+		if len(key) == 0 || isSigned(r) {
+			handler.ServeHTTP(w, r)
 			return
 		}
-		actual := h.Sum(nil)
 
-		if !hmac.Equal(expected, actual) {
-			w.WriteHeader(http.StatusBadRequest)
+		if !strict {
+			logger.Sugar().Warnln(
+				"unsigned request",
+				"uri", r.RequestURI,
+				"method", r.Method,
+			)
+			handler.ServeHTTP(w, r)
 			return
 		}
 
-		r.Body = io.NopCloser(bytes.NewBuffer(body))
-		handler.ServeHTTP(hmacResponseWriter{ResponseWriter: w, key: key}, r)
+		http.Error(w, "request must be signed", http.StatusBadRequest)
 	}
-	return http.HandlerFunc(signFunc)
+	return http.HandlerFunc(requireFunc)
 }
@@ -0,0 +1,31 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+)
+
+// WithTrustedSubnet provides middleware that restricts access to clients from the trusted subnet.
+// If the subnet is nil does nothing.
+// Otherwise, it checks the X-Real-IP header of the request.
+// If the header is missing, malformed or the address is outside the subnet,
+// the response status code is 403 (Forbidden).
+// It must be placed before signature verification and decryption,
+// so rejected requests cost no work.
+func WithTrustedSubnet(subnet *net.IPNet, handler http.Handler) http.Handler {
+	subnetFunc := func(w http.ResponseWriter, r *http.Request) {
+		if subnet == nil {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		ip := net.ParseIP(r.Header.Get("X-Real-IP"))
+		if ip == nil || !subnet.Contains(ip) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		handler.ServeHTTP(w, r)
+	}
+	return http.HandlerFunc(subnetFunc)
+}
@@ -7,10 +7,12 @@ package mocks
 import (
 	context "context"
 	reflect "reflect"
+	time "time"
 
 	gomock "github.com/golang/mock/gomock"
 
 	metric "github.com/sudeeya/metrics-harvester/internal/metric"
+	repository "github.com/sudeeya/metrics-harvester/internal/repository"
 )
 
 // MockRepository is a mock of Repository interface.
@@ -65,19 +67,34 @@ func (mr *MockRepositoryMockRecorder) GetAllMetrics(arg0 interface{}) *gomock.Ca
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAllMetrics", reflect.TypeOf((*MockRepository)(nil).GetAllMetrics), arg0)
 }
 
+// GetHistory mocks base method.
+func (m *MockRepository) GetHistory(arg0 context.Context, arg1, arg2 string, arg3 metric.Labels, arg4, arg5 time.Time) ([]metric.Point, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetHistory", arg0, arg1, arg2, arg3, arg4, arg5)
+	ret0, _ := ret[0].([]metric.Point)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetHistory indicates an expected call of GetHistory.
+func (mr *MockRepositoryMockRecorder) GetHistory(arg0, arg1, arg2, arg3, arg4, arg5 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetHistory", reflect.TypeOf((*MockRepository)(nil).GetHistory), arg0, arg1, arg2, arg3, arg4, arg5)
+}
+
 // GetMetric mocks base method.
-func (m *MockRepository) GetMetric(arg0 context.Context, arg1 string) (metric.Metric, error) {
+func (m *MockRepository) GetMetric(arg0 context.Context, arg1, arg2 string, arg3 metric.Labels) (metric.Metric, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "GetMetric", arg0, arg1)
+	ret := m.ctrl.Call(m, "GetMetric", arg0, arg1, arg2, arg3)
 	ret0, _ := ret[0].(metric.Metric)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // GetMetric indicates an expected call of GetMetric.
-func (mr *MockRepositoryMockRecorder) GetMetric(arg0, arg1 interface{}) *gomock.Call {
+func (mr *MockRepositoryMockRecorder) GetMetric(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetMetric", reflect.TypeOf((*MockRepository)(nil).GetMetric), arg0, arg1)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetMetric", reflect.TypeOf((*MockRepository)(nil).GetMetric), arg0, arg1, arg2, arg3)
 }
 
 // PutBatch mocks base method.
@@ -94,6 +111,35 @@ func (mr *MockRepositoryMockRecorder) PutBatch(arg0, arg1 interface{}) *gomock.C
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PutBatch", reflect.TypeOf((*MockRepository)(nil).PutBatch), arg0, arg1)
 }
 
+// PutBatchOnce mocks base method.
+func (m *MockRepository) PutBatchOnce(arg0 context.Context, arg1 string, arg2 []metric.Metric) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "PutBatchOnce", arg0, arg1, arg2)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// PutBatchOnce indicates an expected call of PutBatchOnce.
+func (mr *MockRepositoryMockRecorder) PutBatchOnce(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PutBatchOnce", reflect.TypeOf((*MockRepository)(nil).PutBatchOnce), arg0, arg1, arg2)
+}
+
+// PutPartialOnce mocks base method.
+func (m *MockRepository) PutPartialOnce(arg0 context.Context, arg1 string, arg2 []metric.Metric) ([]repository.Rejection, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "PutPartialOnce", arg0, arg1, arg2)
+	ret0, _ := ret[0].([]repository.Rejection)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// PutPartialOnce indicates an expected call of PutPartialOnce.
+func (mr *MockRepositoryMockRecorder) PutPartialOnce(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PutPartialOnce", reflect.TypeOf((*MockRepository)(nil).PutPartialOnce), arg0, arg1, arg2)
+}
+
 // PutMetric mocks base method.
 func (m *MockRepository) PutMetric(arg0 context.Context, arg1 metric.Metric) error {
 	m.ctrl.T.Helper()
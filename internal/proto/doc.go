@@ -0,0 +1,9 @@
+// Package proto contains the gRPC Metrics service generated from metrics.proto
+// and conversions between its messages and metric.Metric.
+//
+// To regenerate the code run:
+//
+//	protoc --go_out=. --go_opt=paths=source_relative \
+//		--go-grpc_out=. --go-grpc_opt=paths=source_relative \
+//		metrics.proto
+package proto
@@ -0,0 +1,44 @@
+package proto
+
+import (
+	"maps"
+
+	"github.com/sudeeya/metrics-harvester/internal/metric"
+)
+
+// FromMetric converts metric.Metric to Metric.
+// Histograms are dropped, since Metric has no fields for them.
+func FromMetric(m metric.Metric) *Metric {
+	pm := &Metric{
+		Id:     m.ID,
+		Type:   m.MType,
+		Labels: maps.Clone(m.Labels),
+	}
+	if m.Delta != nil {
+		delta := *m.Delta
+		pm.Delta = &delta
+	}
+	if m.Value != nil {
+		value := *m.Value
+		pm.Value = &value
+	}
+	return pm
+}
+
+// ToMetric converts Metric to metric.Metric.
+func (pm *Metric) ToMetric() metric.Metric {
+	m := metric.Metric{
+		ID:     pm.GetId(),
+		MType:  pm.GetType(),
+		Labels: maps.Clone(pm.GetLabels()),
+	}
+	if pm.Delta != nil {
+		delta := pm.GetDelta()
+		m.Delta = &delta
+	}
+	if pm.Value != nil {
+		value := pm.GetValue()
+		m.Value = &value
+	}
+	return m
+}
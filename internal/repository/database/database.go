@@ -2,7 +2,12 @@
 package database
 
 import (
+	"cmp"
 	"context"
+	"database/sql"
+	"encoding/json"
+	"slices"
+	"strings"
 	"time"
 
 	_ "github.com/jackc/pgx/v5/stdlib"
@@ -14,39 +19,130 @@ import (
 
 const limitInSeconds = 10
 
+// BatchWindow is how long Database remembers batch keys.
+const BatchWindow = time.Hour
+
 // SQL commands.
 const (
-	// CreateMetricsTable is used to create table in PostgeSQL database.
-	// If the table exists, does nothing.
-	CreateMetricsTable = `
-CREATE TABLE IF NOT EXISTS metrics (
-	id TEXT PRIMARY KEY,
-	type TEXT NOT NULL,
-	delta BIGINT,
-	value DOUBLE PRECISION
-);
+	// deleteOldBatches is used to forget batch keys older than the window.
+	deleteOldBatches = `
+DELETE FROM batches
+WHERE applied_at < now() - make_interval(secs => $1);
+`
+
+	// insertBatch is used to record a batch key with the hash of its metrics.
+	// If the key exists, does nothing.
+	insertBatch = `
+INSERT INTO batches (key, hash)
+VALUES ($1, $2)
+ON CONFLICT (key) DO NOTHING;
+`
+
+	// selectBatch is used to get the hash and the rejections of a recorded batch.
+	selectBatch = `
+SELECT hash, rejections
+FROM batches
+WHERE key = $1;
+`
+
+	// updateRejections is used to record the rejections of a partial batch.
+	updateRejections = `
+UPDATE batches
+SET rejections = $2::JSONB
+WHERE key = $1;
+`
+
+	// deleteOldHistory is used to discard points older than the retention.
+	// It is run by PruneHistory, not by writers, so writes do not scan the history.
+	deleteOldHistory = `
+DELETE FROM history
+WHERE ts < now() - make_interval(secs => $1);
+`
+
+	// selectHistory is used to get points of a metric in a time range.
+	selectHistory = `
+SELECT ts, delta, value, histogram
+FROM history
+WHERE type = $1 AND id = $2 AND labels = $3::JSONB AND ts BETWEEN $4 AND $5
+ORDER BY ts;
+`
+
+	// upsertBatch is used to put a batch of metrics in the table with a single statement
+	// and their new states in the history.
+	// The metrics are passed as arrays of ids, types, deltas, values, labels and histograms as JSON,
+	// and every metric must occur once, since a row can be updated only once per statement.
+	// Gauges have no delta and histogram, counters have no value and histogram
+	// and histograms have no delta and value, so the same update expression suits every type.
+	// Histograms are passed already merged with their stored state.
+	upsertBatch = `
+WITH updated AS (
+	INSERT INTO metrics (id, type, delta, value, labels, histogram)
+	SELECT id, type, delta, value, labels::JSONB, histogram::JSONB
+	FROM unnest($1::TEXT[], $2::TEXT[], $3::BIGINT[], $4::DOUBLE PRECISION[], $5::TEXT[], $6::TEXT[])
+		AS batch (id, type, delta, value, labels, histogram)
+	ON CONFLICT (type, id, labels)
+	DO UPDATE SET
+		delta = metrics.delta + EXCLUDED.delta,
+		value = EXCLUDED.value,
+		histogram = EXCLUDED.histogram
+	RETURNING id, type, delta, value, labels, histogram
+)
+INSERT INTO history (id, type, delta, value, labels, histogram)
+SELECT id, type, delta, value, labels, histogram FROM updated;
+`
+
+	// insertHistogramRow is used to create the row of a new histogram,
+	// so it can be locked before the histogram is merged.
+	insertHistogramRow = `
+INSERT INTO metrics (id, type, labels)
+VALUES ($1, $2, $3::JSONB)
+ON CONFLICT (type, id, labels) DO NOTHING;
+`
+
+	// lockHistogram is used to get the stored state of a histogram
+	// and keep it from changing until the transaction is finished.
+	lockHistogram = `
+SELECT histogram
+FROM metrics
+WHERE type = $1 AND id = $2 AND labels = $3::JSONB
+FOR UPDATE;
 `
 
-	// insertGauge is used to put Gauge metric in the table.
+	// insertGauge is used to put Gauge metric in the table
+	// and its new state in the history.
 	insertGauge = `
-INSERT INTO metrics (id, type, value)
-VALUES ($1, $2, $3)
-ON CONFLICT (id)
-DO UPDATE SET
-	value = EXCLUDED.value;
+WITH updated AS (
+	INSERT INTO metrics (id, type, value, labels)
+	VALUES ($1, $2, $3, $4::JSONB)
+	ON CONFLICT (type, id, labels)
+	DO UPDATE SET
+		value = EXCLUDED.value
+	RETURNING id, type, delta, value, labels
+)
+INSERT INTO history (id, type, delta, value, labels)
+SELECT id, type, delta, value, labels FROM updated;
 `
 
-	// insertCounter is used to put Counter metric in the table.
+	// insertCounter is used to put Counter metric in the table
+	// and its new state in the history.
 	insertCounter = `
-INSERT INTO metrics (id, type, delta)
-VALUES ($1, $2, $3)
-ON CONFLICT (id)
-DO UPDATE SET
-	delta = metrics.delta + EXCLUDED.delta;
+WITH updated AS (
+	INSERT INTO metrics (id, type, delta, labels)
+	VALUES ($1, $2, $3, $4::JSONB)
+	ON CONFLICT (type, id, labels)
+	DO UPDATE SET
+		delta = metrics.delta + EXCLUDED.delta
+	RETURNING id, type, delta, value, labels
+)
+INSERT INTO history (id, type, delta, value, labels)
+SELECT id, type, delta, value, labels FROM updated;
 `
 )
 
-var _ repository.Repository = (*Database)(nil)
+var (
+	_ repository.Repository    = (*Database)(nil)
+	_ repository.HistoryPruner = (*Database)(nil)
+)
 
 // Database implements the [Repository] interface.
 type Database struct {
@@ -65,14 +161,22 @@ func (db *Database) PutMetric(ctx context.Context, m metric.Metric) error {
 	ctx, cancel := context.WithTimeout(ctx, limitInSeconds*time.Second)
 	defer cancel()
 
+	// A histogram is merged with its stored state, which takes a transaction.
+	if m.MType == metric.Histogram {
+		return db.PutBatch(ctx, []metric.Metric{m})
+	}
+	labels, err := labelsJSON(m.Labels)
+	if err != nil {
+		return err
+	}
 	switch m.MType {
 	case metric.Gauge:
-		_, err := db.ExecContext(ctx, insertGauge, m.ID, m.MType, *m.Value)
+		_, err := db.ExecContext(ctx, insertGauge, m.ID, m.MType, *m.Value, labels)
 		if err != nil {
 			return err
 		}
 	case metric.Counter:
-		_, err := db.ExecContext(ctx, insertCounter, m.ID, m.MType, *m.Delta)
+		_, err := db.ExecContext(ctx, insertCounter, m.ID, m.MType, *m.Delta, labels)
 		if err != nil {
 			return err
 		}
@@ -89,48 +193,335 @@ func (db *Database) PutBatch(ctx context.Context, metrics []metric.Metric) error
 	if err != nil {
 		return err
 	}
+	// Rollback does nothing once the transaction is committed.
+	defer tx.Rollback()
 
-	stmtGauge, err := tx.PrepareContext(ctx, insertGauge)
+	if err := putBatch(ctx, tx, metrics); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// PutBatchOnce implements the [Repository] interface.
+// The key is inserted in the same transaction as the metrics,
+// and keys older than BatchWindow are forgotten.
+func (db *Database) PutBatchOnce(ctx context.Context, key string, metrics []metric.Metric) error {
+	ctx, cancel := context.WithTimeout(ctx, limitInSeconds*time.Second)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
-	defer stmtGauge.Close()
-	stmtCounter, err := tx.PrepareContext(ctx, insertCounter)
+	// Rollback does nothing once the transaction is committed.
+	defer tx.Rollback()
+
+	if _, err := recordBatch(ctx, tx, key, metrics); err != nil {
+		return err
+	}
+	if err := putBatch(ctx, tx, metrics); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// PutPartialOnce implements the [Repository] interface.
+// The key and the rejections are inserted in the same transaction as the metrics,
+// and keys older than BatchWindow are forgotten.
+func (db *Database) PutPartialOnce(ctx context.Context, key string, metrics []metric.Metric) ([]repository.Rejection, error) {
+	ctx, cancel := context.WithTimeout(ctx, limitInSeconds*time.Second)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	// Rollback does nothing once the transaction is committed.
+	defer tx.Rollback()
+
+	if rejections, err := recordBatch(ctx, tx, key, metrics); err != nil {
+		return rejections, err
+	}
+	rejections, err := putPartial(ctx, tx, metrics)
+	if err != nil {
+		return nil, err
+	}
+	if len(rejections) > 0 {
+		data, err := json.Marshal(rejections)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := tx.ExecContext(ctx, updateRejections, key, string(data)); err != nil {
+			return nil, err
+		}
+	}
+	return rejections, tx.Commit()
+}
+
+// recordBatch inserts the key of a batch with the hash of its metrics and forgets the keys older than BatchWindow.
+// Returns the rejections of the batch and ErrDuplicateBatch if the key is known,
+// or ErrBatchKeyReused if it is known with another hash.
+func recordBatch(ctx context.Context, tx *sql.Tx, key string, metrics []metric.Metric) ([]repository.Rejection, error) {
+	if _, err := tx.ExecContext(ctx, deleteOldBatches, BatchWindow.Seconds()); err != nil {
+		return nil, err
+	}
+	hash, err := repository.BatchHash(metrics)
+	if err != nil {
+		return nil, err
+	}
+	// A concurrent transaction inserting the same key blocks this one until it is finished.
+	result, err := tx.ExecContext(ctx, insertBatch, key, hash)
+	if err != nil {
+		return nil, err
+	}
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if inserted > 0 {
+		return nil, nil
+	}
+	var (
+		recorded sql.NullString
+		data     []byte
+	)
+	if err := tx.QueryRowContext(ctx, selectBatch, key).Scan(&recorded, &data); err != nil {
+		return nil, err
+	}
+	if recorded.Valid && recorded.String != hash {
+		return nil, repository.ErrBatchKeyReused
+	}
+	var rejections []repository.Rejection
+	if data != nil {
+		if err := json.Unmarshal(data, &rejections); err != nil {
+			return nil, err
+		}
+	}
+	return rejections, repository.ErrDuplicateBatch
+}
+
+// putBatch collapses the metrics, so every metric occurs once,
+// merges the histograms with their stored state and writes the metrics with a single upsert.
+func putBatch(ctx context.Context, tx *sql.Tx, metrics []metric.Metric) error {
+	collapsed, err := metric.Collapse(metrics)
 	if err != nil {
 		return err
 	}
-	defer stmtCounter.Close()
+	if len(collapsed) == 0 {
+		return nil
+	}
+	if _, err := mergeStoredHistograms(ctx, tx, collapsed, false); err != nil {
+		return err
+	}
+	return upsert(ctx, tx, collapsed)
+}
+
+// putPartial collapses the metrics like putBatch, but rejects the metrics conflicting
+// with the earlier metrics of the batch or with the stored ones, and writes the other ones.
+// Returns the rejections sorted by index.
+func putPartial(ctx context.Context, tx *sql.Tx, metrics []metric.Metric) ([]repository.Rejection, error) {
+	collapsed, origins, rejections, err := collapsePartial(metrics)
+	if err != nil {
+		return nil, err
+	}
+	conflicts, err := mergeStoredHistograms(ctx, tx, collapsed, true)
+	if err != nil {
+		return nil, err
+	}
+	accepted := make([]metric.Metric, 0, len(collapsed))
+	for i, m := range collapsed {
+		conflict, ok := conflicts[i]
+		if !ok {
+			accepted = append(accepted, m)
+			continue
+		}
+		// Every update of the metric has the buckets of the collapsed one, so all of them conflict.
+		for _, index := range origins[i] {
+			rejections = append(rejections, repository.Rejection{Index: index, Reason: conflict.Error()})
+		}
+	}
+	slices.SortFunc(rejections, func(a, b repository.Rejection) int {
+		return cmp.Compare(a.Index, b.Index)
+	})
+	if len(accepted) == 0 {
+		return rejections, nil
+	}
+	return rejections, upsert(ctx, tx, accepted)
+}
+
+// collapsePartial collapses the metrics like metric.Collapse,
+// but rejects the updates conflicting with the earlier updates of the same metric.
+// Returns the collapsed metrics, the indexes of the updates of every collapsed metric and the rejections.
+func collapsePartial(metrics []metric.Metric) ([]metric.Metric, [][]int, []repository.Rejection, error) {
+	indexes := make(map[metric.Key]int, len(metrics))
+	collapsed := make([]metric.Metric, 0, len(metrics))
+	origins := make([][]int, 0, len(metrics))
+	var rejections []repository.Rejection
+	for i, m := range metrics {
+		j, ok := indexes[m.Key()]
+		if !ok {
+			j = len(collapsed)
+			indexes[m.Key()] = j
+			collapsed = append(collapsed, metric.Metric{ID: m.ID, MType: m.MType, Labels: m.Labels})
+			origins = append(origins, nil)
+		}
+		if err := collapsed[j].Merge(m); err != nil {
+			if !metric.IsConflict(err) {
+				return nil, nil, nil, err
+			}
+			rejections = append(rejections, repository.Rejection{Index: i, Reason: err.Error()})
+			continue
+		}
+		origins[j] = append(origins[j], i)
+	}
+	return collapsed, origins, rejections, nil
+}
+
+// upsert writes the collapsed metrics, every one of which occurs once, with a single statement.
+// The rows are written in the order of the types, names and labels of the metrics,
+// so concurrent batches lock them in the same order and do not deadlock.
+func upsert(ctx context.Context, tx *sql.Tx, collapsed []metric.Metric) error {
+	collapsed = slices.Clone(collapsed)
+	slices.SortFunc(collapsed, compareMetrics)
+	var (
+		ids        = make([]string, len(collapsed))
+		types      = make([]string, len(collapsed))
+		deltas     = make([]*int64, len(collapsed))
+		values     = make([]*float64, len(collapsed))
+		labels     = make([]string, len(collapsed))
+		histograms = make([]*string, len(collapsed))
+		err        error
+	)
+	for i, m := range collapsed {
+		ids[i] = m.ID
+		types[i] = m.MType
+		deltas[i] = m.Delta
+		values[i] = m.Value
+		if labels[i], err = labelsJSON(m.Labels); err != nil {
+			return err
+		}
+		if histograms[i], err = histogramJSON(m.Histogram); err != nil {
+			return err
+		}
+	}
+	_, err = tx.ExecContext(ctx, upsertBatch, ids, types, deltas, values, labels, histograms)
+	return err
+}
 
-	for _, m := range metrics {
-		switch m.MType {
-		case metric.Gauge:
-			_, err := stmtGauge.ExecContext(ctx, m.ID, m.MType, *m.Value)
-			if err != nil {
-				return tx.Rollback()
+// mergeStoredHistograms merges the stored state into every histogram of the batch,
+// since buckets cannot be added up by the upsert.
+// The rows are locked in the order of the names and labels of the histograms, like in upsert,
+// so concurrent batches do not deadlock.
+// If the batch is partial, the histograms conflicting with the stored ones are left as is
+// and their errors are returned by index. Otherwise a conflict is returned as an error.
+func mergeStoredHistograms(ctx context.Context, tx *sql.Tx, metrics []metric.Metric, partial bool) (map[int]error, error) {
+	var (
+		indexes   []int
+		conflicts map[int]error
+	)
+	for i, m := range metrics {
+		if m.MType == metric.Histogram {
+			indexes = append(indexes, i)
+		}
+	}
+	slices.SortFunc(indexes, func(a, b int) int {
+		return compareMetrics(metrics[a], metrics[b])
+	})
+
+	for _, i := range indexes {
+		m := metrics[i]
+		labels, err := labelsJSON(m.Labels)
+		if err != nil {
+			return nil, err
+		}
+		// A new histogram gets a row first, so there is a row to lock.
+		if _, err := tx.ExecContext(ctx, insertHistogramRow, m.ID, m.MType, labels); err != nil {
+			return nil, err
+		}
+		var stored *DBHistogram
+		if err := tx.QueryRowContext(ctx, lockHistogram, m.MType, m.ID, labels).Scan(&stored); err != nil {
+			return nil, err
+		}
+		if stored == nil {
+			continue
+		}
+		merged := metric.Metric{ID: m.ID, MType: m.MType, Labels: m.Labels, Histogram: (*metric.HistogramValue)(stored)}
+		if err := merged.Merge(m); err != nil {
+			if !partial || !metric.IsConflict(err) {
+				return nil, err
 			}
-		case metric.Counter:
-			_, err := stmtCounter.ExecContext(ctx, m.ID, m.MType, *m.Delta)
-			if err != nil {
-				return tx.Rollback()
+			if conflicts == nil {
+				conflicts = make(map[int]error)
 			}
+			conflicts[i] = err
+			continue
 		}
+		metrics[i] = merged
 	}
-	return tx.Commit()
+	return conflicts, nil
+}
+
+// compareMetrics orders the metrics by type, name and labels, like the primary key of their rows.
+func compareMetrics(a, b metric.Metric) int {
+	return cmp.Or(
+		strings.Compare(a.MType, b.MType),
+		strings.Compare(a.ID, b.ID),
+		strings.Compare(a.Labels.String(), b.Labels.String()),
+	)
 }
 
 // GetMetric implements the [Repository] interface.
-func (db *Database) GetMetric(ctx context.Context, mName string) (metric.Metric, error) {
+func (db *Database) GetMetric(ctx context.Context, mType, mName string, labels metric.Labels) (metric.Metric, error) {
 	ctx, cancel := context.WithTimeout(ctx, limitInSeconds*time.Second)
 	defer cancel()
 
+	jsonLabels, err := labelsJSON(labels)
+	if err != nil {
+		return metric.Metric{}, err
+	}
 	var dbm DBMetric
 	if err := db.GetContext(ctx, &dbm,
-		"SELECT id, type, delta, value FROM metrics WHERE id = $1", mName); err != nil {
+		"SELECT id, type, delta, value, labels, histogram FROM metrics WHERE type = $1 AND id = $2 AND labels = $3::JSONB",
+		mType, mName, jsonLabels); err != nil {
 		return metric.Metric{}, err
 	}
 	return dbm.ToMetric(), nil
 }
 
+// GetHistory implements the [Repository] interface.
+// Points older than HistoryRetention are skipped even if they have not been pruned yet.
+func (db *Database) GetHistory(ctx context.Context, mType, mName string, labels metric.Labels, from, to time.Time) ([]metric.Point, error) {
+	ctx, cancel := context.WithTimeout(ctx, limitInSeconds*time.Second)
+	defer cancel()
+
+	from = repository.RetainedFrom(from, time.Now())
+	if _, err := db.GetMetric(ctx, mType, mName, labels); err != nil {
+		return nil, err
+	}
+	jsonLabels, err := labelsJSON(labels)
+	if err != nil {
+		return nil, err
+	}
+	var dbPoints []DBPoint
+	if err := db.SelectContext(ctx, &dbPoints, selectHistory, mType, mName, jsonLabels, from, to); err != nil {
+		return nil, err
+	}
+	points := make([]metric.Point, len(dbPoints))
+	for i, dbp := range dbPoints {
+		points[i] = dbp.ToPoint()
+	}
+	return points, nil
+}
+
+// PruneHistory implements the [repository.HistoryPruner] interface.
+func (db *Database) PruneHistory(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, limitInSeconds*time.Second)
+	defer cancel()
+
+	_, err := db.ExecContext(ctx, deleteOldHistory, repository.HistoryRetention.Seconds())
+	return err
+}
+
 // GetAllMetrics implements the [Repository] interface.
 func (db *Database) GetAllMetrics(ctx context.Context) ([]metric.Metric, error) {
 	ctx, cancel := context.WithTimeout(ctx, limitInSeconds*time.Second)
@@ -138,7 +529,7 @@ func (db *Database) GetAllMetrics(ctx context.Context) ([]metric.Metric, error)
 
 	var dbMetrics []DBMetric
 	if err := db.SelectContext(ctx, &dbMetrics,
-		"SELECT id, type, delta, value FROM metrics ORDER BY id"); err != nil {
+		"SELECT id, type, delta, value, labels, histogram FROM metrics ORDER BY id, type, labels::TEXT"); err != nil {
 		return nil, err
 	}
 	allMetrics := make([]metric.Metric, len(dbMetrics))
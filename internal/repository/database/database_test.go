@@ -0,0 +1,134 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sudeeya/metrics-harvester/internal/metric"
+)
+
+// newBenchDatabase connects to the database from the DATABASE_DSN environment variable.
+// The benchmark is skipped if it is not set.
+func newBenchDatabase(b *testing.B) *Database {
+	dsn := os.Getenv("DATABASE_DSN")
+	if dsn == "" {
+		b.Skip("DATABASE_DSN is not set")
+	}
+	db := NewDatabase(dsn)
+	b.Cleanup(func() { db.Close() })
+	if _, _, err := db.Migrate(context.Background()); err != nil {
+		b.Fatal(err)
+	}
+	return db
+}
+
+// benchBatch returns a batch of hosts reports with perHost metrics each.
+// Every host reports the same metrics, so the batch collapses to perHost metrics.
+func benchBatch(hosts, perHost int) []metric.Metric {
+	metrics := make([]metric.Metric, 0, hosts*perHost)
+	for i := range hosts {
+		for j := range perHost {
+			id := fmt.Sprintf("bench%d", j)
+			if j%2 == 0 {
+				value := float64(i)
+				metrics = append(metrics, metric.Metric{ID: id, MType: metric.Gauge, Value: &value})
+			} else {
+				delta := int64(i)
+				metrics = append(metrics, metric.Metric{ID: id, MType: metric.Counter, Delta: &delta})
+			}
+		}
+	}
+	return metrics
+}
+
+// putBatchStatements is the previous implementation of putBatch,
+// which executes a prepared statement per metric.
+func putBatchStatements(ctx context.Context, tx *sql.Tx, metrics []metric.Metric) error {
+	stmtGauge, err := tx.PrepareContext(ctx, insertGauge)
+	if err != nil {
+		return err
+	}
+	defer stmtGauge.Close()
+	stmtCounter, err := tx.PrepareContext(ctx, insertCounter)
+	if err != nil {
+		return err
+	}
+	defer stmtCounter.Close()
+
+	for _, m := range metrics {
+		switch m.MType {
+		case metric.Gauge:
+			if _, err := stmtGauge.ExecContext(ctx, m.ID, m.MType, *m.Value, "{}"); err != nil {
+				return err
+			}
+		case metric.Counter:
+			if _, err := stmtCounter.ExecContext(ctx, m.ID, m.MType, *m.Delta, "{}"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func BenchmarkPutBatch(b *testing.B) {
+	db := newBenchDatabase(b)
+	implementations := []struct {
+		name     string
+		putBatch func(ctx context.Context, tx *sql.Tx, metrics []metric.Metric) error
+	}{
+		{name: "statements", putBatch: putBatchStatements},
+		{name: "upsert", putBatch: putBatch},
+	}
+	sizes := []struct {
+		hosts   int
+		perHost int
+	}{
+		{hosts: 1, perHost: 30},
+		{hosts: 100, perHost: 30},
+	}
+	for _, impl := range implementations {
+		for _, size := range sizes {
+			metrics := benchBatch(size.hosts, size.perHost)
+			b.Run(fmt.Sprintf("%s/%d", impl.name, len(metrics)), func(b *testing.B) {
+				ctx := context.Background()
+				for range b.N {
+					tx, err := db.BeginTx(ctx, nil)
+					if err != nil {
+						b.Fatal(err)
+					}
+					if err := impl.putBatch(ctx, tx, metrics); err != nil {
+						tx.Rollback()
+						b.Fatal(err)
+					}
+					if err := tx.Commit(); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestCompareMetrics(t *testing.T) {
+	metrics := []metric.Metric{
+		{ID: "b", MType: metric.Gauge},
+		{ID: "a", MType: metric.Gauge, Labels: metric.Labels{"host": "b"}},
+		{ID: "b", MType: metric.Counter},
+		{ID: "a", MType: metric.Gauge, Labels: metric.Labels{"host": "a"}},
+		{ID: "a", MType: metric.Gauge},
+	}
+	slices.SortFunc(metrics, compareMetrics)
+	require.Equal(t, []metric.Metric{
+		{ID: "b", MType: metric.Counter},
+		{ID: "a", MType: metric.Gauge},
+		{ID: "a", MType: metric.Gauge, Labels: metric.Labels{"host": "a"}},
+		{ID: "a", MType: metric.Gauge, Labels: metric.Labels{"host": "b"}},
+		{ID: "b", MType: metric.Gauge},
+	}, metrics)
+}
@@ -2,16 +2,21 @@ package database
 
 import (
 	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
 
 	"github.com/sudeeya/metrics-harvester/internal/metric"
 )
 
 // DBMetric is an auxiliary structure into which the database response is written.
 type DBMetric struct {
-	ID    string          `db:"id"`
-	MType string          `db:"type"`
-	Delta sql.NullInt64   `db:"delta"`
-	Value sql.NullFloat64 `db:"value"`
+	ID        string          `db:"id"`
+	MType     string          `db:"type"`
+	Delta     sql.NullInt64   `db:"delta"`
+	Value     sql.NullFloat64 `db:"value"`
+	Labels    DBLabels        `db:"labels"`
+	Histogram *DBHistogram    `db:"histogram"`
 }
 
 // ToMetric converts DBMetric to metric.Metric.
@@ -25,5 +30,92 @@ func (dbm DBMetric) ToMetric() metric.Metric {
 	if dbm.Value.Valid {
 		m.Value = &dbm.Value.Float64
 	}
+	if len(dbm.Labels) > 0 {
+		m.Labels = metric.Labels(dbm.Labels)
+	}
+	m.Histogram = (*metric.HistogramValue)(dbm.Histogram)
 	return m
 }
+
+// DBLabels scans the JSONB labels of a metric.
+type DBLabels metric.Labels
+
+// Scan implements the sql.Scanner interface.
+func (l *DBLabels) Scan(src any) error {
+	var data []byte
+	switch v := src.(type) {
+	case nil:
+		*l = nil
+		return nil
+	case []byte:
+		data = v
+	case string:
+		data = []byte(v)
+	default:
+		return fmt.Errorf("cannot scan %T into labels", src)
+	}
+	return json.Unmarshal(data, (*map[string]string)(l))
+}
+
+// DBHistogram scans the JSONB histogram of a metric.
+type DBHistogram metric.HistogramValue
+
+// Scan implements the sql.Scanner interface.
+func (h *DBHistogram) Scan(src any) error {
+	switch v := src.(type) {
+	case []byte:
+		return json.Unmarshal(v, (*metric.HistogramValue)(h))
+	case string:
+		return json.Unmarshal([]byte(v), (*metric.HistogramValue)(h))
+	default:
+		return fmt.Errorf("cannot scan %T into histogram", src)
+	}
+}
+
+// histogramJSON returns the histogram as a JSON object for a JSONB parameter,
+// or nil if there is no histogram.
+func histogramJSON(h *metric.HistogramValue) (*string, error) {
+	if h == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(h)
+	if err != nil {
+		return nil, err
+	}
+	s := string(data)
+	return &s, nil
+}
+
+// labelsJSON returns the labels as a JSON object for a JSONB parameter.
+// Nil labels are an empty object, like the labels of metrics stored before labels were introduced.
+func labelsJSON(labels metric.Labels) (string, error) {
+	if len(labels) == 0 {
+		return "{}", nil
+	}
+	data, err := json.Marshal(labels)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// DBPoint is an auxiliary structure into which the history response is written.
+type DBPoint struct {
+	Time      time.Time       `db:"ts"`
+	Delta     sql.NullInt64   `db:"delta"`
+	Value     sql.NullFloat64 `db:"value"`
+	Histogram *DBHistogram    `db:"histogram"`
+}
+
+// ToPoint converts DBPoint to metric.Point.
+func (dbp DBPoint) ToPoint() metric.Point {
+	p := metric.Point{Time: dbp.Time}
+	if dbp.Delta.Valid {
+		p.Delta = &dbp.Delta.Int64
+	}
+	if dbp.Value.Valid {
+		p.Value = &dbp.Value.Float64
+	}
+	p.Histogram = (*metric.HistogramValue)(dbp.Histogram)
+	return p
+}
@@ -0,0 +1,154 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// migrationLockID identifies the advisory lock held while migrating,
+// so concurrently starting servers apply migrations one at a time.
+const migrationLockID = 0x6d68617276657374
+
+// ErrSchemaTooNew is returned by Migrate if the database has been migrated
+// by a newer version of the server than the running one.
+var ErrSchemaTooNew = errors.New("database schema is newer than the server")
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// SQL commands used by migrations.
+const (
+	// createMigrationsTable is used to create table of applied migrations.
+	createMigrationsTable = `
+CREATE TABLE IF NOT EXISTS schema_migrations (
+	version INTEGER PRIMARY KEY,
+	applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+`
+
+	// selectSchemaVersion is used to get the version of the last applied migration.
+	selectSchemaVersion = `
+SELECT COALESCE(MAX(version), 0) FROM schema_migrations;
+`
+
+	// insertSchemaVersion is used to record an applied migration.
+	insertSchemaVersion = `
+INSERT INTO schema_migrations (version) VALUES ($1);
+`
+)
+
+// migration is an embedded SQL file named like 0001_description.sql.
+type migration struct {
+	version int
+	name    string
+	sql     string
+}
+
+// loadMigrations returns the embedded migrations sorted by version.
+// Versions must start with 1 and have no gaps.
+func loadMigrations() ([]migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	migrations := make([]migration, 0, len(entries))
+	for i, entry := range entries {
+		prefix, _, ok := strings.Cut(entry.Name(), "_")
+		if !ok {
+			return nil, fmt.Errorf("migration %s has no version", entry.Name())
+		}
+		version, err := strconv.Atoi(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s has no version: %w", entry.Name(), err)
+		}
+		if version != i+1 {
+			return nil, fmt.Errorf("migration %s must have version %d", entry.Name(), i+1)
+		}
+		data, err := fs.ReadFile(migrationFiles, path.Join("migrations", entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, migration{version: version, name: entry.Name(), sql: string(data)})
+	}
+	return migrations, nil
+}
+
+// SchemaVersion returns the latest schema version known to the server.
+func SchemaVersion() (int, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return 0, err
+	}
+	return len(migrations), nil
+}
+
+// Migrate applies the embedded migrations newer than the database schema.
+// Every migration is applied in its own transaction together with its version,
+// and the whole run holds an advisory lock.
+// Returns the schema versions before and after migrating.
+// Returns ErrSchemaTooNew if the database schema is newer than the latest migration.
+func (db *Database) Migrate(ctx context.Context) (from, to int, err error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// The advisory lock belongs to a session, so everything runs on one connection.
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLockID); err != nil {
+		return 0, 0, err
+	}
+	defer func() {
+		// The lock is released on a new context, so it is not leaked if ctx is done.
+		if _, unlockErr := conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", migrationLockID); unlockErr != nil {
+			err = errors.Join(err, unlockErr)
+		}
+	}()
+
+	if _, err := conn.ExecContext(ctx, createMigrationsTable); err != nil {
+		return 0, 0, err
+	}
+	if err := conn.QueryRowContext(ctx, selectSchemaVersion).Scan(&from); err != nil {
+		return 0, 0, err
+	}
+	if from > len(migrations) {
+		return from, from, fmt.Errorf("%w: database version is %d, server version is %d", ErrSchemaTooNew, from, len(migrations))
+	}
+
+	to = from
+	for _, m := range migrations[from:] {
+		if err := applyMigration(ctx, conn, m); err != nil {
+			return from, to, fmt.Errorf("migration %s: %w", m.name, err)
+		}
+		to = m.version
+	}
+	return from, to, nil
+}
+
+func applyMigration(ctx context.Context, conn *sql.Conn, m migration) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	// Rollback does nothing once the transaction is committed.
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, m.sql); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, insertSchemaVersion, m.version); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
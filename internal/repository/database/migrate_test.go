@@ -0,0 +1,21 @@
+package database
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	migrations, err := loadMigrations()
+	require.NoError(t, err)
+	require.NotEmpty(t, migrations)
+	for i, m := range migrations {
+		require.Equal(t, i+1, m.version, m.name)
+		require.NotEmpty(t, m.sql, m.name)
+	}
+
+	version, err := SchemaVersion()
+	require.NoError(t, err)
+	require.Equal(t, len(migrations), version)
+}
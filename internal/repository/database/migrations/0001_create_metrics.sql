@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS metrics (
+	id TEXT PRIMARY KEY,
+	type TEXT NOT NULL,
+	delta BIGINT,
+	value DOUBLE PRECISION
+);
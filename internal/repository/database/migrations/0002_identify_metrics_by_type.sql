@@ -0,0 +1,10 @@
+-- Metrics are identified by type and name instead of name only.
+-- Databases created before migrations were introduced may already be migrated.
+DO $$
+BEGIN
+	IF (SELECT array_length(conkey, 1) FROM pg_constraint WHERE conname = 'metrics_pkey' AND conrelid = 'metrics'::regclass) = 1 THEN
+		ALTER TABLE metrics DROP CONSTRAINT metrics_pkey;
+		ALTER TABLE metrics ADD PRIMARY KEY (type, id);
+	END IF;
+END
+$$;
@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS batches (
+	key TEXT PRIMARY KEY,
+	applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS batches_applied_at ON batches (applied_at);
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS history (
+	id TEXT NOT NULL,
+	type TEXT NOT NULL,
+	ts TIMESTAMPTZ NOT NULL DEFAULT now(),
+	delta BIGINT,
+	value DOUBLE PRECISION
+);
+CREATE INDEX IF NOT EXISTS history_metric_ts ON history (type, id, ts);
+CREATE INDEX IF NOT EXISTS history_ts ON history (ts);
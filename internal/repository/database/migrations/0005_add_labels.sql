@@ -0,0 +1,10 @@
+-- Labels are part of the identity of a metric.
+-- Metrics stored before labels were introduced have empty labels.
+ALTER TABLE metrics ADD COLUMN IF NOT EXISTS labels JSONB NOT NULL DEFAULT '{}';
+ALTER TABLE metrics DROP CONSTRAINT IF EXISTS metrics_pkey;
+ALTER TABLE metrics ADD PRIMARY KEY (type, id, labels);
+CREATE INDEX IF NOT EXISTS metrics_labels ON metrics USING GIN (labels);
+
+ALTER TABLE history ADD COLUMN IF NOT EXISTS labels JSONB NOT NULL DEFAULT '{}';
+DROP INDEX IF EXISTS history_metric_ts;
+CREATE INDEX history_metric_ts ON history (type, id, labels, ts);
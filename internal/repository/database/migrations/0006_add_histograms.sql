@@ -0,0 +1,3 @@
+-- Histograms are stored as JSON objects with their bounds, counts of every bucket, count and sum.
+ALTER TABLE metrics ADD COLUMN IF NOT EXISTS histogram JSONB;
+ALTER TABLE history ADD COLUMN IF NOT EXISTS histogram JSONB;
@@ -0,0 +1,2 @@
+-- Partial batches record the metrics they rejected, so a retried batch gets the same result.
+ALTER TABLE batches ADD COLUMN IF NOT EXISTS rejections JSONB;
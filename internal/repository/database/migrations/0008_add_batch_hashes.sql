@@ -0,0 +1,3 @@
+-- Batches record the hash of their metrics, so a key reused for other metrics is detected.
+-- Keys recorded before have no hash and are not checked.
+ALTER TABLE batches ADD COLUMN IF NOT EXISTS hash TEXT;
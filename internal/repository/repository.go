@@ -3,24 +3,108 @@ package repository
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
 
 	"github.com/sudeeya/metrics-harvester/internal/metric"
 )
 
+// ErrDuplicateBatch is returned by PutBatchOnce if the batch has already been inserted.
+var ErrDuplicateBatch = errors.New("batch has already been applied")
+
+// ErrBatchKeyReused is returned by PutBatchOnce and PutPartialOnce
+// if the key has been recorded with a batch of other metrics.
+var ErrBatchKeyReused = errors.New("batch key has been used for other metrics")
+
+// BatchHash returns the hash of the metrics of a batch.
+// It is recorded with the key of the batch, so a key reused for other metrics is detected.
+func BatchHash(metrics []metric.Metric) (string, error) {
+	data, err := json.Marshal(metrics)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// HistoryRetention is how long Repository keeps the history of metrics.
+// Points older than that are not returned and are discarded by PruneHistory.
+const HistoryRetention = time.Hour
+
+// RetainedFrom returns the later of from and the start of the retention at the moment now,
+// so the history returned by every Repository starts at the same point.
+func RetainedFrom(from, now time.Time) time.Time {
+	if start := now.Add(-HistoryRetention); from.Before(start) {
+		return start
+	}
+	return from
+}
+
+// HistoryPruner is implemented by the repositories whose discarded points
+// must be deleted periodically by the caller, so that writers do not delete them.
+type HistoryPruner interface {
+	// PruneHistory deletes the points older than HistoryRetention.
+	PruneHistory(ctx context.Context) error
+}
+
+// Rejection is a metric of a partial batch rejected by Repository,
+// since it conflicts with the stored one.
+type Rejection struct {
+	// Index is the index of the metric in the batch.
+	Index int `json:"index"`
+
+	// Reason is the error of the metric.
+	Reason string `json:"reason"`
+}
+
 // Repository describes interaction with an object storing metrics.
+// Metrics are identified by their type, name and labels,
+// so a gauge and a counter with the same name are different metrics,
+// as are metrics with the same name reported with different labels.
 type Repository interface {
 	// PutMetric inserts a metric into Repository.
 	// Returns an error if the metric could not be inserted.
+	// The error wraps metric.ErrTypeConflict if the stored metric has another type.
 	PutMetric(ctx context.Context, m metric.Metric) error
 
 	// PutBatch inserts a slice of metrics into Repository.
 	// The same metric can be present in a slice with different values.
-	// Returns an error if any of the metrics could not be inserted.
+	// The batch is atomic: if any of the metrics could not be inserted,
+	// none of them are and an error is returned.
 	PutBatch(ctx context.Context, metrics []metric.Metric) error
 
-	// GetMetric returns a metric by its name (ID).
+	// PutBatchOnce inserts a slice of metrics like PutBatch,
+	// unless a batch with the same key has recently been inserted.
+	// The key is recorded atomically with the metrics,
+	// so a retried batch does not increase counters twice.
+	// Returns ErrDuplicateBatch without inserting anything if the key is known,
+	// or ErrBatchKeyReused if the key is known for a batch of other metrics.
+	PutBatchOnce(ctx context.Context, key string, metrics []metric.Metric) error
+
+	// PutPartialOnce inserts every metric of a slice which does not conflict with the stored one,
+	// unless a batch with the same key has recently been inserted.
+	// A metric whose error satisfies metric.IsConflict is rejected, and the other ones are inserted.
+	// The key is recorded atomically with the inserted metrics and the rejections,
+	// so a retried batch gets the same result and does not increase counters twice.
+	// Returns the rejections sorted by index.
+	// If the key is known, returns the rejections of the original batch and ErrDuplicateBatch
+	// without inserting anything, or only ErrBatchKeyReused if the original batch had other metrics.
+	// Any other error fails the whole batch and nothing is inserted.
+	PutPartialOnce(ctx context.Context, key string, metrics []metric.Metric) ([]Rejection, error)
+
+	// GetMetric returns a metric by its type, name (ID) and labels.
+	// Nil labels identify the metric without labels.
 	// Returns an error if the metric could not be found.
-	GetMetric(ctx context.Context, mName string) (metric.Metric, error)
+	GetMetric(ctx context.Context, mType, mName string, labels metric.Labels) (metric.Metric, error)
+
+	// GetHistory returns the points of a metric recorded from from to to inclusive, sorted by time.
+	// Every update of a metric is recorded as a point,
+	// but points older than HistoryRetention are never returned.
+	// Returns an error if the history could not be retrieved.
+	GetHistory(ctx context.Context, mType, mName string, labels metric.Labels, from, to time.Time) ([]metric.Point, error)
 
 	// GetAllMetrics returns a slice containing all metrics from Repository.
 	// Returns an error if the metrics could not be retrieved.
@@ -30,3 +114,15 @@ type Repository interface {
 	// Returns an error if the repository could not be closed.
 	Close() error
 }
+
+// Unwrap returns the repository decorated by r, such as snapshot.Synced,
+// or r itself if it is not a decorator.
+func Unwrap(r Repository) Repository {
+	for {
+		decorator, ok := r.(interface{ Unwrap() Repository })
+		if !ok {
+			return r
+		}
+		r = decorator.Unwrap()
+	}
+}
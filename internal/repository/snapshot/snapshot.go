@@ -0,0 +1,260 @@
+// Package snapshot stores the metrics of a Repository to a file and reads them back.
+//
+// A snapshot is written to a temporary file, synced and renamed into place,
+// so a crash never leaves a partially written snapshot behind.
+// The previous snapshots are kept next to it with the suffixes .1, .2 and so on,
+// the greater the suffix, the older the snapshot.
+package snapshot
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/sudeeya/metrics-harvester/internal/metric"
+	repo "github.com/sudeeya/metrics-harvester/internal/repository"
+)
+
+// FormatVersion is the version of the snapshot format written by File.
+const FormatVersion = 1
+
+// ErrNoSnapshot is returned by Read if no snapshot has been stored yet.
+var ErrNoSnapshot = errors.New("no snapshot")
+
+// header precedes the metrics in a snapshot file.
+type header struct {
+	// Version is the format version.
+	Version int `json:"version"`
+
+	// Time is the time the snapshot was taken at.
+	Time time.Time `json:"time"`
+
+	// Sequence is the sequence number of the last write-ahead log record covered by the snapshot.
+	Sequence uint64 `json:"sequence,omitempty"`
+
+	// Checksum is the hex encoded SHA-256 of Metrics in the compact form,
+	// so it does not depend on indentation.
+	Checksum string `json:"checksum"`
+
+	// Metrics is the JSON array of metrics.
+	Metrics json.RawMessage `json:"metrics"`
+}
+
+// Snapshot is the content of a snapshot file.
+type Snapshot struct {
+	// Path is the file the snapshot was read from.
+	Path string
+
+	// Time is the time the snapshot was taken at.
+	// It is zero for snapshots written before the format had a header.
+	Time time.Time
+
+	// Sequence is the sequence number of the last write-ahead log record covered by the snapshot.
+	// It is zero if the updates are not logged.
+	Sequence uint64
+
+	// Metrics are the stored metrics.
+	Metrics []metric.Metric
+}
+
+// File stores snapshots to the path and keeps the given number of the latest ones.
+type File struct {
+	path string
+	keep int
+	// mutex serializes writes, since they rotate the same files.
+	mutex sync.Mutex
+}
+
+// NewFile returns File storing snapshots to the path.
+// At least one snapshot is kept.
+func NewFile(path string, keep int) *File {
+	return &File{
+		path: path,
+		keep: max(keep, 1),
+	}
+}
+
+// generation returns the path of the snapshot stored i snapshots ago.
+func (f *File) generation(i int) string {
+	if i == 0 {
+		return f.path
+	}
+	return fmt.Sprintf("%s.%d", f.path, i)
+}
+
+// Write saves the metrics as the latest snapshot and rotates the previous ones.
+func (f *File) Write(metrics []metric.Metric) error {
+	return f.WriteSequence(metrics, 0)
+}
+
+// WriteSequence saves the metrics as the latest snapshot like Write
+// and records that it covers the write-ahead log up to the record with the sequence number.
+func (f *File) WriteSequence(metrics []metric.Metric, seq uint64) error {
+	if metrics == nil {
+		metrics = []metric.Metric{}
+	}
+	data, err := encode(metrics, seq, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	tmp, err := writeTemp(filepath.Dir(f.path), filepath.Base(f.path), data)
+	if err != nil {
+		return err
+	}
+	if err := f.rotate(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, f.path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncDir(filepath.Dir(f.path))
+}
+
+// rotate shifts every kept snapshot one generation older, dropping the oldest one.
+func (f *File) rotate() error {
+	for i := f.keep - 1; i > 0; i-- {
+		err := os.Rename(f.generation(i-1), f.generation(i))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Read returns the latest valid snapshot.
+// Snapshots which are truncated or fail the checksum are skipped.
+// Returns ErrNoSnapshot if there are no snapshots,
+// or an error for every invalid snapshot if none of them is valid.
+func (f *File) Read() (Snapshot, error) {
+	var errs []error
+	for i := range f.keep {
+		path := f.generation(i)
+		data, err := os.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		s, err := decode(data)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("snapshot %s: %w", path, err))
+			continue
+		}
+		s.Path = path
+		return s, nil
+	}
+	if len(errs) == 0 {
+		return Snapshot{}, ErrNoSnapshot
+	}
+	return Snapshot{}, errors.Join(errs...)
+}
+
+// Store saves all metrics of the repository as the latest snapshot.
+func (f *File) Store(ctx context.Context, repository repo.Repository) error {
+	metrics, err := repository.GetAllMetrics(ctx)
+	if err != nil {
+		return err
+	}
+	return f.Write(metrics)
+}
+
+func encode(metrics []metric.Metric, seq uint64, t time.Time) ([]byte, error) {
+	data, err := json.Marshal(metrics)
+	if err != nil {
+		return nil, err
+	}
+	checksum := sha256.Sum256(data)
+	return json.MarshalIndent(header{
+		Version:  FormatVersion,
+		Time:     t,
+		Sequence: seq,
+		Checksum: hex.EncodeToString(checksum[:]),
+		Metrics:  data,
+	}, "", "\t")
+}
+
+func decode(data []byte) (Snapshot, error) {
+	// Snapshots written before the format had a header are plain arrays of metrics.
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		var metrics []metric.Metric
+		if err := json.Unmarshal(trimmed, &metrics); err != nil {
+			return Snapshot{}, err
+		}
+		return Snapshot{Metrics: metrics}, nil
+	}
+
+	var h header
+	if err := json.Unmarshal(data, &h); err != nil {
+		return Snapshot{}, err
+	}
+	if h.Version < 1 || h.Version > FormatVersion {
+		return Snapshot{}, fmt.Errorf("unsupported format version %d", h.Version)
+	}
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, h.Metrics); err != nil {
+		return Snapshot{}, err
+	}
+	checksum := sha256.Sum256(compact.Bytes())
+	if hex.EncodeToString(checksum[:]) != h.Checksum {
+		return Snapshot{}, errors.New("checksum mismatch")
+	}
+	var metrics []metric.Metric
+	if err := json.Unmarshal(h.Metrics, &metrics); err != nil {
+		return Snapshot{}, err
+	}
+	return Snapshot{Time: h.Time, Sequence: h.Sequence, Metrics: metrics}, nil
+}
+
+// writeTemp writes the data to a new synced file in the directory and returns its path.
+func writeTemp(dir, name string, data []byte) (string, error) {
+	file, err := os.CreateTemp(dir, name+".tmp-*")
+	if err != nil {
+		return "", err
+	}
+	// CreateTemp makes the file private, but snapshots are readable like other files.
+	if err := file.Chmod(0644); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return "", err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return "", err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return "", err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+// syncDir makes the renames in the directory durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
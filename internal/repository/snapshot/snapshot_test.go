@@ -0,0 +1,131 @@
+package snapshot
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sudeeya/metrics-harvester/internal/metric"
+)
+
+func counters(deltas ...int64) []metric.Metric {
+	metrics := make([]metric.Metric, len(deltas))
+	for i, delta := range deltas {
+		metrics[i] = metric.Metric{ID: "counter", MType: metric.Counter, Delta: int64Ptr(delta)}
+	}
+	return metrics
+}
+
+func TestFile_Rotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	file := NewFile(path, 3)
+	for i := range int64(5) {
+		require.NoError(t, file.Write(counters(i)))
+	}
+
+	for i, expected := range []int64{4, 3, 2} {
+		s, err := decodeFile(file.generation(i))
+		require.NoError(t, err)
+		require.Equal(t, expected, *s.Metrics[0].Delta)
+		require.False(t, s.Time.IsZero())
+	}
+	_, err := os.Stat(file.generation(3))
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	entries, err := os.ReadDir(filepath.Dir(path))
+	require.NoError(t, err)
+	for _, entry := range entries {
+		require.NotContains(t, entry.Name(), ".tmp-", "temporary files must be renamed")
+	}
+}
+
+func TestFile_Read(t *testing.T) {
+	tests := []struct {
+		name     string
+		damage   func(t *testing.T, file *File)
+		expected int64
+		wantErr  bool
+	}{
+		{
+			name:     "latest is valid",
+			damage:   func(t *testing.T, file *File) {},
+			expected: 2,
+		},
+		{
+			name: "latest is truncated",
+			damage: func(t *testing.T, file *File) {
+				data, err := os.ReadFile(file.path)
+				require.NoError(t, err)
+				require.NoError(t, os.WriteFile(file.path, data[:len(data)/2], 0666))
+			},
+			expected: 1,
+		},
+		{
+			name: "latest fails the checksum",
+			damage: func(t *testing.T, file *File) {
+				data, err := os.ReadFile(file.path)
+				require.NoError(t, err)
+				data = []byte(strings.Replace(string(data), `"delta": 2`, `"delta": 9`, 1))
+				require.NoError(t, os.WriteFile(file.path, data, 0666))
+			},
+			expected: 1,
+		},
+		{
+			name: "latest is missing",
+			damage: func(t *testing.T, file *File) {
+				require.NoError(t, os.Remove(file.path))
+			},
+			expected: 1,
+		},
+		{
+			name: "all are damaged",
+			damage: func(t *testing.T, file *File) {
+				require.NoError(t, os.WriteFile(file.generation(0), []byte("{"), 0666))
+				require.NoError(t, os.WriteFile(file.generation(1), []byte("{"), 0666))
+			},
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file := NewFile(filepath.Join(t.TempDir(), "metrics.json"), 2)
+			require.NoError(t, file.Write(counters(1)))
+			require.NoError(t, file.Write(counters(2)))
+			test.damage(t, file)
+
+			s, err := file.Read()
+			if test.wantErr {
+				require.Error(t, err)
+				require.NotErrorIs(t, err, ErrNoSnapshot)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, test.expected, *s.Metrics[0].Delta)
+		})
+	}
+}
+
+func TestFile_ReadLegacy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	require.NoError(t, os.WriteFile(path, []byte(`[{"id": "counter", "type": "counter", "delta": 7}]`), 0666))
+
+	s, err := NewFile(path, 1).Read()
+	require.NoError(t, err)
+	require.Equal(t, path, s.Path)
+	require.True(t, s.Time.IsZero())
+	require.Equal(t, int64(7), *s.Metrics[0].Delta)
+
+	_, err = NewFile(filepath.Join(t.TempDir(), "missing.json"), 1).Read()
+	require.ErrorIs(t, err, ErrNoSnapshot)
+}
+
+func decodeFile(path string) (Snapshot, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	return decode(data)
+}
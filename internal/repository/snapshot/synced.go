@@ -0,0 +1,114 @@
+package snapshot
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/sudeeya/metrics-harvester/internal/metric"
+	repo "github.com/sudeeya/metrics-harvester/internal/repository"
+)
+
+// Synced is a Repository decorator which stores all metrics as the latest snapshot
+// after every successful write, before the write returns.
+//
+// If the file could not be stored, the write is applied to the repository,
+// but an error is returned, since it is not persisted.
+// Concurrent writers are coalesced: while the file is being stored,
+// the writes which complete are covered by the next store, which one of them performs for all.
+type Synced struct {
+	repo.Repository
+	file *File
+
+	mutex sync.Mutex
+	// stored is signaled every time a store finishes.
+	stored *sync.Cond
+	// written counts the writes completed in the repository.
+	written uint64
+	// synced counts the writes covered by the file.
+	synced uint64
+	// storing reports whether one of the writers is storing the file.
+	storing bool
+}
+
+var _ repo.Repository = (*Synced)(nil)
+
+// NewSynced returns Synced storing the metrics of the repository to the file.
+func NewSynced(repository repo.Repository, file *File) *Synced {
+	s := &Synced{
+		Repository: repository,
+		file:       file,
+	}
+	s.stored = sync.NewCond(&s.mutex)
+	return s
+}
+
+// Unwrap returns the decorated repository.
+func (s *Synced) Unwrap() repo.Repository {
+	return s.Repository
+}
+
+// PutMetric inserts a metric into the repository and stores the file.
+func (s *Synced) PutMetric(ctx context.Context, m metric.Metric) error {
+	if err := s.Repository.PutMetric(ctx, m); err != nil {
+		return err
+	}
+	return s.sync(ctx)
+}
+
+// PutBatch inserts a slice of metrics into the repository and stores the file.
+func (s *Synced) PutBatch(ctx context.Context, metrics []metric.Metric) error {
+	if err := s.Repository.PutBatch(ctx, metrics); err != nil {
+		return err
+	}
+	return s.sync(ctx)
+}
+
+// PutBatchOnce inserts a slice of metrics into the repository once and stores the file.
+// The file is not stored for a duplicate batch.
+func (s *Synced) PutBatchOnce(ctx context.Context, key string, metrics []metric.Metric) error {
+	if err := s.Repository.PutBatchOnce(ctx, key, metrics); err != nil {
+		return err
+	}
+	return s.sync(ctx)
+}
+
+// PutPartialOnce inserts the metrics of a slice not conflicting with the stored ones into the repository once
+// and stores the file.
+// The file is not stored for a duplicate batch.
+func (s *Synced) PutPartialOnce(ctx context.Context, key string, metrics []metric.Metric) ([]repo.Rejection, error) {
+	rejections, err := s.Repository.PutPartialOnce(ctx, key, metrics)
+	if err != nil {
+		return rejections, err
+	}
+	return rejections, s.sync(ctx)
+}
+
+// sync returns once the file covers the write which has just completed.
+// If no one is storing the file, the caller stores it for all completed writes.
+// Otherwise it waits for the store in progress, which may have started before its write.
+func (s *Synced) sync(ctx context.Context) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.written++
+	write := s.written
+	for s.synced < write {
+		if s.storing {
+			s.stored.Wait()
+			continue
+		}
+		s.storing = true
+		covered := s.written
+		s.mutex.Unlock()
+		err := s.file.Store(ctx, s.Repository)
+		s.mutex.Lock()
+		s.storing = false
+		s.stored.Broadcast()
+		if err != nil {
+			// The waiting writers retry the store themselves.
+			return fmt.Errorf("store %s: %w", s.file.path, err)
+		}
+		s.synced = max(s.synced, covered)
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package snapshot
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sudeeya/metrics-harvester/internal/metric"
+	"github.com/sudeeya/metrics-harvester/internal/repository/storage"
+)
+
+func int64Ptr(i int64) *int64 {
+	return &i
+}
+
+func float64Ptr(f float64) *float64 {
+	return &f
+}
+
+func TestSynced_ConcurrentWriters(t *testing.T) {
+	const writers = 50
+	ctx := context.Background()
+	file := NewFile(filepath.Join(t.TempDir(), "metrics.json"), 1)
+	s := NewSynced(storage.NewMemStorage(), file)
+
+	var wg sync.WaitGroup
+	for range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m := metric.Metric{ID: "counter", MType: metric.Counter, Delta: int64Ptr(1)}
+			require.NoError(t, s.PutMetric(ctx, m))
+		}()
+	}
+	wg.Wait()
+
+	snapshot, err := file.Read()
+	require.NoError(t, err)
+	require.Len(t, snapshot.Metrics, 1)
+	require.Equal(t, int64(writers), *snapshot.Metrics[0].Delta)
+}
+
+func TestSynced_Writes(t *testing.T) {
+	ctx := context.Background()
+	file := NewFile(filepath.Join(t.TempDir(), "metrics.json"), 1)
+	s := NewSynced(storage.NewMemStorage(), file)
+
+	require.NoError(t, s.PutBatch(ctx, []metric.Metric{
+		{ID: "gauge", MType: metric.Gauge, Value: float64Ptr(1.5)},
+	}))
+	snapshot, err := file.Read()
+	require.NoError(t, err)
+	require.Len(t, snapshot.Metrics, 1)
+
+	require.NoError(t, s.PutBatchOnce(ctx, "key", []metric.Metric{
+		{ID: "counter", MType: metric.Counter, Delta: int64Ptr(2)},
+	}))
+	snapshot, err = file.Read()
+	require.NoError(t, err)
+	require.Len(t, snapshot.Metrics, 2)
+
+	// A failed write does not store the file.
+	require.NoError(t, file.Write(nil))
+	require.Error(t, s.PutMetric(ctx, metric.Metric{ID: "gauge", MType: metric.Gauge}))
+	snapshot, err = file.Read()
+	require.NoError(t, err)
+	require.Empty(t, snapshot.Metrics)
+}
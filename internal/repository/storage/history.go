@@ -0,0 +1,53 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/sudeeya/metrics-harvester/internal/metric"
+)
+
+// HistorySize is the maximum number of points of every metric remembered by MemStorage.
+// It bounds the memory of a metric updated faster than its old points are pruned.
+const HistorySize = 3600
+
+// pointLog keeps the points of a metric in the order they were added.
+// Old points are kept until they are pruned or until there are HistorySize newer ones.
+type pointLog struct {
+	points []metric.Point
+}
+
+func (pl *pointLog) add(p metric.Point) {
+	// The oldest point is sliced off, and append drops it from memory
+	// the next time it moves the points to a new backing array.
+	if len(pl.points) >= HistorySize {
+		pl.points = pl.points[len(pl.points)-HistorySize+1:]
+	}
+	pl.points = append(pl.points, p)
+}
+
+// prune drops the leading points recorded before before.
+// Points are added in the order of their times, give or take concurrent batches,
+// so the old ones lead.
+func (pl *pointLog) prune(before time.Time) {
+	i := 0
+	for i < len(pl.points) && pl.points[i].Time.Before(before) {
+		i++
+	}
+	if i == 0 {
+		return
+	}
+	// The points are copied, so the dropped ones are not kept by the backing array.
+	pl.points = append([]metric.Point(nil), pl.points[i:]...)
+}
+
+// between returns the points from from to to inclusive in the order they were added.
+func (pl *pointLog) between(from, to time.Time) []metric.Point {
+	result := make([]metric.Point, 0)
+	for _, p := range pl.points {
+		if p.Time.Before(from) || p.Time.After(to) {
+			continue
+		}
+		result = append(result, p)
+	}
+	return result
+}
@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sudeeya/metrics-harvester/internal/metric"
+)
+
+// ShardCount is the number of shards the metrics of MemStorage are spread over.
+// It must not exceed 64, since a set of shards is a bit mask.
+const ShardCount = 32
+
+// allShards is the mask of every shard.
+const allShards = 1<<ShardCount - 1
+
+// shard stores the metrics whose keys hash to it.
+type shard struct {
+	mutex   sync.RWMutex
+	metrics map[metric.Key]metric.Metric
+	history map[metric.Key]*pointLog
+	// seqs has the sequence numbers of the log records of the stored gauges.
+	seqs map[metric.Key]uint64
+}
+
+// shardOf returns the index of the shard the key belongs to.
+// It is the FNV-1a hash of the type, the name and the canonical labels, which does not allocate,
+// so the series of a metric with many label values are spread over the shards.
+func shardOf(key metric.Key) int {
+	const (
+		offset = 14695981039346656037
+		prime  = 1099511628211
+	)
+	hash := uint64(offset)
+	for i := 0; i < len(key.MType); i++ {
+		hash = (hash ^ uint64(key.MType[i])) * prime
+	}
+	// A zero byte separates the type from the name.
+	hash *= prime
+	for i := 0; i < len(key.ID); i++ {
+		hash = (hash ^ uint64(key.ID[i])) * prime
+	}
+	// A zero byte separates the name from the labels.
+	hash *= prime
+	for i := 0; i < len(key.Labels); i++ {
+		hash = (hash ^ uint64(key.Labels[i])) * prime
+	}
+	return int(hash % ShardCount)
+}
+
+// bounds returns the buckets of the stored histogram.
+// If locked is false, the shard is read locked while they are read.
+// Otherwise the caller must hold the lock of the shard.
+func (s *shard) bounds(key metric.Key, locked bool) ([]float64, bool) {
+	if !locked {
+		s.mutex.RLock()
+		defer s.mutex.RUnlock()
+	}
+	m, ok := s.metrics[key]
+	if !ok {
+		return nil, false
+	}
+	return m.Histogram.Bounds, true
+}
+
+// merge applies the validated update logged with the sequence number and adds the new state to the history.
+// Updates of a shard applied one at a time may come in another order than their records,
+// so a gauge update older than the stored value is dropped and the state matches a replay of the log.
+// The caller must hold the write lock of the shard.
+func (s *shard) merge(update metric.Metric, seq uint64, t time.Time) {
+	key := update.Key()
+	if update.MType == metric.Gauge && seq > 0 {
+		if seq < s.seqs[key] {
+			return
+		}
+		if s.seqs == nil {
+			s.seqs = make(map[metric.Key]uint64)
+		}
+		s.seqs[key] = seq
+	}
+	value, ok := s.metrics[key]
+	if !ok {
+		value = metric.Metric{ID: update.ID, MType: update.MType, Labels: update.Labels}
+	}
+	// The update has been validated against the stored metric, whose buckets do not change.
+	_ = value.Merge(update)
+	s.metrics[key] = value
+	s.record(value, t)
+}
+
+// record adds the current state of the metric to its history.
+// The caller must hold the write lock of the shard.
+func (s *shard) record(m metric.Metric, t time.Time) {
+	if s.history == nil {
+		s.history = make(map[metric.Key]*pointLog)
+	}
+	history, ok := s.history[m.Key()]
+	if !ok {
+		history = &pointLog{}
+		s.history[m.Key()] = history
+	}
+	history.add(m.Point(t))
+}
+
+// prune drops the points recorded before before and the histories left empty.
+// The caller must hold the write lock of the shard.
+func (s *shard) prune(before time.Time) {
+	for key, history := range s.history {
+		history.prune(before)
+		if len(history.points) == 0 {
+			delete(s.history, key)
+		}
+	}
+}
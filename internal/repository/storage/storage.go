@@ -2,90 +2,500 @@
 package storage
 
 import (
+	"cmp"
 	"context"
+	"errors"
 	"fmt"
 	"slices"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/sudeeya/metrics-harvester/internal/metric"
 	"github.com/sudeeya/metrics-harvester/internal/repository"
 )
 
-var _ repository.Repository = (*MemStorage)(nil)
+var (
+	_ repository.Repository    = (*MemStorage)(nil)
+	_ repository.HistoryPruner = (*MemStorage)(nil)
+)
+
+// BatchWindow is the number of recent batch keys remembered by MemStorage.
+const BatchWindow = 10000
 
 // MemStorage implements the [Repository] interface.
+// Metrics are spread over ShardCount shards with a lock each,
+// so writers of different metrics rarely wait for each other.
 type MemStorage struct {
-	mutex   sync.RWMutex
-	metrics map[string]metric.Metric
+	shards [ShardCount]shard
+
+	// batchMutex guards batches and pending.
+	batchMutex sync.Mutex
+	batches    *keyWindow
+	// pending has the keys of the batches being applied.
+	// A duplicate of such a batch waits until the channel is closed.
+	pending map[string]chan struct{}
+
+	// applying is read locked by the batches applied one shard at a time,
+	// from the moment they are logged until they are applied.
+	applying sync.RWMutex
+
+	// wal records the updates before they are applied. It is nil if there is no log.
+	// It is set by Recover while every shard and applying are locked.
+	wal *WAL
 }
 
 func NewMemStorage() *MemStorage {
-	return &MemStorage{
-		metrics: make(map[string]metric.Metric),
+	ms := &MemStorage{}
+	for i := range ms.shards {
+		ms.shards[i].metrics = make(map[metric.Key]metric.Metric)
+	}
+	return ms
+}
+
+// shard returns the shard the key belongs to.
+func (ms *MemStorage) shard(key metric.Key) *shard {
+	return &ms.shards[shardOf(key)]
+}
+
+// lock takes the write locks of the shards in the mask in the order of their indexes,
+// so writers locking several shards do not deadlock.
+func (ms *MemStorage) lock(mask uint64) {
+	for i := range ms.shards {
+		if mask&(1<<i) != 0 {
+			ms.shards[i].mutex.Lock()
+		}
+	}
+}
+
+func (ms *MemStorage) unlock(mask uint64) {
+	for i := range ms.shards {
+		if mask&(1<<i) != 0 {
+			ms.shards[i].mutex.Unlock()
+		}
+	}
+}
+
+// rlockAll takes the read locks of every shard in the order of their indexes,
+// so readers see a consistent view of all shards at one moment.
+// Only a batch applied while all its shards are locked is seen either whole or not at all,
+// a batch applied one shard at a time may be seen in part.
+func (ms *MemStorage) rlockAll() {
+	for i := range ms.shards {
+		ms.shards[i].mutex.RLock()
+	}
+}
+
+func (ms *MemStorage) runlockAll() {
+	for i := range ms.shards {
+		ms.shards[i].mutex.RUnlock()
 	}
 }
 
 // PutMetric implements the [Repository] interface.
 func (ms *MemStorage) PutMetric(ctx context.Context, m metric.Metric) error {
-	ms.mutex.Lock()
-	defer ms.mutex.Unlock()
+	key := m.Key()
+	s := ms.shard(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 
-	value, ok := ms.metrics[m.ID]
+	value, ok := s.metrics[key]
 	if !ok {
-		ms.metrics[m.ID] = m
-		return nil
+		value = metric.Metric{ID: m.ID, MType: m.MType, Labels: m.Labels}
 	}
-	switch m.MType {
-	case metric.Gauge:
-		value.Update(*m.Value)
-	case metric.Counter:
-		value.Update(*m.Delta)
+	if err := value.Merge(m); err != nil {
+		return err
 	}
-	ms.metrics[m.ID] = value
+	seq, err := ms.log("", "", []metric.Metric{m}, nil)
+	if err != nil {
+		return err
+	}
+	s.merge(m, seq, time.Now())
 	return nil
 }
 
 // PutBatch implements the [Repository] interface.
 func (ms *MemStorage) PutBatch(ctx context.Context, metrics []metric.Metric) error {
-	for _, m := range metrics {
-		if err := ms.PutMetric(ctx, m); err != nil {
+	_, err := ms.putBatch("", "", metrics, false)
+	return err
+}
+
+// PutBatchOnce implements the [Repository] interface.
+// The last BatchWindow keys are remembered.
+// A batch whose duplicate is being applied waits for it and is rejected if it succeeds.
+func (ms *MemStorage) PutBatchOnce(ctx context.Context, key string, metrics []metric.Metric) error {
+	hash, err := repository.BatchHash(metrics)
+	if err != nil {
+		return err
+	}
+	if _, err := ms.reserve(ctx, key, hash); err != nil {
+		return err
+	}
+	_, err = ms.putBatch(key, hash, metrics, false)
+	ms.release(key, err == nil, appliedBatch{hash: hash})
+	return err
+}
+
+// PutPartialOnce implements the [Repository] interface.
+// The keys are shared with PutBatchOnce, and the last BatchWindow of them are remembered.
+func (ms *MemStorage) PutPartialOnce(ctx context.Context, key string, metrics []metric.Metric) ([]repository.Rejection, error) {
+	hash, err := repository.BatchHash(metrics)
+	if err != nil {
+		return nil, err
+	}
+	if rejections, err := ms.reserve(ctx, key, hash); err != nil {
+		return rejections, err
+	}
+	rejections, err := ms.putBatch(key, hash, metrics, true)
+	ms.release(key, err == nil, appliedBatch{hash: hash, rejections: rejections})
+	return rejections, err
+}
+
+// reserve marks the key as being applied.
+// Returns the rejections of the batch and ErrDuplicateBatch if a batch with the key has already been applied,
+// or ErrBatchKeyReused if the batch had metrics of another hash.
+func (ms *MemStorage) reserve(ctx context.Context, key, hash string) ([]repository.Rejection, error) {
+	for {
+		ms.batchMutex.Lock()
+		if ms.batches != nil {
+			if batch, ok := ms.batches.get(key); ok {
+				ms.batchMutex.Unlock()
+				if batch.hash != "" && batch.hash != hash {
+					return nil, repository.ErrBatchKeyReused
+				}
+				return batch.rejections, repository.ErrDuplicateBatch
+			}
+		}
+		done, ok := ms.pending[key]
+		if !ok {
+			if ms.pending == nil {
+				ms.pending = make(map[string]chan struct{})
+			}
+			ms.pending[key] = make(chan struct{})
+			ms.batchMutex.Unlock()
+			return nil, nil
+		}
+		ms.batchMutex.Unlock()
+
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// release remembers the key with its batch if the batch has been applied
+// and wakes up the duplicates waiting for it.
+func (ms *MemStorage) release(key string, applied bool, batch appliedBatch) {
+	ms.batchMutex.Lock()
+	defer ms.batchMutex.Unlock()
+
+	if applied {
+		ms.remember(key, batch)
+	}
+	close(ms.pending[key])
+	delete(ms.pending, key)
+}
+
+// remember adds the key to the window of applied batches.
+// The caller must hold batchMutex.
+func (ms *MemStorage) remember(key string, batch appliedBatch) {
+	if ms.batches == nil {
+		ms.batches = newKeyWindow(BatchWindow)
+	}
+	ms.batches.add(key, batch)
+}
+
+// putBatch validates the metrics against each other and the stored metrics first,
+// so the storage is left unchanged if any of them fails.
+// If the batch is partial, the metrics conflicting with the stored ones are rejected
+// and the other ones are applied. Otherwise a conflict fails the batch.
+// The key and the hash of the batch, if any, are recorded in the log together with the applied metrics and the rejections.
+//
+// The stored buckets of a histogram never change, so once the batch is validated
+// it is applied one shard at a time and writers of other shards do not wait for the whole batch.
+// Readers may see a part of such a batch, but a failed batch is never seen.
+// Only a batch creating a histogram, which a concurrent batch may create with other buckets,
+// locks all its shards at once.
+func (ms *MemStorage) putBatch(key, hash string, metrics []metric.Metric, partial bool) ([]repository.Rejection, error) {
+	// The shard of every metric is hashed once.
+	shards := make([]int, len(metrics))
+	var mask uint64
+	for i, m := range metrics {
+		shards[i] = shardOf(m.Key())
+		mask |= 1 << shards[i]
+	}
+	accepted, rejections, err := ms.stage(metrics, shards, partial, false)
+	if errors.Is(err, errNewHistogram) {
+		return ms.putBatchLocked(key, hash, metrics, shards, mask, partial)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Checkpoint waits for the logged batches to be applied.
+	ms.applying.RLock()
+	defer ms.applying.RUnlock()
+	seq, err := ms.log(key, hash, acceptedMetrics(metrics, accepted, rejections), rejections)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for i := range ms.shards {
+		if mask&(1<<i) == 0 {
+			continue
+		}
+		s := &ms.shards[i]
+		s.mutex.Lock()
+		for _, j := range accepted {
+			if shards[j] == i {
+				s.merge(metrics[j], seq, now)
+			}
+		}
+		s.mutex.Unlock()
+	}
+	return rejections, nil
+}
+
+// putBatchLocked is putBatch for the batches creating histograms.
+// It validates and applies the batch while every shard of the batch is locked.
+func (ms *MemStorage) putBatchLocked(key, hash string, metrics []metric.Metric, shards []int, mask uint64, partial bool) ([]repository.Rejection, error) {
+	ms.lock(mask)
+	defer ms.unlock(mask)
+
+	accepted, rejections, err := ms.stage(metrics, shards, partial, true)
+	if err != nil {
+		return nil, err
+	}
+	seq, err := ms.log(key, hash, acceptedMetrics(metrics, accepted, rejections), rejections)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for _, i := range accepted {
+		ms.shards[shards[i]].merge(metrics[i], seq, now)
+	}
+	return rejections, nil
+}
+
+// errNewHistogram is returned by stage if a histogram of the batch is not stored yet.
+var errNewHistogram = errors.New("new histogram")
+
+// stage merges the metrics into a staging copy of their stored state
+// and returns the indexes of the accepted metrics and the rejections.
+// Only the buckets of the stored histograms are read, since nothing else can fail an update.
+// If locked is false, every shard is read locked in turn
+// and errNewHistogram is returned for a histogram which is not stored.
+// Otherwise the caller must hold the write locks of the shards of the metrics.
+func (ms *MemStorage) stage(metrics []metric.Metric, shards []int, partial, locked bool) ([]int, []repository.Rejection, error) {
+	staged := make(map[metric.Key]metric.Metric, len(metrics))
+	accepted := make([]int, 0, len(metrics))
+	var rejections []repository.Rejection
+	for i, m := range metrics {
+		value, ok := staged[m.Key()]
+		if !ok {
+			value = metric.Metric{ID: m.ID, MType: m.MType, Labels: m.Labels}
+			if m.MType == metric.Histogram {
+				bounds, ok := ms.shards[shards[i]].bounds(m.Key(), locked)
+				if !ok && !locked {
+					return nil, nil, errNewHistogram
+				}
+				if ok {
+					value.Histogram = metric.NewHistogramValue(bounds)
+				}
+			}
+		}
+		if err := value.Merge(m); err != nil {
+			if !partial || !metric.IsConflict(err) {
+				return nil, nil, err
+			}
+			rejections = append(rejections, repository.Rejection{Index: i, Reason: err.Error()})
+			continue
+		}
+		staged[m.Key()] = value
+		accepted = append(accepted, i)
+	}
+	return accepted, rejections, nil
+}
+
+// acceptedMetrics returns the accepted metrics of the batch, which are all of them if none is rejected.
+func acceptedMetrics(metrics []metric.Metric, accepted []int, rejections []repository.Rejection) []metric.Metric {
+	if len(rejections) == 0 {
+		return metrics
+	}
+	result := make([]metric.Metric, len(accepted))
+	for i, j := range accepted {
+		result[i] = metrics[j]
+	}
+	return result
+}
+
+// log writes the accepted updates to the log before they are applied
+// and returns the sequence number of the record, which is zero if there is no log.
+// The caller must hold either the write locks of the shards of the updates or the read lock of applying.
+func (ms *MemStorage) log(key, hash string, metrics []metric.Metric, rejections []repository.Rejection) (uint64, error) {
+	if ms.wal == nil {
+		return 0, nil
+	}
+	return ms.wal.write(key, hash, metrics, rejections)
+}
+
+// Recover applies the records of the log which follow the snapshot with the given sequence number,
+// then MemStorage records every update in the log before applying it.
+// If the log lacks records following the snapshot, the updates of the present ones are still applied
+// and the log is used, but an error wrapping ErrWALGap is returned.
+// Recover must be called once, after the snapshot is restored.
+func (ms *MemStorage) Recover(wal *WAL, after uint64) error {
+	err := wal.Replay(after, func(key, hash string, metrics []metric.Metric, rejections []repository.Rejection) error {
+		if _, err := ms.putBatch("", "", metrics, false); err != nil {
 			return err
 		}
+		if key != "" {
+			ms.batchMutex.Lock()
+			ms.remember(key, appliedBatch{hash: hash, rejections: rejections})
+			ms.batchMutex.Unlock()
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, ErrWALGap) {
+		return err
 	}
-	return nil
+	ms.applying.Lock()
+	defer ms.applying.Unlock()
+	ms.lock(allShards)
+	defer ms.unlock(allShards)
+	ms.wal = wal
+	return err
+}
+
+// Checkpoint passes all metrics and the sequence number of the last record covering them to store,
+// which is expected to save a snapshot.
+// Once it succeeds, the records covered by the snapshot are dropped from the log.
+// Updates are not blocked while store runs.
+func (ms *MemStorage) Checkpoint(store func(metrics []metric.Metric, seq uint64) error) error {
+	// Every logged update is applied before the metrics are copied, so the snapshot covers its record.
+	ms.applying.Lock()
+	ms.rlockAll()
+	metrics := ms.allMetrics()
+	wal := ms.wal
+	var (
+		seq  uint64
+		size int64
+	)
+	if wal != nil {
+		seq, size = wal.position()
+	}
+	ms.runlockAll()
+	ms.applying.Unlock()
+
+	sortMetrics(metrics)
+	if err := store(metrics, seq); err != nil {
+		return err
+	}
+	if wal == nil {
+		return nil
+	}
+	return wal.discard(size)
 }
 
 // GetMetric implements the [Repository] interface.
-func (ms *MemStorage) GetMetric(ctx context.Context, mName string) (metric.Metric, error) {
-	ms.mutex.RLock()
-	defer ms.mutex.RUnlock()
+func (ms *MemStorage) GetMetric(ctx context.Context, mType, mName string, labels metric.Labels) (metric.Metric, error) {
+	key := metric.Key{MType: mType, ID: mName, Labels: labels.String()}
+	s := ms.shard(key)
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
 
-	m, ok := ms.metrics[mName]
+	m, ok := s.metrics[key]
 	if !ok {
-		return metric.Metric{}, fmt.Errorf("metric %s is missing", mName)
+		return metric.Metric{}, fmt.Errorf("%s %s{%s} is missing", mType, mName, key.Labels)
 	}
 	return m, nil
 }
 
+// GetHistory implements the [Repository] interface.
+// Points older than HistoryRetention are skipped even if they have not been pruned yet.
+func (ms *MemStorage) GetHistory(ctx context.Context, mType, mName string, labels metric.Labels, from, to time.Time) ([]metric.Point, error) {
+	from = repository.RetainedFrom(from, time.Now())
+	key := metric.Key{MType: mType, ID: mName, Labels: labels.String()}
+	s := ms.shard(key)
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if _, ok := s.metrics[key]; !ok {
+		return nil, fmt.Errorf("%s %s{%s} is missing", mType, mName, key.Labels)
+	}
+	history, ok := s.history[key]
+	if !ok {
+		return make([]metric.Point, 0), nil
+	}
+	return history.between(from, to), nil
+}
+
+// PruneHistory implements the [repository.HistoryPruner] interface.
+// Shards are pruned one at a time, so writers of other shards do not wait.
+func (ms *MemStorage) PruneHistory(ctx context.Context) error {
+	before := time.Now().Add(-repository.HistoryRetention)
+	for i := range ms.shards {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		s := &ms.shards[i]
+		s.mutex.Lock()
+		s.prune(before)
+		s.mutex.Unlock()
+	}
+	return nil
+}
+
 // GetAllMetrics implements the [Repository] interface.
+// Shards are only locked while the metrics are copied, sorting happens afterwards.
 func (ms *MemStorage) GetAllMetrics(ctx context.Context) ([]metric.Metric, error) {
-	ms.mutex.RLock()
-	defer ms.mutex.RUnlock()
+	ms.rlockAll()
+	allMetrics := ms.allMetrics()
+	ms.runlockAll()
 
-	allMetrics := make([]metric.Metric, len(ms.metrics))
-	i := 0
-	for _, value := range ms.metrics {
-		allMetrics[i] = value
-		i++
-	}
-	slices.SortFunc(allMetrics, func(a, b metric.Metric) int {
-		return strings.Compare(a.ID, b.ID)
-	})
+	sortMetrics(allMetrics)
 	return allMetrics, nil
 }
 
+// sortMetrics sorts metrics by name, type and labels.
+func sortMetrics(metrics []metric.Metric) {
+	slices.SortFunc(metrics, func(a, b metric.Metric) int {
+		return cmp.Or(
+			strings.Compare(a.ID, b.ID),
+			strings.Compare(a.MType, b.MType),
+			strings.Compare(a.Labels.String(), b.Labels.String()),
+		)
+	})
+}
+
+// allMetrics returns all metrics unsorted.
+// The caller must hold the read locks of every shard.
+func (ms *MemStorage) allMetrics() []metric.Metric {
+	n := 0
+	for i := range ms.shards {
+		n += len(ms.shards[i].metrics)
+	}
+	allMetrics := make([]metric.Metric, 0, n)
+	for i := range ms.shards {
+		for _, value := range ms.shards[i].metrics {
+			allMetrics = append(allMetrics, value)
+		}
+	}
+	return allMetrics
+}
+
 // Close implements the [Repository] interface.
+// The log, if any, is synced and closed.
 func (ms *MemStorage) Close() error {
-	return nil
+	ms.applying.Lock()
+	defer ms.applying.Unlock()
+	ms.lock(allShards)
+	defer ms.unlock(allShards)
+
+	if ms.wal == nil {
+		return nil
+	}
+	return ms.wal.Close()
 }
@@ -2,11 +2,24 @@ package storage
 
 import (
 	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"maps"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 
 	"github.com/sudeeya/metrics-harvester/internal/metric"
+	"github.com/sudeeya/metrics-harvester/internal/repository"
 )
 
 func int64Ptr(i int64) *int64 {
@@ -17,80 +30,108 @@ func float64Ptr(f float64) *float64 {
 	return &f
 }
 
+// newTestStorage returns a storage with the metrics.
+func newTestStorage(metrics map[metric.Key]metric.Metric) *MemStorage {
+	ms := NewMemStorage()
+	for key, m := range metrics {
+		ms.shard(key).metrics[key] = m
+	}
+	return ms
+}
+
+// metricsOf returns the metrics of every shard of the storage.
+func metricsOf(ms *MemStorage) map[metric.Key]metric.Metric {
+	metrics := make(map[metric.Key]metric.Metric)
+	for i := range ms.shards {
+		maps.Copy(metrics, ms.shards[i].metrics)
+	}
+	return metrics
+}
+
 func TestPutMetric(t *testing.T) {
 	var (
-		ms1 = &MemStorage{metrics: map[string]metric.Metric{
-			"gauge": {ID: "gauge", MType: metric.Gauge, Value: float64Ptr(12)},
-		}}
-		ms2 = &MemStorage{metrics: map[string]metric.Metric{
-			"gauge": {ID: "gauge", MType: metric.Gauge, Value: float64Ptr(12.12)},
-		}}
-		ms3 = &MemStorage{metrics: map[string]metric.Metric{
-			"counter": {ID: "counter", MType: metric.Counter, Delta: int64Ptr(12)},
-		}}
-		ms4 = &MemStorage{metrics: map[string]metric.Metric{
-			"counter": {ID: "counter", MType: metric.Counter, Delta: int64Ptr(24)},
-		}}
+		ms1 = newTestStorage(map[metric.Key]metric.Metric{
+			{MType: metric.Gauge, ID: "gauge"}: {ID: "gauge", MType: metric.Gauge, Value: float64Ptr(12)},
+		})
+		ms2 = newTestStorage(map[metric.Key]metric.Metric{
+			{MType: metric.Gauge, ID: "gauge"}: {ID: "gauge", MType: metric.Gauge, Value: float64Ptr(12.12)},
+		})
+		ms3 = newTestStorage(map[metric.Key]metric.Metric{
+			{MType: metric.Counter, ID: "counter"}: {ID: "counter", MType: metric.Counter, Delta: int64Ptr(12)},
+		})
+		ms4 = newTestStorage(map[metric.Key]metric.Metric{
+			{MType: metric.Counter, ID: "counter"}: {ID: "counter", MType: metric.Counter, Delta: int64Ptr(24)},
+		})
+		ms5 = newTestStorage(map[metric.Key]metric.Metric{
+			{MType: metric.Gauge, ID: "counter"}:   {ID: "counter", MType: metric.Gauge, Value: float64Ptr(12.12)},
+			{MType: metric.Counter, ID: "counter"}: {ID: "counter", MType: metric.Counter, Delta: int64Ptr(12)},
+		})
 	)
 	tests := []struct {
 		name   string
 		ms     *MemStorage
-		mName  string
 		m      metric.Metric
 		result *MemStorage
 	}{
 		{
 			name:   "put gauge",
 			ms:     NewMemStorage(),
-			mName:  "gauge",
 			m:      metric.Metric{ID: "gauge", MType: metric.Gauge, Value: float64Ptr(12)},
 			result: ms1,
 		},
 		{
 			name:   "put the same gauge with a different value",
 			ms:     ms1,
-			mName:  "gauge",
 			m:      metric.Metric{ID: "gauge", MType: metric.Gauge, Value: float64Ptr(12.12)},
 			result: ms2,
 		},
 		{
 			name:   "put counter",
 			ms:     NewMemStorage(),
-			mName:  "counter",
 			m:      metric.Metric{ID: "counter", MType: metric.Counter, Delta: int64Ptr(12)},
 			result: ms3,
 		},
 		{
 			name:   "put the same counter",
 			ms:     ms3,
-			mName:  "counter",
 			m:      metric.Metric{ID: "counter", MType: metric.Counter, Delta: int64Ptr(12)},
 			result: ms4,
 		},
+		{
+			name: "put gauge named like a counter",
+			ms: newTestStorage(map[metric.Key]metric.Metric{
+				{MType: metric.Counter, ID: "counter"}: {ID: "counter", MType: metric.Counter, Delta: int64Ptr(12)},
+			}),
+			m:      metric.Metric{ID: "counter", MType: metric.Gauge, Value: float64Ptr(12.12)},
+			result: ms5,
+		},
 	}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			test.ms.PutMetric(context.Background(), test.m)
-			require.Equal(t, test.result.metrics[test.mName].GetValue(), test.ms.metrics[test.mName].GetValue())
+			require.NoError(t, test.ms.PutMetric(context.Background(), test.m))
+			require.Len(t, metricsOf(test.ms), len(metricsOf(test.result)))
+			for key := range metricsOf(test.result) {
+				require.Equal(t, metricsOf(test.result)[key].GetValue(), metricsOf(test.ms)[key].GetValue())
+			}
 		})
 	}
 }
 
 func TestPutButch(t *testing.T) {
 	var (
-		ms1 = &MemStorage{metrics: map[string]metric.Metric{
-			"gauge":   {ID: "gauge", MType: metric.Gauge, Value: float64Ptr(12.12)},
-			"counter": {ID: "counter", MType: metric.Counter, Delta: int64Ptr(12)},
-		}}
-		ms2 = &MemStorage{metrics: map[string]metric.Metric{
-			"gauge":   {ID: "gauge", MType: metric.Gauge, Value: float64Ptr(12.12)},
-			"counter": {ID: "counter", MType: metric.Counter, Delta: int64Ptr(12)},
-		}}
-		ms3 = &MemStorage{metrics: map[string]metric.Metric{
-			"gauge":   {ID: "gauge", MType: metric.Gauge, Value: float64Ptr(42)},
-			"counter": {ID: "counter", MType: metric.Counter, Delta: int64Ptr(12)},
-			"dummy":   {ID: "dummy", MType: metric.Counter, Delta: int64Ptr(-1)},
-		}}
+		ms1 = newTestStorage(map[metric.Key]metric.Metric{
+			{MType: metric.Gauge, ID: "gauge"}:     {ID: "gauge", MType: metric.Gauge, Value: float64Ptr(12.12)},
+			{MType: metric.Counter, ID: "counter"}: {ID: "counter", MType: metric.Counter, Delta: int64Ptr(12)},
+		})
+		ms2 = newTestStorage(map[metric.Key]metric.Metric{
+			{MType: metric.Gauge, ID: "gauge"}:     {ID: "gauge", MType: metric.Gauge, Value: float64Ptr(12.12)},
+			{MType: metric.Counter, ID: "counter"}: {ID: "counter", MType: metric.Counter, Delta: int64Ptr(12)},
+		})
+		ms3 = newTestStorage(map[metric.Key]metric.Metric{
+			{MType: metric.Gauge, ID: "gauge"}:     {ID: "gauge", MType: metric.Gauge, Value: float64Ptr(42)},
+			{MType: metric.Counter, ID: "counter"}: {ID: "counter", MType: metric.Counter, Delta: int64Ptr(12)},
+			{MType: metric.Counter, ID: "dummy"}:   {ID: "dummy", MType: metric.Counter, Delta: int64Ptr(-1)},
+		})
 	)
 	tests := []struct {
 		name    string
@@ -120,13 +161,25 @@ func TestPutButch(t *testing.T) {
 				{ID: "dummy", MType: metric.Counter, Delta: int64Ptr(-1)}},
 			result: ms3,
 		},
+		{
+			name: "put batch with a broken metric",
+			ms: newTestStorage(map[metric.Key]metric.Metric{
+				{MType: metric.Counter, ID: "counter"}: {ID: "counter", MType: metric.Counter, Delta: int64Ptr(12)},
+			}),
+			metrics: []metric.Metric{
+				{ID: "counter", MType: metric.Counter, Delta: int64Ptr(12)},
+				{ID: "gauge", MType: metric.Gauge}},
+			result: newTestStorage(map[metric.Key]metric.Metric{
+				{MType: metric.Counter, ID: "counter"}: {ID: "counter", MType: metric.Counter, Delta: int64Ptr(12)},
+			}),
+		},
 	}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			test.ms.PutBatch(context.Background(), test.metrics)
-			require.Equal(t, len(test.result.metrics), len(test.ms.metrics))
-			for mName := range test.result.metrics {
-				require.Equal(t, test.result.metrics[mName].GetValue(), test.ms.metrics[mName].GetValue())
+			_ = test.ms.PutBatch(context.Background(), test.metrics)
+			require.Equal(t, len(metricsOf(test.result)), len(metricsOf(test.ms)))
+			for key := range metricsOf(test.result) {
+				require.Equal(t, metricsOf(test.result)[key].GetValue(), metricsOf(test.ms)[key].GetValue())
 			}
 		})
 	}
@@ -134,13 +187,13 @@ func TestPutButch(t *testing.T) {
 
 func TestGetMetric_Existing(t *testing.T) {
 	var (
-		ms1 = &MemStorage{metrics: map[string]metric.Metric{
-			"gauge": {ID: "gauge", MType: metric.Gauge, Value: float64Ptr(12)},
-		}}
-		ms2 = &MemStorage{metrics: map[string]metric.Metric{
-			"counter": {ID: "counter", MType: metric.Counter, Delta: int64Ptr(12)},
-			"dummy":   {ID: "dummy", MType: metric.Gauge, Value: float64Ptr(-1)},
-		}}
+		ms1 = newTestStorage(map[metric.Key]metric.Metric{
+			{MType: metric.Gauge, ID: "gauge"}: {ID: "gauge", MType: metric.Gauge, Value: float64Ptr(12)},
+		})
+		ms2 = newTestStorage(map[metric.Key]metric.Metric{
+			{MType: metric.Counter, ID: "counter"}: {ID: "counter", MType: metric.Counter, Delta: int64Ptr(12)},
+			{MType: metric.Gauge, ID: "dummy"}:     {ID: "dummy", MType: metric.Gauge, Value: float64Ptr(-1)},
+		})
 	)
 	tests := []struct {
 		name   string
@@ -163,7 +216,7 @@ func TestGetMetric_Existing(t *testing.T) {
 	}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			m, err := test.ms.GetMetric(context.Background(), test.mName)
+			m, err := test.ms.GetMetric(context.Background(), test.result.MType, test.mName, nil)
 			require.Nil(t, err)
 			require.Equal(t, test.result.GetValue(), m.GetValue())
 		})
@@ -172,24 +225,32 @@ func TestGetMetric_Existing(t *testing.T) {
 
 func TestGetMetric_NotExisting(t *testing.T) {
 	var (
-		ms1 = &MemStorage{metrics: map[string]metric.Metric{
-			"counter": {ID: "counter", MType: metric.Counter, Delta: int64Ptr(12)},
-		}}
+		ms1 = newTestStorage(map[metric.Key]metric.Metric{
+			{MType: metric.Counter, ID: "counter"}: {ID: "counter", MType: metric.Counter, Delta: int64Ptr(12)},
+		})
 	)
 	tests := []struct {
 		name  string
 		ms    *MemStorage
+		mType string
 		mName string
 	}{
 		{
 			name:  "try to get gauge",
 			ms:    ms1,
+			mType: metric.Gauge,
 			mName: "gauge",
 		},
+		{
+			name:  "try to get counter as gauge",
+			ms:    ms1,
+			mType: metric.Gauge,
+			mName: "counter",
+		},
 	}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			_, err := test.ms.GetMetric(context.Background(), test.mName)
+			_, err := test.ms.GetMetric(context.Background(), test.mType, test.mName, nil)
 			require.NotNil(t, err)
 		})
 	}
@@ -197,11 +258,11 @@ func TestGetMetric_NotExisting(t *testing.T) {
 
 func TestGetAllMetrics(t *testing.T) {
 	var (
-		ms1 = &MemStorage{metrics: map[string]metric.Metric{
-			"gauge":   {ID: "gauge", MType: metric.Gauge, Value: float64Ptr(42)},
-			"counter": {ID: "counter", MType: metric.Counter, Delta: int64Ptr(12)},
-			"dummy":   {ID: "dummy", MType: metric.Counter, Delta: int64Ptr(-1)},
-		}}
+		ms1 = newTestStorage(map[metric.Key]metric.Metric{
+			{MType: metric.Gauge, ID: "gauge"}:     {ID: "gauge", MType: metric.Gauge, Value: float64Ptr(42)},
+			{MType: metric.Counter, ID: "counter"}: {ID: "counter", MType: metric.Counter, Delta: int64Ptr(12)},
+			{MType: metric.Counter, ID: "dummy"}:   {ID: "dummy", MType: metric.Counter, Delta: int64Ptr(-1)},
+		})
 	)
 	tests := []struct {
 		name   string
@@ -237,11 +298,11 @@ func TestGetAllMetrics(t *testing.T) {
 
 func TestClose(t *testing.T) {
 	var (
-		ms1 = &MemStorage{metrics: map[string]metric.Metric{
-			"gauge":   {ID: "gauge", MType: metric.Gauge, Value: float64Ptr(42)},
-			"counter": {ID: "counter", MType: metric.Counter, Delta: int64Ptr(12)},
-			"dummy":   {ID: "dummy", MType: metric.Counter, Delta: int64Ptr(-1)},
-		}}
+		ms1 = newTestStorage(map[metric.Key]metric.Metric{
+			{MType: metric.Gauge, ID: "gauge"}:     {ID: "gauge", MType: metric.Gauge, Value: float64Ptr(42)},
+			{MType: metric.Counter, ID: "counter"}: {ID: "counter", MType: metric.Counter, Delta: int64Ptr(12)},
+			{MType: metric.Counter, ID: "dummy"}:   {ID: "dummy", MType: metric.Counter, Delta: int64Ptr(-1)},
+		})
 	)
 	tests := []struct {
 		name string
@@ -262,3 +323,663 @@ func TestClose(t *testing.T) {
 		})
 	}
 }
+
+func TestLabels(t *testing.T) {
+	ctx := context.Background()
+	ms := NewMemStorage()
+	web1 := metric.Labels{"host": "web1"}
+	require.NoError(t, ms.PutBatch(ctx, []metric.Metric{
+		{ID: "requests", MType: metric.Counter, Delta: int64Ptr(1)},
+		{ID: "requests", MType: metric.Counter, Delta: int64Ptr(2), Labels: web1},
+		{ID: "requests", MType: metric.Counter, Delta: int64Ptr(4), Labels: metric.Labels{"host": "web2"}},
+		{ID: "requests", MType: metric.Counter, Delta: int64Ptr(8), Labels: metric.Labels{"host": "web1"}},
+	}))
+
+	m, err := ms.GetMetric(ctx, metric.Counter, "requests", nil)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), *m.Delta)
+	m, err = ms.GetMetric(ctx, metric.Counter, "requests", web1)
+	require.NoError(t, err)
+	require.Equal(t, int64(10), *m.Delta)
+	require.Equal(t, web1, m.Labels)
+	_, err = ms.GetMetric(ctx, metric.Counter, "requests", metric.Labels{"host": "web3"})
+	require.Error(t, err)
+
+	points, err := ms.GetHistory(ctx, metric.Counter, "requests", web1, time.Time{}, time.Now())
+	require.NoError(t, err)
+	require.Len(t, points, 2)
+
+	all, err := ms.GetAllMetrics(ctx)
+	require.NoError(t, err)
+	require.Len(t, all, 3)
+	require.Nil(t, all[0].Labels)
+	require.Equal(t, web1, all[1].Labels)
+}
+
+func TestHistogram(t *testing.T) {
+	ctx := context.Background()
+	ms := NewMemStorage()
+	observe := func(values ...float64) metric.Metric {
+		h := metric.NewHistogramValue([]float64{0.1, 0.5})
+		for _, v := range values {
+			h.Observe(v)
+		}
+		return metric.Metric{ID: "latency", MType: metric.Histogram, Histogram: h}
+	}
+	require.NoError(t, ms.PutMetric(ctx, observe(0.05, 0.3)))
+	require.NoError(t, ms.PutBatch(ctx, []metric.Metric{observe(0.7), observe(0.1)}))
+
+	m, err := ms.GetMetric(ctx, metric.Histogram, "latency", nil)
+	require.NoError(t, err)
+	require.Equal(t, []int64{2, 1, 1}, m.Histogram.Counts)
+	require.Equal(t, int64(4), m.Histogram.Count)
+	require.InDelta(t, 1.15, m.Histogram.Sum, 1e-9)
+
+	other := metric.Metric{ID: "latency", MType: metric.Histogram, Histogram: metric.NewHistogramValue([]float64{1})}
+	require.ErrorIs(t, ms.PutBatch(ctx, []metric.Metric{observe(0.2), other}), metric.ErrBucketsConflict)
+	m, err = ms.GetMetric(ctx, metric.Histogram, "latency", nil)
+	require.NoError(t, err)
+	require.Equal(t, int64(4), m.Histogram.Count, "rejected batch must not be applied")
+}
+
+func TestPutBatchOnce(t *testing.T) {
+	ms := NewMemStorage()
+	metrics := []metric.Metric{
+		{ID: "counter", MType: metric.Counter, Delta: int64Ptr(12)},
+	}
+	require.NoError(t, ms.PutBatchOnce(context.Background(), "first", metrics))
+	require.ErrorIs(t, ms.PutBatchOnce(context.Background(), "first", metrics), repository.ErrDuplicateBatch)
+	require.NoError(t, ms.PutBatchOnce(context.Background(), "second", metrics))
+	// A key reused for other metrics is rejected rather than answered with the original result.
+	other := []metric.Metric{
+		{ID: "counter", MType: metric.Counter, Delta: int64Ptr(1)},
+	}
+	require.ErrorIs(t, ms.PutBatchOnce(context.Background(), "first", other), repository.ErrBatchKeyReused)
+	_, err := ms.PutPartialOnce(context.Background(), "first", other)
+	require.ErrorIs(t, err, repository.ErrBatchKeyReused)
+
+	m, err := ms.GetMetric(context.Background(), metric.Counter, "counter", nil)
+	require.NoError(t, err)
+	require.Equal(t, int64(24), *m.Delta)
+}
+
+func TestPutPartialOnce(t *testing.T) {
+	ctx := context.Background()
+	wal, err := OpenWAL(filepath.Join(t.TempDir(), "metrics.wal"), SyncNever, 0)
+	require.NoError(t, err)
+	ms := NewMemStorage()
+	require.NoError(t, ms.Recover(wal, 0))
+
+	histogram := func(bound float64) metric.Metric {
+		return metric.Metric{ID: "latency", MType: metric.Histogram, Histogram: metric.NewHistogramValue([]float64{bound})}
+	}
+	require.NoError(t, ms.PutMetric(ctx, histogram(1)))
+	metrics := []metric.Metric{
+		{ID: "counter", MType: metric.Counter, Delta: int64Ptr(12)},
+		histogram(2),
+		histogram(1),
+	}
+	rejections, err := ms.PutPartialOnce(ctx, "key", metrics)
+	require.NoError(t, err)
+	require.Len(t, rejections, 1)
+	require.Equal(t, 1, rejections[0].Index)
+	require.Contains(t, rejections[0].Reason, metric.ErrBucketsConflict.Error())
+
+	replayed, err := ms.PutPartialOnce(ctx, "key", metrics)
+	require.ErrorIs(t, err, repository.ErrDuplicateBatch)
+	require.Equal(t, rejections, replayed)
+	m, err := ms.GetMetric(ctx, metric.Counter, "counter", nil)
+	require.NoError(t, err)
+	require.Equal(t, int64(12), *m.Delta)
+
+	// The rejections survive a restart.
+	require.NoError(t, ms.Close())
+	wal, err = OpenWAL(wal.path, SyncNever, 0)
+	require.NoError(t, err)
+	recovered := NewMemStorage()
+	require.NoError(t, recovered.Recover(wal, 0))
+	defer recovered.Close()
+	replayed, err = recovered.PutPartialOnce(ctx, "key", metrics)
+	require.ErrorIs(t, err, repository.ErrDuplicateBatch)
+	require.Equal(t, rejections, replayed)
+	m, err = recovered.GetMetric(ctx, metric.Counter, "counter", nil)
+	require.NoError(t, err)
+	require.Equal(t, int64(12), *m.Delta)
+}
+
+func TestPutBatchOnce_Concurrent(t *testing.T) {
+	const senders = 20
+	ms := NewMemStorage()
+	metrics := []metric.Metric{
+		{ID: "counter", MType: metric.Counter, Delta: int64Ptr(1)},
+		{ID: "gauge", MType: metric.Gauge, Value: float64Ptr(1)},
+	}
+
+	var (
+		wg      sync.WaitGroup
+		applied atomic.Int64
+	)
+	for range senders {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := ms.PutBatchOnce(context.Background(), "key", metrics)
+			if err == nil {
+				applied.Add(1)
+				return
+			}
+			require.ErrorIs(t, err, repository.ErrDuplicateBatch)
+		}()
+	}
+	wg.Wait()
+
+	require.Equal(t, int64(1), applied.Load())
+	m, err := ms.GetMetric(context.Background(), metric.Counter, "counter", nil)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), *m.Delta)
+}
+
+func TestPutBatch_ConcurrentHistograms(t *testing.T) {
+	const senders = 20
+	ms := NewMemStorage()
+
+	var (
+		wg      sync.WaitGroup
+		applied atomic.Int64
+	)
+	for i := range senders {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Every sender creates the histogram with other buckets.
+			err := ms.PutBatch(context.Background(), []metric.Metric{
+				{ID: fmt.Sprintf("counter%d", i), MType: metric.Counter, Delta: int64Ptr(1)},
+				{ID: "latency", MType: metric.Histogram, Histogram: metric.NewHistogramValue([]float64{float64(i)})},
+			})
+			if err == nil {
+				applied.Add(1)
+				return
+			}
+			require.ErrorIs(t, err, metric.ErrBucketsConflict)
+		}()
+	}
+	wg.Wait()
+
+	require.Equal(t, int64(1), applied.Load())
+	// The counters of the failed batches are not applied.
+	metrics, err := ms.GetAllMetrics(context.Background())
+	require.NoError(t, err)
+	require.Len(t, metrics, 2)
+}
+
+func TestKeyWindow(t *testing.T) {
+	kw := newKeyWindow(2)
+	second := appliedBatch{hash: "hash", rejections: []repository.Rejection{{Index: 1, Reason: "conflict"}}}
+	kw.add("first", appliedBatch{})
+	kw.add("second", second)
+	_, ok := kw.get("first")
+	require.True(t, ok)
+	kw.add("third", appliedBatch{})
+	_, ok = kw.get("first")
+	require.False(t, ok)
+	got, ok := kw.get("second")
+	require.True(t, ok)
+	require.Equal(t, second, got)
+	_, ok = kw.get("third")
+	require.True(t, ok)
+}
+
+func TestGetHistory(t *testing.T) {
+	ms := NewMemStorage()
+	from := time.Now()
+	for range 3 {
+		require.NoError(t, ms.PutMetric(context.Background(), metric.Metric{ID: "counter", MType: metric.Counter, Delta: int64Ptr(12)}))
+	}
+	require.NoError(t, ms.PutBatch(context.Background(), []metric.Metric{
+		{ID: "counter", MType: metric.Counter, Delta: int64Ptr(12)},
+		{ID: "gauge", MType: metric.Gauge, Value: float64Ptr(12.12)},
+	}))
+
+	points, err := ms.GetHistory(context.Background(), metric.Counter, "counter", nil, from, time.Now())
+	require.NoError(t, err)
+	totals := make([]int64, len(points))
+	for i, p := range points {
+		totals[i] = *p.Delta
+	}
+	require.Equal(t, []int64{12, 24, 36, 48}, totals)
+
+	points, err = ms.GetHistory(context.Background(), metric.Counter, "counter", nil, from.Add(-time.Hour), from)
+	require.NoError(t, err)
+	require.Empty(t, points)
+
+	_, err = ms.GetHistory(context.Background(), metric.Gauge, "counter", nil, from, time.Now())
+	require.Error(t, err)
+}
+
+func TestShardOf_Labels(t *testing.T) {
+	shards := make(map[int]bool)
+	for i := range 100 {
+		m := metric.Metric{ID: "requests", MType: metric.Counter, Labels: metric.Labels{"host": fmt.Sprintf("host%d", i)}}
+		shards[shardOf(m.Key())] = true
+	}
+	// The series of one metric are spread over the shards instead of sharing one.
+	require.Greater(t, len(shards), ShardCount/2)
+}
+
+func TestPointLog(t *testing.T) {
+	start := time.Date(2024, time.October, 1, 12, 0, 0, 0, time.UTC)
+	pl := &pointLog{}
+	for i := range 5 {
+		pl.add(metric.Point{Time: start.Add(time.Duration(i) * time.Second), Value: float64Ptr(float64(i))})
+	}
+	pl.prune(start.Add(2 * time.Second))
+	points := pl.between(start, start.Add(time.Hour))
+	values := make([]float64, len(points))
+	for i, p := range points {
+		values[i] = *p.Value
+	}
+	require.Equal(t, []float64{2, 3, 4}, values)
+	require.Len(t, pl.between(start.Add(3*time.Second), start.Add(3*time.Second)), 1)
+}
+
+func TestPointLog_Size(t *testing.T) {
+	start := time.Date(2024, time.October, 1, 12, 0, 0, 0, time.UTC)
+	pl := &pointLog{}
+	for i := range HistorySize + 10 {
+		pl.add(metric.Point{Time: start.Add(time.Duration(i) * time.Millisecond), Value: float64Ptr(float64(i))})
+	}
+	points := pl.between(start, start.Add(time.Hour))
+	require.Len(t, points, HistorySize)
+	// The oldest points are dropped.
+	require.Equal(t, float64(10), *points[0].Value)
+	require.Equal(t, float64(HistorySize+9), *points[len(points)-1].Value)
+}
+
+func TestPruneHistory(t *testing.T) {
+	ms := NewMemStorage()
+	now := time.Now()
+	old := metric.Metric{ID: "old", MType: metric.Gauge, Value: float64Ptr(1)}
+	fresh := metric.Metric{ID: "fresh", MType: metric.Gauge, Value: float64Ptr(2)}
+	ms.shard(old.Key()).merge(old, 0, now.Add(-2*repository.HistoryRetention))
+	ms.shard(fresh.Key()).merge(fresh, 0, now.Add(-2*repository.HistoryRetention))
+	ms.shard(fresh.Key()).merge(fresh, 0, now)
+
+	// Points older than the retention are not returned before they are pruned.
+	points, err := ms.GetHistory(context.Background(), metric.Gauge, "fresh", nil, time.Time{}, now)
+	require.NoError(t, err)
+	require.Len(t, points, 1)
+
+	require.NoError(t, ms.PruneHistory(context.Background()))
+	require.NotContains(t, ms.shard(old.Key()).history, old.Key())
+	require.Len(t, ms.shard(fresh.Key()).history[fresh.Key()].points, 1)
+}
+
+// openWAL returns a storage which logs its updates to the path,
+// after replaying the records following the sequence number.
+func openWAL(t *testing.T, path string, after uint64) *MemStorage {
+	wal, err := OpenWAL(path, SyncAlways, 0)
+	require.NoError(t, err)
+	ms := NewMemStorage()
+	require.NoError(t, ms.Recover(wal, after))
+	return ms
+}
+
+func TestWAL_Recover(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "metrics.wal")
+
+	ms := openWAL(t, path, 0)
+	require.NoError(t, ms.PutMetric(ctx, metric.Metric{ID: "counter", MType: metric.Counter, Delta: int64Ptr(1)}))
+	batch := []metric.Metric{
+		{ID: "counter", MType: metric.Counter, Delta: int64Ptr(2)},
+		{ID: "gauge", MType: metric.Gauge, Value: float64Ptr(1.5)},
+	}
+	require.NoError(t, ms.PutBatchOnce(ctx, "key", batch))
+	// A rejected update is not logged.
+	require.Error(t, ms.PutMetric(ctx, metric.Metric{ID: "gauge", MType: metric.Gauge}))
+	require.NoError(t, ms.Close())
+
+	// A crash while appending leaves a torn record at the end of the log.
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0666)
+	require.NoError(t, err)
+	_, err = file.Write([]byte{0, 0, 1, 0, 42})
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	ms = openWAL(t, path, 0)
+	require.ErrorIs(t, ms.PutBatchOnce(ctx, "key", batch), repository.ErrDuplicateBatch)
+	require.ErrorIs(t, ms.PutBatchOnce(ctx, "key", nil), repository.ErrBatchKeyReused)
+	require.NoError(t, ms.PutMetric(ctx, metric.Metric{ID: "counter", MType: metric.Counter, Delta: int64Ptr(4)}))
+	require.NoError(t, ms.Close())
+
+	ms = openWAL(t, path, 0)
+	m, err := ms.GetMetric(ctx, metric.Counter, "counter", nil)
+	require.NoError(t, err)
+	require.Equal(t, int64(7), *m.Delta)
+	m, err = ms.GetMetric(ctx, metric.Gauge, "gauge", nil)
+	require.NoError(t, err)
+	require.Equal(t, 1.5, *m.Value)
+	require.NoError(t, ms.Close())
+}
+
+// frameRecord returns the payload framed like a record of the log.
+func frameRecord(payload []byte) []byte {
+	data := make([]byte, recordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(data[:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(data[4:recordHeaderSize], crc32.Checksum(payload, crcTable))
+	copy(data[recordHeaderSize:], payload)
+	return data
+}
+
+func TestWAL_Damaged(t *testing.T) {
+	record := func(seq uint64) []byte {
+		payload, err := json.Marshal(walRecord{Seq: seq, Metrics: []metric.Metric{
+			{ID: "counter", MType: metric.Counter, Delta: int64Ptr(1)},
+		}})
+		require.NoError(t, err)
+		return frameRecord(payload)
+	}
+	damaged := func(data []byte) []byte {
+		data = slices.Clone(data)
+		data[len(data)-1] ^= 0xff
+		return data
+	}
+	var oversized [recordHeaderSize]byte
+	binary.BigEndian.PutUint32(oversized[:4], maxRecordSize+1)
+
+	tests := []struct {
+		name string
+		log  [][]byte
+		// replayed is the number of records replayed if the log is truncated after them.
+		// If it is negative, Replay must fail and leave the log unchanged.
+		replayed int
+	}{
+		{name: "torn header", log: [][]byte{record(1), {0, 0, 1}}, replayed: 1},
+		{name: "torn record", log: [][]byte{record(1), record(2)[:20]}, replayed: 1},
+		{name: "checksum mismatch at the end", log: [][]byte{record(1), damaged(record(2))}, replayed: 1},
+		{name: "checksum mismatch in the middle", log: [][]byte{record(1), damaged(record(2)), record(3)}, replayed: -1},
+		{name: "oversized record", log: [][]byte{record(1), oversized[:], record(2)}, replayed: -1},
+		{name: "oversized record at the end", log: [][]byte{record(1), oversized[:]}, replayed: -1},
+		{name: "malformed record", log: [][]byte{record(1), frameRecord([]byte("{")), record(2)}, replayed: -1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "metrics.wal")
+			data := slices.Concat(test.log...)
+			require.NoError(t, os.WriteFile(path, data, 0666))
+			wal, err := OpenWAL(path, SyncNever, 0)
+			require.NoError(t, err)
+			defer wal.Close()
+
+			replayed := 0
+			err = wal.Replay(0, func(string, string, []metric.Metric, []repository.Rejection) error {
+				replayed++
+				return nil
+			})
+			stored, readErr := os.ReadFile(path)
+			require.NoError(t, readErr)
+			if test.replayed < 0 {
+				require.Error(t, err)
+				require.Equal(t, data, stored, "the log must be left unchanged")
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, test.replayed, replayed)
+			require.Equal(t, slices.Concat(test.log[:test.replayed]...), stored)
+		})
+	}
+}
+
+func TestWAL_Checkpoint(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "metrics.wal")
+
+	ms := openWAL(t, path, 0)
+	for range 3 {
+		require.NoError(t, ms.PutMetric(ctx, metric.Metric{ID: "counter", MType: metric.Counter, Delta: int64Ptr(1)}))
+	}
+	var (
+		snapshot []metric.Metric
+		covered  uint64
+	)
+	require.NoError(t, ms.Checkpoint(func(metrics []metric.Metric, seq uint64) error {
+		// Updates during the checkpoint are logged after the covered records.
+		require.NoError(t, ms.PutMetric(ctx, metric.Metric{ID: "counter", MType: metric.Counter, Delta: int64Ptr(10)}))
+		snapshot, covered = metrics, seq
+		return nil
+	}))
+	require.Equal(t, uint64(3), covered)
+	require.Equal(t, int64(3), *snapshot[0].Delta)
+	require.NoError(t, ms.PutMetric(ctx, metric.Metric{ID: "counter", MType: metric.Counter, Delta: int64Ptr(100)}))
+	require.NoError(t, ms.Close())
+
+	ms = NewMemStorage()
+	require.NoError(t, ms.PutBatch(ctx, snapshot))
+	wal, err := OpenWAL(path, SyncNever, 0)
+	require.NoError(t, err)
+	require.NoError(t, ms.Recover(wal, covered))
+	m, err := ms.GetMetric(ctx, metric.Counter, "counter", nil)
+	require.NoError(t, err)
+	require.Equal(t, int64(113), *m.Delta)
+
+	// The numbering continues after the replayed records.
+	seq, _ := wal.position()
+	require.Equal(t, uint64(5), seq)
+	require.NoError(t, ms.Close())
+}
+
+func TestWAL_Gap(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "metrics.wal")
+
+	ms := openWAL(t, path, 0)
+	for range 2 {
+		require.NoError(t, ms.PutMetric(ctx, metric.Metric{ID: "counter", MType: metric.Counter, Delta: int64Ptr(1)}))
+	}
+	require.NoError(t, ms.Checkpoint(func(metrics []metric.Metric, seq uint64) error {
+		return nil
+	}))
+	require.NoError(t, ms.PutMetric(ctx, metric.Metric{ID: "counter", MType: metric.Counter, Delta: int64Ptr(10)}))
+	require.NoError(t, ms.Close())
+
+	// The snapshot covering the first records is lost, so an older one is restored.
+	ms = NewMemStorage()
+	wal, err := OpenWAL(path, SyncNever, 0)
+	require.NoError(t, err)
+	require.ErrorIs(t, ms.Recover(wal, 0), ErrWALGap)
+	m, err := ms.GetMetric(ctx, metric.Counter, "counter", nil)
+	require.NoError(t, err)
+	require.Equal(t, int64(10), *m.Delta)
+
+	// The log is still used.
+	require.NoError(t, ms.PutMetric(ctx, metric.Metric{ID: "counter", MType: metric.Counter, Delta: int64Ptr(100)}))
+	seq, _ := wal.position()
+	require.Equal(t, uint64(4), seq)
+	require.NoError(t, ms.Close())
+}
+
+func TestWAL_ConcurrentGauges(t *testing.T) {
+	const senders = 20
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "metrics.wal")
+
+	ms := openWAL(t, path, 0)
+	var wg sync.WaitGroup
+	for i := range senders {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range 50 {
+				value := float64Ptr(float64(i*100 + j))
+				if j%2 == 0 {
+					require.NoError(t, ms.PutMetric(ctx, metric.Metric{ID: "gauge0", MType: metric.Gauge, Value: value}))
+					continue
+				}
+				batch := make([]metric.Metric, 0, ShardCount)
+				for k := range ShardCount {
+					batch = append(batch, metric.Metric{ID: fmt.Sprintf("gauge%d", k), MType: metric.Gauge, Value: value})
+				}
+				require.NoError(t, ms.PutBatch(ctx, batch))
+			}
+		}()
+	}
+	wg.Wait()
+	expected, err := ms.GetAllMetrics(ctx)
+	require.NoError(t, err)
+	require.NoError(t, ms.Close())
+
+	// The gauges keep the values of their last records.
+	ms = openWAL(t, path, 0)
+	recovered, err := ms.GetAllMetrics(ctx)
+	require.NoError(t, err)
+	require.Equal(t, expected, recovered)
+	require.NoError(t, ms.Close())
+}
+
+// lockedStorage is the previous design of MemStorage,
+// which guards a single map with one lock.
+// It is kept to compare the throughput of parallel writers.
+type lockedStorage struct {
+	mutex   sync.RWMutex
+	metrics map[metric.Key]metric.Metric
+	history map[metric.Key]*pointLog
+}
+
+func (ls *lockedStorage) PutBatch(ctx context.Context, metrics []metric.Metric) error {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+
+	staged := make(map[metric.Key]metric.Metric, len(metrics))
+	updates := make([]metric.Metric, 0, len(metrics))
+	for _, m := range metrics {
+		value, ok := staged[m.Key()]
+		if !ok {
+			value, ok = ls.metrics[m.Key()]
+		}
+		if !ok {
+			value = metric.Metric{ID: m.ID, MType: m.MType}
+		}
+		if err := value.Merge(m); err != nil {
+			return err
+		}
+		staged[m.Key()] = value
+		updates = append(updates, value)
+	}
+	maps.Copy(ls.metrics, staged)
+	now := time.Now()
+	for _, value := range updates {
+		history, ok := ls.history[value.Key()]
+		if !ok {
+			history = &pointLog{}
+			ls.history[value.Key()] = history
+		}
+		history.add(value.Point(now))
+	}
+	return nil
+}
+
+func (ls *lockedStorage) GetAllMetrics(ctx context.Context) ([]metric.Metric, error) {
+	ls.mutex.RLock()
+	defer ls.mutex.RUnlock()
+
+	allMetrics := make([]metric.Metric, 0, len(ls.metrics))
+	for _, value := range ls.metrics {
+		allMetrics = append(allMetrics, value)
+	}
+	sortMetrics(allMetrics)
+	return allMetrics, nil
+}
+
+// benchStorage is the part of Repository the benchmarks use.
+type benchStorage interface {
+	PutBatch(ctx context.Context, metrics []metric.Metric) error
+	GetAllMetrics(ctx context.Context) ([]metric.Metric, error)
+}
+
+var benchStorages = []struct {
+	name string
+	new  func() benchStorage
+}{
+	{name: "locked", new: func() benchStorage {
+		return &lockedStorage{
+			metrics: make(map[metric.Key]metric.Metric),
+			history: make(map[metric.Key]*pointLog),
+		}
+	}},
+	{name: "sharded", new: func() benchStorage { return NewMemStorage() }},
+}
+
+// hostBatch returns a batch of perHost metrics reported by the host.
+// If shared is true, every host reports the same metrics.
+func hostBatch(host, perHost int, shared bool) []metric.Metric {
+	metrics := make([]metric.Metric, perHost)
+	for i := range metrics {
+		id := fmt.Sprintf("host%d.metric%d", host, i)
+		if shared {
+			id = fmt.Sprintf("metric%d", i)
+		}
+		metrics[i] = metric.Metric{ID: id, MType: metric.Counter, Delta: int64Ptr(1)}
+	}
+	return metrics
+}
+
+// BenchmarkPutBatch_Parallel measures the throughput of agents sending batches at once.
+func BenchmarkPutBatch_Parallel(b *testing.B) {
+	for _, storage := range benchStorages {
+		for _, perHost := range []int{1, 30} {
+			for _, shared := range []bool{false, true} {
+				name := fmt.Sprintf("%s/%d/distinct", storage.name, perHost)
+				if shared {
+					name = fmt.Sprintf("%s/%d/shared", storage.name, perHost)
+				}
+				b.Run(name, func(b *testing.B) {
+					s := storage.new()
+					var hosts atomic.Int64
+					b.RunParallel(func(pb *testing.PB) {
+						batch := hostBatch(int(hosts.Add(1)), perHost, shared)
+						for pb.Next() {
+							if err := s.PutBatch(context.Background(), batch); err != nil {
+								b.Error(err)
+							}
+						}
+					})
+				})
+			}
+		}
+	}
+}
+
+// BenchmarkGetAllMetrics_Writers measures readers of all metrics while agents send batches.
+func BenchmarkGetAllMetrics_Writers(b *testing.B) {
+	for _, storage := range benchStorages {
+		b.Run(storage.name, func(b *testing.B) {
+			s := storage.new()
+			for host := range 100 {
+				require.NoError(b, s.PutBatch(context.Background(), hostBatch(host, 30, false)))
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			var wg sync.WaitGroup
+			for host := range runtime.GOMAXPROCS(0) {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					batch := hostBatch(host, 30, false)
+					for ctx.Err() == nil {
+						if err := s.PutBatch(ctx, batch); err != nil {
+							b.Error(err)
+						}
+					}
+				}()
+			}
+			b.ResetTimer()
+			for range b.N {
+				if _, err := s.GetAllMetrics(context.Background()); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+			cancel()
+			wg.Wait()
+		})
+	}
+}
@@ -0,0 +1,337 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/sudeeya/metrics-harvester/internal/metric"
+	"github.com/sudeeya/metrics-harvester/internal/repository"
+)
+
+// Fsync policies of WAL.
+const (
+	// SyncAlways syncs the log before every update is applied.
+	SyncAlways = "always"
+	// SyncInterval syncs the log periodically, so a crash of the machine
+	// loses at most the updates of the last interval.
+	SyncInterval = "interval"
+	// SyncNever leaves syncing to the operating system.
+	// Updates survive a crash of the server, but not of the machine.
+	SyncNever = "never"
+)
+
+// ErrWALGap is returned when the log lacks records following the snapshot,
+// since they were dropped as covered by a newer snapshot which is lost.
+var ErrWALGap = errors.New("WAL gap")
+
+// recordHeaderSize is the size of the length and the checksum preceding every record.
+const recordHeaderSize = 8
+
+// maxRecordSize is the maximum size of a record without its header,
+// so a damaged length does not make replay allocate gigabytes.
+const maxRecordSize = 64 << 20
+
+// errTornRecord is returned by readRecord for a record at the end of the log
+// which was being written when the server stopped.
+var errTornRecord = errors.New("torn record")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// walRecord is an update accepted by MemStorage.
+type walRecord struct {
+	// Seq increases by one with every record and is never reused,
+	// even after the log is truncated.
+	Seq uint64 `json:"seq"`
+
+	// Key is the idempotency key of the batch, if any.
+	Key string `json:"key,omitempty"`
+
+	// Hash is the hash of the metrics of the batch with the key.
+	Hash string `json:"hash,omitempty"`
+
+	// Metrics are the updates, as they were accepted.
+	Metrics []metric.Metric `json:"metrics"`
+
+	// Rejections are the metrics of a partial batch rejected by MemStorage.
+	Rejections []repository.Rejection `json:"rejections,omitempty"`
+}
+
+// WAL is an append-only write-ahead log of the updates accepted by MemStorage
+// since the latest snapshot.
+// Every record is framed by its length and CRC-32C checksum,
+// so a record torn by a crash is detected and dropped on replay.
+type WAL struct {
+	mutex  sync.Mutex
+	path   string
+	file   *os.File
+	policy string
+	// seq is the sequence number of the last record.
+	seq uint64
+	// size is the size of the log in bytes.
+	size int64
+	// dirty reports whether the log has records which have not been synced.
+	dirty bool
+
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// OpenWAL opens the log at the path, creating it if it does not exist.
+// With SyncInterval the log is synced every interval until it is closed.
+func OpenWAL(path, policy string, interval time.Duration) (*WAL, error) {
+	switch policy {
+	case SyncAlways, SyncNever:
+	case SyncInterval:
+		if interval <= 0 {
+			return nil, fmt.Errorf("non-positive WAL sync interval: %s", interval)
+		}
+	default:
+		return nil, fmt.Errorf("unknown WAL sync policy: %s", policy)
+	}
+	file, err := openLog(path)
+	if err != nil {
+		return nil, err
+	}
+	w := &WAL{
+		path:   path,
+		file:   file,
+		policy: policy,
+	}
+	if policy == SyncInterval {
+		w.stop = make(chan struct{})
+		w.stopped = make(chan struct{})
+		go w.syncEvery(interval)
+	}
+	return w, nil
+}
+
+// Replay calls apply for every record with a sequence number greater than after, in order.
+// Records are read up to the end of the log or a torn record at its end, and the log is truncated there,
+// so new records are appended after the last valid one.
+// A damaged record followed by others is not torn by a crash, so Replay returns an error
+// and leaves the log unchanged rather than drop the records following it.
+// If the first record following after is not the next one, the records are still applied,
+// and an error wrapping ErrWALGap is returned once the log is replayed.
+// Replay must be called once, before any record is appended.
+func (w *WAL) Replay(after uint64, apply func(key, hash string, metrics []metric.Metric, rejections []repository.Rejection) error) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	info, err := w.file.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err := w.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	w.seq = after
+	reader := bufio.NewReader(w.file)
+	var (
+		offset int64
+		gap    error
+	)
+	for {
+		record, n, err := readRecord(reader, info.Size()-offset)
+		if errors.Is(err, io.EOF) || errors.Is(err, errTornRecord) {
+			// Either the log has ended or the rest of it was being written when the server stopped.
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("WAL record at offset %d: %w", offset, err)
+		}
+		offset += n
+		if record.Seq <= after {
+			continue
+		}
+		if w.seq == after && record.Seq > after+1 {
+			gap = fmt.Errorf("%w: records %d to %d are missing", ErrWALGap, after+1, record.Seq-1)
+		}
+		if err := apply(record.Key, record.Hash, record.Metrics, record.Rejections); err != nil {
+			return fmt.Errorf("WAL record %d: %w", record.Seq, err)
+		}
+		w.seq = record.Seq
+	}
+	w.size = offset
+	if err := w.file.Truncate(offset); err != nil {
+		return err
+	}
+	return gap
+}
+
+// openLog opens the log for reading and appending.
+func openLog(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+}
+
+// readRecord returns the next record and its size in the log, which has remaining bytes left.
+// Returns io.EOF if the log has no more records
+// and errTornRecord if the record does not fit in the log or is the last one and fails its checksum.
+func readRecord(reader io.Reader, remaining int64) (walRecord, int64, error) {
+	var header [recordHeaderSize]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return walRecord{}, 0, fmt.Errorf("%w header", errTornRecord)
+		}
+		return walRecord{}, 0, err
+	}
+	length := int64(binary.BigEndian.Uint32(header[:4]))
+	checksum := binary.BigEndian.Uint32(header[4:])
+	// A record this long is never written, so its header is damaged rather than torn.
+	if length > maxRecordSize {
+		return walRecord{}, 0, fmt.Errorf("record length %d exceeds %d", length, maxRecordSize)
+	}
+	size := recordHeaderSize + length
+	if size > remaining {
+		return walRecord{}, 0, errTornRecord
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		// The log is shorter than its size, so it is being changed by someone else.
+		return walRecord{}, 0, err
+	}
+	if crc32.Checksum(payload, crcTable) != checksum {
+		if size == remaining {
+			return walRecord{}, 0, fmt.Errorf("%w: checksum mismatch", errTornRecord)
+		}
+		return walRecord{}, 0, errors.New("record checksum mismatch")
+	}
+	var record walRecord
+	if err := json.Unmarshal(payload, &record); err != nil {
+		return walRecord{}, 0, err
+	}
+	return record, size, nil
+}
+
+// write appends a record of the updates to the log
+// and syncs it if the policy is SyncAlways.
+// Returns the sequence number of the record.
+func (w *WAL) write(key, hash string, metrics []metric.Metric, rejections []repository.Rejection) (uint64, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	payload, err := json.Marshal(walRecord{Seq: w.seq + 1, Key: key, Hash: hash, Metrics: metrics, Rejections: rejections})
+	if err != nil {
+		return 0, err
+	}
+	// A longer record would be taken for a damaged one on replay.
+	if len(payload) > maxRecordSize {
+		return 0, fmt.Errorf("WAL record of %d bytes exceeds %d", len(payload), maxRecordSize)
+	}
+	data := make([]byte, recordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(data[:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(data[4:recordHeaderSize], crc32.Checksum(payload, crcTable))
+	copy(data[recordHeaderSize:], payload)
+	_, err = w.file.Write(data)
+	if err == nil && w.policy == SyncAlways {
+		err = w.file.Sync()
+	}
+	if err != nil {
+		// Drop the record, so a partially written one does not hide the following ones
+		// and an unsynced one is not replayed, since the update is not applied.
+		return 0, errors.Join(err, w.file.Truncate(w.size))
+	}
+	if w.policy != SyncAlways {
+		w.dirty = true
+	}
+	w.seq++
+	w.size += int64(len(data))
+	return w.seq, nil
+}
+
+// position returns the sequence number of the last record and the size of the log.
+func (w *WAL) position() (uint64, int64) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	return w.seq, w.size
+}
+
+// discard drops the records stored in the first size bytes of the log,
+// since they are covered by a snapshot.
+// The remaining records are written to a new file which replaces the log.
+func (w *WAL) discard(size int64) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if size == w.size {
+		if err := w.file.Truncate(0); err != nil {
+			return err
+		}
+		w.size = 0
+		w.dirty = false
+		return w.file.Sync()
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(w.path), filepath.Base(w.path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := io.Copy(tmp, io.NewSectionReader(w.file, size, w.size-size)); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := errors.Join(tmp.Sync(), tmp.Close()); err != nil {
+		return err
+	}
+	// The new file is opened before it replaces the log,
+	// so the log is never left without a handle to append to.
+	file, err := openLog(tmp.Name())
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), w.path); err != nil {
+		file.Close()
+		return err
+	}
+	w.file.Close()
+	w.file = file
+	w.size -= size
+	return nil
+}
+
+// syncEvery syncs the log every interval if it has new records.
+func (w *WAL) syncEvery(interval time.Duration) {
+	defer close(w.stopped)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+			w.mutex.Lock()
+			if w.dirty {
+				if err := w.file.Sync(); err == nil {
+					w.dirty = false
+				}
+			}
+			w.mutex.Unlock()
+		}
+	}
+}
+
+// Close syncs and closes the log.
+func (w *WAL) Close() error {
+	if w.stop != nil {
+		close(w.stop)
+		<-w.stopped
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	return errors.Join(w.file.Sync(), w.file.Close())
+}
@@ -0,0 +1,42 @@
+package storage
+
+import "github.com/sudeeya/metrics-harvester/internal/repository"
+
+// appliedBatch is a batch remembered by its key.
+type appliedBatch struct {
+	// hash is the hash of the metrics of the batch.
+	// It is empty for the batches logged before hashes were recorded.
+	hash string
+
+	rejections []repository.Rejection
+}
+
+// keyWindow remembers the last size keys with their batches.
+// When it is full, adding a key forgets the oldest one.
+type keyWindow struct {
+	keys  map[string]appliedBatch
+	order []string
+	next  int
+}
+
+func newKeyWindow(size int) *keyWindow {
+	return &keyWindow{
+		keys:  make(map[string]appliedBatch, size),
+		order: make([]string, size),
+	}
+}
+
+// get returns the batch with the key and reports whether the key is known.
+func (kw *keyWindow) get(key string) (appliedBatch, bool) {
+	batch, ok := kw.keys[key]
+	return batch, ok
+}
+
+func (kw *keyWindow) add(key string, batch appliedBatch) {
+	if oldest := kw.order[kw.next]; oldest != "" {
+		delete(kw.keys, oldest)
+	}
+	kw.order[kw.next] = key
+	kw.keys[key] = batch
+	kw.next = (kw.next + 1) % len(kw.order)
+}
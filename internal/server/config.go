@@ -2,45 +2,127 @@ package server
 
 import (
 	"flag"
+	"fmt"
 
 	"github.com/caarlos0/env/v11"
+
+	"github.com/sudeeya/metrics-harvester/internal/repository/storage"
+)
+
+// Signing modes.
+const (
+	// SigningStrict rejects unsigned update requests when the key is set.
+	SigningStrict = "strict"
+	// SigningPermissive logs unsigned update requests and accepts them.
+	SigningPermissive = "permissive"
 )
 
 const (
 	defaultAddress         string = "localhost:8080"
+	defaultAllowPlaintext  bool   = false
+	defaultCryptoKey       string = ""
 	defaultDatabaseDSN     string = ""
+	defaultImportOnly      bool   = false
 	defaultKey             string = ""
 	defaultLogLevel        string = "info"
+	defaultMigrateOnly     bool   = false
 	defaultStoreInterval   int64  = 300
 	defaultFileStoragePath string = "metrics.json"
+	defaultGRPCAddress     string = ""
 	defaultProfilerPort    int64  = 6060
+	defaultReadSubnet      string = ""
 	defaultRestore         bool   = true
+	defaultShutdownTimeout int64  = 10
+	defaultSigningMode     string = SigningStrict
+	defaultSnapshotKeep    int64  = 3
+	defaultSnapshots       string = SnapshotsAuto
+	defaultTrustedSubnet   string = ""
+	defaultWAL             bool   = true
+	defaultWALSync         string = storage.SyncInterval
+	defaultWALSyncInterval int64  = 1
 )
 
 type Config struct {
 	Address         string `env:"ADDRESS"`
+	AllowPlaintext  bool   `env:"ALLOW_PLAINTEXT"`
+	CryptoKey       string `env:"CRYPTO_KEY"`
 	DatabaseDSN     string `env:"DATABASE_DSN"`
+	ImportOnly      bool   `env:"IMPORT_ONLY"`
 	Key             string `env:"KEY"`
 	LogLevel        string `env:"LOG_LEVEL"`
+	MigrateOnly     bool   `env:"MIGRATE_ONLY"`
 	StoreInterval   int64  `env:"STORE_INTERVAL"`
 	FileStoragePath string `env:"FILE_STORAGE_PATH"`
+	GRPCAddress     string `env:"GRPC_ADDRESS"`
 	ProfilerPort    int64  `env:"PROFILER_PORT"`
+	ReadSubnet      string `env:"READ_TRUSTED_SUBNET"`
 	Restore         bool   `env:"RESTORE"`
+	ShutdownTimeout int64  `env:"SHUTDOWN_TIMEOUT"`
+	SigningMode     string `env:"SIGNING_MODE"`
+	SnapshotKeep    int64  `env:"SNAPSHOT_KEEP"`
+	Snapshots       string `env:"SNAPSHOTS"`
+	TrustedSubnet   string `env:"TRUSTED_SUBNET"`
+	WAL             bool   `env:"WAL"`
+	WALSync         string `env:"WAL_SYNC"`
+	WALSyncInterval int64  `env:"WAL_SYNC_INTERVAL"`
 }
 
 func NewConfig() (*Config, error) {
 	var cfg Config
 	flag.StringVar(&cfg.Address, "a", defaultAddress, "Server IP address and port")
+	flag.BoolVar(&cfg.AllowPlaintext, "allow-plaintext", defaultAllowPlaintext, "Accept unencrypted update request bodies when the crypto key is set")
+	flag.StringVar(&cfg.CryptoKey, "crypto-key", defaultCryptoKey, "Path to the PEM file with the RSA private key for request decryption")
 	flag.StringVar(&cfg.DatabaseDSN, "d", defaultDatabaseDSN, "Database DSN (e.g., user=postgres password=secret host=localhost port=5432 database=pgx_test sslmode=disable)")
+	flag.BoolVar(&cfg.ImportOnly, "import-only", defaultImportOnly, "Seed an empty database with the metrics from the storage file and exit")
 	flag.StringVar(&cfg.Key, "k", defaultKey, "Key for HMAC hash")
 	flag.StringVar(&cfg.LogLevel, "l", defaultLogLevel, "Log level: info, error, fatal")
-	flag.Int64Var(&cfg.StoreInterval, "i", defaultStoreInterval, "The time interval in seconds after which metric values will be saved to the file")
+	flag.BoolVar(&cfg.MigrateOnly, "migrate-only", defaultMigrateOnly, "Apply database migrations and exit")
+	flag.Int64Var(&cfg.StoreInterval, "i", defaultStoreInterval, "The time interval in seconds after which metric values will be saved to the file (0 saves them on every update)")
 	flag.StringVar(&cfg.FileStoragePath, "f", defaultFileStoragePath, "Path to the file where the metric values are saved")
+	flag.StringVar(&cfg.GRPCAddress, "g", defaultGRPCAddress, "gRPC server IP address and port (gRPC is disabled if empty)")
 	flag.Int64Var(&cfg.ProfilerPort, "p", defaultProfilerPort, "The port on which pprof is running")
+	flag.StringVar(&cfg.ReadSubnet, "rt", defaultReadSubnet, "CIDR of clients allowed to read metrics (reads are unrestricted if empty)")
 	flag.BoolVar(&cfg.Restore, "r", defaultRestore, "Determines whether previously saved values from a file will be loaded when the server starts")
+	flag.Int64Var(&cfg.ShutdownTimeout, "st", defaultShutdownTimeout, "The time in seconds given to in-flight requests to complete on shutdown")
+	flag.StringVar(&cfg.SigningMode, "sm", defaultSigningMode, "Handling of unsigned update requests when the key is set: strict, permissive")
+	flag.Int64Var(&cfg.SnapshotKeep, "snapshot-keep", defaultSnapshotKeep, "The number of the latest snapshots kept, the older ones are used if the latest is damaged")
+	flag.StringVar(&cfg.Snapshots, "snapshots", defaultSnapshots, "Storing metrics to the file: auto (only without the database), on, off")
+	flag.StringVar(&cfg.TrustedSubnet, "t", defaultTrustedSubnet, "CIDR of agents allowed to update metrics (updates are unrestricted if empty)")
+	flag.BoolVar(&cfg.WAL, "wal", defaultWAL, "Log updates of the in-memory storage between snapshots to the storage file path with the .wal suffix")
+	flag.StringVar(&cfg.WALSync, "wal-sync", defaultWALSync, "Syncing of the write-ahead log: always, interval, never")
+	flag.Int64Var(&cfg.WALSyncInterval, "wal-sync-interval", defaultWALSyncInterval, "The time interval in seconds after which the write-ahead log is synced with the interval policy")
 	flag.Parse()
 	if err := env.Parse(&cfg); err != nil {
 		return nil, err
 	}
+	switch cfg.SigningMode {
+	case SigningStrict, SigningPermissive:
+	default:
+		return nil, fmt.Errorf("unknown signing mode: %s", cfg.SigningMode)
+	}
+	// The gRPC transport has no encryption of its own, so it would let plaintext metrics in.
+	if cfg.GRPCAddress != "" && cfg.CryptoKey != "" && !cfg.AllowPlaintext {
+		return nil, fmt.Errorf("gRPC does not encrypt metrics: disable it or allow plaintext with the crypto key set")
+	}
+	if cfg.StoreInterval < 0 {
+		return nil, fmt.Errorf("negative store interval: %d", cfg.StoreInterval)
+	}
+	if cfg.SnapshotKeep < 1 {
+		return nil, fmt.Errorf("at least one snapshot must be kept: %d", cfg.SnapshotKeep)
+	}
+	switch cfg.Snapshots {
+	case SnapshotsAuto, SnapshotsOn, SnapshotsOff:
+	default:
+		return nil, fmt.Errorf("unknown snapshot policy: %s", cfg.Snapshots)
+	}
+	switch cfg.WALSync {
+	case storage.SyncAlways, storage.SyncNever:
+	case storage.SyncInterval:
+		if cfg.WALSyncInterval <= 0 {
+			return nil, fmt.Errorf("non-positive WAL sync interval: %d", cfg.WALSyncInterval)
+		}
+	default:
+		return nil, fmt.Errorf("unknown WAL sync policy: %s", cfg.WALSync)
+	}
 	return &cfg, nil
 }
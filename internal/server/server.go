@@ -2,12 +2,14 @@ package server
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/rsa"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
-	"os"
 	"os/signal"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -15,153 +17,385 @@ import (
 
 	"github.com/go-chi/chi/v5"
 	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	_ "google.golang.org/grpc/encoding/gzip"
 
+	"github.com/sudeeya/metrics-harvester/internal/encryption"
 	"github.com/sudeeya/metrics-harvester/internal/handlers"
-	"github.com/sudeeya/metrics-harvester/internal/metric"
+	"github.com/sudeeya/metrics-harvester/internal/interceptor"
 	"github.com/sudeeya/metrics-harvester/internal/middleware"
+	pb "github.com/sudeeya/metrics-harvester/internal/proto"
 	repo "github.com/sudeeya/metrics-harvester/internal/repository"
 	"github.com/sudeeya/metrics-harvester/internal/repository/database"
+	"github.com/sudeeya/metrics-harvester/internal/repository/snapshot"
 	"github.com/sudeeya/metrics-harvester/internal/repository/storage"
+	"github.com/sudeeya/metrics-harvester/internal/service"
 )
 
 const limitInSeconds = 10
 
+// pruneInterval is how often the history older than the retention is deleted.
+const pruneInterval = time.Minute
+
+// migrationLimitInSeconds is longer than limitInSeconds,
+// since migrations may rewrite large tables.
+const migrationLimitInSeconds = 300
+
 type Server struct {
 	cfg        *Config
 	logger     *zap.Logger
 	repository repo.Repository
-	handler    http.Handler
+	httpServer *http.Server
+	grpcServer *grpc.Server
+	profiler   *http.Server
+	inFlight   sync.WaitGroup
+	// snapshotFile stores metrics to the file. It is nil if file snapshots are disabled.
+	snapshotFile *snapshot.File
 }
 
 func NewServer(logger *zap.Logger, cfg *Config, repository repo.Repository) *Server {
-	logger.Info("Initializing storage file")
-	initializeStorageFile(logger, cfg)
+	var snapshotFile *snapshot.File
+	if snapshotsEnabled(cfg, repository) {
+		snapshotFile = snapshot.NewFile(cfg.FileStoragePath, int(cfg.SnapshotKeep))
+	}
 	logger.Info("Initializing repository")
-	initializeRepository(logger, cfg, repository)
+	initializeRepository(logger, cfg, repository, snapshotFile)
+	if snapshotFile != nil && cfg.StoreInterval == 0 {
+		logger.Info("Storing metrics to file on every update")
+		repository = snapshot.NewSynced(repository, snapshotFile)
+	}
 	router := chi.NewRouter()
 	logger.Info("Initializing routes")
-	addRoutes(logger, repository, router)
+	trustedSubnet := initializeSubnet(logger, cfg.TrustedSubnet)
+	readSubnet := initializeSubnet(logger, cfg.ReadSubnet)
+	privateKey := initializePrivateKey(logger, cfg)
+	addRoutes(logger, cfg, repository, router, privateKey)
 	logger.Info("Initializing middleware")
 	handler := middleware.WithCompressing(router)
+	handler = middleware.WithDecrypting(privateKey, handler)
 	handler = middleware.WithSigning([]byte(cfg.Key), handler)
+	// The subnet is checked before any body is decrypted, as the gRPC interceptors do.
+	handler = withSubnets(trustedSubnet, readSubnet, handler)
 	handler = middleware.WithLogging(logger, handler)
-	return &Server{
-		cfg:        cfg,
-		logger:     logger,
-		repository: repository,
-		handler:    handler,
+	var grpcServer *grpc.Server
+	if cfg.GRPCAddress != "" {
+		logger.Info("Initializing gRPC server")
+		grpcServer = initializeGRPCServer(logger, cfg, repository, trustedSubnet)
+	}
+	s := &Server{
+		cfg:          cfg,
+		logger:       logger,
+		repository:   repository,
+		grpcServer:   grpcServer,
+		snapshotFile: snapshotFile,
+		profiler: &http.Server{
+			Addr:    fmt.Sprintf(":%d", cfg.ProfilerPort),
+			Handler: http.DefaultServeMux,
+		},
+	}
+	s.httpServer = &http.Server{
+		Addr:    cfg.Address,
+		Handler: s.trackInFlight(handler),
 	}
+	return s
 }
 
-func initializeStorageFile(logger *zap.Logger, cfg *Config) {
-	if file, err := os.Open(cfg.FileStoragePath); !os.IsNotExist(err) {
-		file.Close()
-		return
+func initializeGRPCServer(logger *zap.Logger, cfg *Config, repository repo.Repository, trustedSubnet *net.IPNet) *grpc.Server {
+	grpcServer := grpc.NewServer(
+		grpc.WaitForHandlers(true),
+		grpc.ChainUnaryInterceptor(
+			interceptor.UnaryLogging(logger),
+			interceptor.UnaryTrustedSubnet(trustedSubnet),
+			interceptor.UnarySigning(logger, []byte(cfg.Key), cfg.SigningMode == SigningStrict),
+		),
+		grpc.ChainStreamInterceptor(
+			interceptor.StreamLogging(logger),
+			interceptor.StreamTrustedSubnet(trustedSubnet),
+			interceptor.StreamSigning(logger, []byte(cfg.Key), cfg.SigningMode == SigningStrict),
+		),
+	)
+	pb.RegisterMetricsServer(grpcServer, service.NewMetricsService(logger, repository))
+	return grpcServer
+}
+
+func initializeSubnet(logger *zap.Logger, cidr string) *net.IPNet {
+	if cidr == "" {
+		return nil
 	}
-	newFile, err := os.Create(cfg.FileStoragePath)
+	_, subnet, err := net.ParseCIDR(cidr)
 	if err != nil {
 		logger.Fatal(err.Error())
 	}
-	newFile.Close()
-	if err := os.WriteFile(cfg.FileStoragePath, []byte("[]"), 0666); err != nil {
+	return subnet
+}
+
+func initializePrivateKey(logger *zap.Logger, cfg *Config) *rsa.PrivateKey {
+	if cfg.CryptoKey == "" {
+		return nil
+	}
+	privateKey, err := encryption.LoadPrivateKey(cfg.CryptoKey)
+	if err != nil {
 		logger.Fatal(err.Error())
 	}
+	return privateKey
 }
 
-func initializeRepository(logger *zap.Logger, cfg *Config, repository repo.Repository) {
-	switch v := repository.(type) {
-	case *database.Database:
-		logger.Info("Initializing database")
-		ctx, cancel := context.WithTimeout(context.Background(), limitInSeconds*time.Second)
-		defer cancel()
-		if _, err := v.DB.ExecContext(ctx, database.CreateMetricsTable); err != nil {
-			logger.Fatal(err.Error())
-		}
-		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
-			logger.Error(ctx.Err().Error())
-		}
-	case *storage.MemStorage:
-		if cfg.Restore {
-			logger.Info("Initializing metrics with saved values from a file")
-			savedData, err := os.ReadFile(cfg.FileStoragePath)
-			if err != nil {
-				logger.Fatal(err.Error())
-			}
-			var savedMetrics []metric.Metric
-			if err := json.Unmarshal(savedData, &savedMetrics); err != nil {
-				logger.Fatal(err.Error())
-			}
-			ctx := context.Background()
-			for _, m := range savedMetrics {
-				repository.PutMetric(ctx, m)
-			}
-		}
+// Migrate applies database migrations and returns.
+// It is used in the migrate-only mode, so the repository must be a database.
+func Migrate(logger *zap.Logger, repository repo.Repository) {
+	db, ok := repository.(*database.Database)
+	if !ok {
+		logger.Fatal("Migrations require the database DSN")
 	}
+	migrateDatabase(logger, db)
 }
 
-func addRoutes(logger *zap.Logger, repository repo.Repository, router chi.Router) {
-	router.Get("/value/{metricType}/{metricName}", handlers.NewValueHandler(logger, repository))
+// migrateDatabase applies the migrations newer than the database schema.
+// If the schema is newer than the server knows, the server must not start.
+func migrateDatabase(logger *zap.Logger, db *database.Database) {
+	logger.Info("Migrating database")
+	ctx, cancel := context.WithTimeout(context.Background(), migrationLimitInSeconds*time.Second)
+	defer cancel()
+	from, to, err := db.Migrate(ctx)
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+	if from == to {
+		logger.Info(fmt.Sprintf("Database schema is up to date at version %d", to))
+		return
+	}
+	logger.Info(fmt.Sprintf("Database schema is migrated from version %d to %d", from, to))
+}
+
+// initializeRepository migrates the database, restores the snapshot if file snapshots are enabled
+// and replays the write-ahead log of the in-memory storage over it.
+func initializeRepository(logger *zap.Logger, cfg *Config, repository repo.Repository, snapshotFile *snapshot.File) {
+	if db, ok := repository.(*database.Database); ok {
+		migrateDatabase(logger, db)
+	}
+	if snapshotFile == nil {
+		return
+	}
+	var restored snapshot.Snapshot
+	if cfg.Restore {
+		restored = restoreMetrics(logger, repository, snapshotFile)
+	}
+	// Every update is stored to the file anyway if the store interval is zero.
+	if ms, ok := repository.(*storage.MemStorage); ok && cfg.WAL && cfg.StoreInterval > 0 {
+		recoverWAL(logger, cfg, ms, snapshotFile, restored)
+	}
+}
+
+func addRoutes(logger *zap.Logger, cfg *Config, repository repo.Repository, router chi.Router, privateKey *rsa.PrivateKey) {
 	router.Get("/ping", handlers.NewPingHandler(logger, repository))
-	router.Get("/", handlers.NewAllMetricsHandler(logger, repository))
-	router.Post("/update/{metricType}/{metricName}/{metricValue}", handlers.NewUpdateHandler(logger, repository))
-	router.Post("/update/{metricType}/", http.NotFound)
-	router.Post("/update/", handlers.NewJSONUpdateHandler(logger, repository))
-	router.Post("/updates/", handlers.NewBatchHandler(logger, repository))
-	router.Post("/value/", handlers.NewJSONValueHandler(logger, repository))
+	router.Group(func(r chi.Router) {
+		r.Get("/value/{metricType}/{metricName}", handlers.NewValueHandler(logger, repository))
+		r.Get("/history/{metricType}/{metricName}", handlers.NewHistoryHandler(logger, repository))
+		r.Get("/", handlers.NewAllMetricsHandler(logger, repository))
+		r.Get("/metrics", handlers.NewPrometheusHandler(logger, repository))
+		r.Post("/value/", handlers.NewJSONValueHandler(logger, repository))
+	})
+	router.Group(func(r chi.Router) {
+		r.Use(withRequiredSignature(logger, cfg))
+		r.Use(withRequiredEncryption(privateKey, cfg))
+		r.Post("/update/{metricType}/{metricName}/{metricValue}", handlers.NewUpdateHandler(logger, repository))
+		r.Post("/update/{metricType}/", http.NotFound)
+		r.Post("/update/", handlers.NewJSONUpdateHandler(logger, repository))
+		r.Post("/updates/", handlers.NewBatchHandler(logger, repository))
+	})
+}
+
+func withRequiredSignature(logger *zap.Logger, cfg *Config) func(http.Handler) http.Handler {
+	return func(handler http.Handler) http.Handler {
+		return middleware.WithRequiredSignature(logger, []byte(cfg.Key), cfg.SigningMode == SigningStrict, handler)
+	}
+}
+
+func withRequiredEncryption(privateKey *rsa.PrivateKey, cfg *Config) func(http.Handler) http.Handler {
+	return func(handler http.Handler) http.Handler {
+		return middleware.WithRequiredEncryption(privateKey, cfg.AllowPlaintext, handler)
+	}
+}
+
+// withSubnets restricts the update routes to the trusted subnet
+// and every other route except /ping to the read subnet.
+func withSubnets(trustedSubnet, readSubnet *net.IPNet, handler http.Handler) http.Handler {
+	trusted := middleware.WithTrustedSubnet(trustedSubnet, handler)
+	read := middleware.WithTrustedSubnet(readSubnet, handler)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case isUpdateRoute(r):
+			trusted.ServeHTTP(w, r)
+		case r.URL.Path == "/ping":
+			handler.ServeHTTP(w, r)
+		default:
+			read.ServeHTTP(w, r)
+		}
+	})
+}
+
+// isUpdateRoute reports whether the request targets one of the routes that change metrics.
+func isUpdateRoute(r *http.Request) bool {
+	return r.Method == http.MethodPost &&
+		(strings.HasPrefix(r.URL.Path, "/update/") || r.URL.Path == "/updates/")
 }
 
+// Run starts the servers and blocks until SIGINT, SIGTERM or SIGQUIT is received.
+// Then it shuts the server down gracefully.
 func (s *Server) Run() {
 	s.logger.Info("Server is running")
-	storeTicker := time.NewTicker(time.Duration(s.cfg.StoreInterval) * time.Second)
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	defer stop()
 	go func() {
-		if err := http.ListenAndServe(s.cfg.Address, s.handler); err != nil {
+		if err := s.httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			s.logger.Fatal(err.Error())
 		}
 	}()
+	if s.grpcServer != nil {
+		go func() {
+			listener, err := net.Listen("tcp", s.cfg.GRPCAddress)
+			if err != nil {
+				s.logger.Fatal(err.Error())
+			}
+			if err := s.grpcServer.Serve(listener); err != nil {
+				s.logger.Fatal(err.Error())
+			}
+		}()
+	}
 	go func() {
-		for range storeTicker.C {
+		if err := s.profiler.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.logger.Fatal(err.Error())
+		}
+	}()
+	storeDone := make(chan struct{})
+	if s.snapshotFile != nil && s.cfg.StoreInterval > 0 {
+		go s.storeEvery(ctx, time.Duration(s.cfg.StoreInterval)*time.Second, storeDone)
+	} else {
+		close(storeDone)
+	}
+	pruneDone := make(chan struct{})
+	if pruner, ok := repo.Unwrap(s.repository).(repo.HistoryPruner); ok {
+		go s.pruneEvery(ctx, pruner, pruneInterval, pruneDone)
+	} else {
+		close(pruneDone)
+	}
+
+	<-ctx.Done()
+	s.logger.Info("Server is shutting down")
+	stop()
+	s.drain()
+	<-storeDone
+	<-pruneDone
+	s.Shutdown()
+}
+
+// pruneEvery deletes the history older than the retention every interval until ctx is done.
+func (s *Server) pruneEvery(ctx context.Context, pruner repo.HistoryPruner, interval time.Duration, done chan<- struct{}) {
+	defer close(done)
+	pruneTicker := time.NewTicker(interval)
+	defer pruneTicker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-pruneTicker.C:
+			if err := pruner.PruneHistory(ctx); err != nil && ctx.Err() == nil {
+				s.logger.Error(err.Error())
+			}
+		}
+	}
+}
+
+// storeEvery stores metrics to the file every interval until ctx is done.
+func (s *Server) storeEvery(ctx context.Context, interval time.Duration, done chan<- struct{}) {
+	defer close(done)
+	storeTicker := time.NewTicker(interval)
+	defer storeTicker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-storeTicker.C:
 			s.logger.Info("Storing all metrics to file")
 			s.StoreMetricsToFile()
 		}
-	}()
-	go func() {
-		<-sigChan
-		s.logger.Info("Server is shutting down")
-		s.Shutdown()
-	}()
-	go func() {
-		if err := http.ListenAndServe(fmt.Sprintf(":%d", s.cfg.ProfilerPort), nil); err != nil {
-			s.logger.Fatal(err.Error())
+	}
+}
+
+// drain stops accepting new requests and waits for in-flight ones.
+// Requests still running after the shutdown timeout have their connections closed,
+// but drain returns only after their handlers do.
+func (s *Server) drain() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(s.cfg.ShutdownTimeout)*time.Second)
+	defer cancel()
+
+	grpcStopped := make(chan struct{})
+	if s.grpcServer != nil {
+		go func() {
+			defer close(grpcStopped)
+			s.grpcServer.GracefulStop()
+		}()
+	}
+	if err := s.httpServer.Shutdown(ctx); err != nil {
+		s.logger.Error(err.Error())
+		if err := s.httpServer.Close(); err != nil {
+			s.logger.Error(err.Error())
 		}
-	}()
-	select {}
+	}
+	if s.grpcServer != nil {
+		select {
+		case <-grpcStopped:
+		case <-ctx.Done():
+			s.logger.Error(ctx.Err().Error())
+			s.grpcServer.Stop()
+			<-grpcStopped
+		}
+	}
+	s.inFlight.Wait()
+}
+
+// trackInFlight counts requests whose handlers have not returned yet.
+func (s *Server) trackInFlight(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.inFlight.Add(1)
+		defer s.inFlight.Done()
+		handler.ServeHTTP(w, r)
+	})
 }
 
 func (s *Server) StoreMetricsToFile() {
 	ctx, cancel := context.WithTimeout(context.Background(), limitInSeconds*time.Second)
 	defer cancel()
-	metrics, err := s.repository.GetAllMetrics(ctx)
+	var err error
+	if ms, ok := s.repository.(*storage.MemStorage); ok {
+		// The write-ahead log is truncated once the snapshot covers it.
+		err = ms.Checkpoint(s.snapshotFile.WriteSequence)
+	} else {
+		err = s.snapshotFile.Store(ctx, s.repository)
+	}
 	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
 		s.logger.Error(ctx.Err().Error())
 	}
 	if err != nil {
 		s.logger.Fatal(err.Error())
 	}
-	data, err := json.MarshalIndent(metrics, "", "\t")
-	if err != nil {
-		s.logger.Fatal(err.Error())
-	}
-	if err := os.WriteFile(s.cfg.FileStoragePath, data, 0666); err != nil {
-		s.logger.Fatal(err.Error())
-	}
 }
 
+// Shutdown stops the profiler, writes the final snapshot if snapshots are enabled
+// and closes Repository.
+// It must be called after the HTTP and gRPC servers have been drained.
 func (s *Server) Shutdown() {
-	s.StoreMetricsToFile()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(s.cfg.ShutdownTimeout)*time.Second)
+	defer cancel()
+	if err := s.profiler.Shutdown(ctx); err != nil {
+		s.logger.Error(err.Error())
+	}
+	if s.snapshotFile != nil {
+		s.logger.Info("Storing all metrics to file")
+		s.StoreMetricsToFile()
+	}
 	if err := s.repository.Close(); err != nil {
-		s.logger.Fatal(err.Error())
+		s.logger.Error(err.Error())
 	}
-	os.Exit(0)
+	s.logger.Info("Server is stopped")
 }
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/sudeeya/metrics-harvester/internal/metric"
+	"github.com/sudeeya/metrics-harvester/internal/middleware"
+	"github.com/sudeeya/metrics-harvester/internal/mocks"
+)
+
+func TestWithSubnets(t *testing.T) {
+	_, trustedSubnet, err := net.ParseCIDR("10.0.0.0/24")
+	require.NoError(t, err)
+	_, readSubnet, err := net.ParseCIDR("192.168.0.0/24")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		realIP   string
+		expected int
+	}{
+		{name: "update from trusted subnet", method: http.MethodPost, path: "/updates/", realIP: "10.0.0.1", expected: http.StatusOK},
+		{name: "update from read subnet", method: http.MethodPost, path: "/updates/", realIP: "192.168.0.1", expected: http.StatusForbidden},
+		{name: "plain update from outside", method: http.MethodPost, path: "/update/counter/c/1", realIP: "172.16.0.1", expected: http.StatusForbidden},
+		{name: "read from read subnet", method: http.MethodGet, path: "/metrics", realIP: "192.168.0.1", expected: http.StatusOK},
+		{name: "read from trusted subnet", method: http.MethodGet, path: "/metrics", realIP: "10.0.0.1", expected: http.StatusForbidden},
+		{name: "ping from outside", method: http.MethodGet, path: "/ping", realIP: "172.16.0.1", expected: http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reached := false
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				reached = true
+			})
+			r := httptest.NewRequest(test.method, test.path, nil)
+			r.Header.Set("X-Real-IP", test.realIP)
+			w := httptest.NewRecorder()
+			withSubnets(trustedSubnet, readSubnet, next).ServeHTTP(w, r)
+			require.Equal(t, test.expected, w.Code)
+			// Rejected requests must not reach decryption.
+			require.Equal(t, test.expected == http.StatusOK, reached)
+		})
+	}
+}
+
+func TestRequiredEncryption(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	repoMock := mocks.NewMockRepository(ctrl)
+	value := 1.5
+	repoMock.EXPECT().
+		GetMetric(gomock.Any(), metric.Gauge, "gauge", gomock.Nil()).
+		Return(metric.Metric{ID: "gauge", MType: metric.Gauge, Value: &value}, nil)
+
+	router := chi.NewRouter()
+	addRoutes(zap.NewNop(), &Config{}, repoMock, router, privateKey)
+	handler := middleware.WithDecrypting(privateKey, router)
+
+	tests := []struct {
+		name     string
+		path     string
+		body     string
+		expected int
+	}{
+		{name: "plaintext read", path: "/value/", body: `{"id":"gauge","type":"gauge"}`, expected: http.StatusOK},
+		{name: "plaintext batch", path: "/updates/", body: `[{"id":"gauge","type":"gauge","value":1}]`, expected: http.StatusBadRequest},
+		{name: "plaintext update", path: "/update/", body: `{"id":"gauge","type":"gauge","value":1}`, expected: http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, test.path, strings.NewReader(test.body))
+			r.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			require.Equal(t, test.expected, w.Code)
+		})
+	}
+}
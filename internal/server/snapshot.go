@@ -0,0 +1,153 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/sudeeya/metrics-harvester/internal/metric"
+	repo "github.com/sudeeya/metrics-harvester/internal/repository"
+	"github.com/sudeeya/metrics-harvester/internal/repository/database"
+	"github.com/sudeeya/metrics-harvester/internal/repository/snapshot"
+	"github.com/sudeeya/metrics-harvester/internal/repository/storage"
+)
+
+// Snapshot policies.
+const (
+	// SnapshotsAuto enables file snapshots for the in-memory storage
+	// and disables them for the database, which persists metrics itself.
+	SnapshotsAuto = "auto"
+	// SnapshotsOn enables file snapshots for any repository.
+	SnapshotsOn = "on"
+	// SnapshotsOff disables file snapshots.
+	SnapshotsOff = "off"
+)
+
+// walSuffix is appended to the storage file path to get the path of the write-ahead log.
+const walSuffix = ".wal"
+
+// errRepositoryNotEmpty is returned by restoreSnapshot if the repository already has metrics.
+// Restoring them again would add the saved counter deltas twice.
+var errRepositoryNotEmpty = errors.New("repository is not empty")
+
+// snapshotsEnabled resolves the snapshot policy for the repository.
+func snapshotsEnabled(cfg *Config, repository repo.Repository) bool {
+	switch cfg.Snapshots {
+	case SnapshotsOn:
+		return true
+	case SnapshotsOff:
+		return false
+	}
+	_, isDatabase := repository.(*database.Database)
+	return !isDatabase
+}
+
+// restoreSnapshot puts the metrics from the latest valid snapshot into an empty repository
+// with one batch, so either the whole snapshot is restored or nothing is.
+// Metrics the server no longer accepts, such as the ones named before the names were restricted,
+// are logged and skipped, and the returned snapshot has only the restored ones.
+// Returns errRepositoryNotEmpty if the repository already has metrics
+// and snapshot.ErrNoSnapshot if there is no snapshot.
+func restoreSnapshot(ctx context.Context, logger *zap.Logger, repository repo.Repository, file *snapshot.File) (snapshot.Snapshot, error) {
+	existing, err := repository.GetAllMetrics(ctx)
+	if err != nil {
+		return snapshot.Snapshot{}, err
+	}
+	if len(existing) != 0 {
+		return snapshot.Snapshot{}, errRepositoryNotEmpty
+	}
+	s, err := file.Read()
+	if err != nil {
+		return snapshot.Snapshot{}, err
+	}
+	valid := make([]metric.Metric, 0, len(s.Metrics))
+	for _, m := range s.Metrics {
+		if err := m.Validate(); err != nil {
+			logger.Warn(fmt.Sprintf("Skipping metric %q of snapshot %s: %s", m.ID, s.Path, err))
+			continue
+		}
+		valid = append(valid, m)
+	}
+	s.Metrics = valid
+	if len(s.Metrics) == 0 {
+		return s, nil
+	}
+	if err := repository.PutBatch(ctx, s.Metrics); err != nil {
+		return snapshot.Snapshot{}, err
+	}
+	return s, nil
+}
+
+// restoreMetrics restores the latest valid snapshot when the server starts and returns it.
+// A repository which already has metrics is left as is.
+func restoreMetrics(logger *zap.Logger, repository repo.Repository, file *snapshot.File) snapshot.Snapshot {
+	logger.Info("Initializing metrics with saved values from a file")
+	ctx, cancel := context.WithTimeout(context.Background(), limitInSeconds*time.Second)
+	defer cancel()
+	s, err := restoreSnapshot(ctx, logger, repository, file)
+	switch {
+	case errors.Is(err, errRepositoryNotEmpty):
+		logger.Warn("Repository already has metrics, the snapshot is not restored")
+		return snapshot.Snapshot{}
+	case errors.Is(err, snapshot.ErrNoSnapshot):
+		logger.Info("There is no snapshot to restore")
+		return snapshot.Snapshot{}
+	case err != nil:
+		logger.Fatal(err.Error())
+	}
+	logger.Info(fmt.Sprintf("Restored %d metrics from %s taken at %s", len(s.Metrics), s.Path, s.Time))
+	return s
+}
+
+// recoverWAL replays the write-ahead log over the restored snapshot
+// and makes the storage log every update.
+// If the snapshot is not restored, the log is discarded,
+// but its new records follow the latest snapshot, so they are not mistaken for covered ones.
+func recoverWAL(logger *zap.Logger, cfg *Config, ms *storage.MemStorage, file *snapshot.File, restored snapshot.Snapshot) {
+	path := cfg.FileStoragePath + walSuffix
+	after := restored.Sequence
+	if !cfg.Restore {
+		logger.Info("Discarding the write-ahead log")
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			logger.Fatal(err.Error())
+		}
+		if latest, err := file.Read(); err == nil {
+			after = latest.Sequence
+		}
+	}
+	logger.Info("Replaying the write-ahead log")
+	wal, err := storage.OpenWAL(path, cfg.WALSync, time.Duration(cfg.WALSyncInterval)*time.Second)
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+	err = ms.Recover(wal, after)
+	switch {
+	case errors.Is(err, storage.ErrWALGap):
+		// The snapshot covering the missing records is lost, so their updates are lost too.
+		logger.Error(err.Error())
+	case err != nil:
+		logger.Fatal(err.Error())
+	}
+}
+
+// Import seeds an empty database with the metrics from the latest valid snapshot and returns.
+// It is used in the import-only mode, so the repository must be a database.
+func Import(logger *zap.Logger, cfg *Config, repository repo.Repository) {
+	db, ok := repository.(*database.Database)
+	if !ok {
+		logger.Fatal("Import requires the database DSN")
+	}
+	migrateDatabase(logger, db)
+	logger.Info("Importing metrics from a file")
+	ctx, cancel := context.WithTimeout(context.Background(), migrationLimitInSeconds*time.Second)
+	defer cancel()
+	s, err := restoreSnapshot(ctx, logger, db, snapshot.NewFile(cfg.FileStoragePath, int(cfg.SnapshotKeep)))
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+	logger.Info(fmt.Sprintf("Imported %d metrics from %s", len(s.Metrics), s.Path))
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/sudeeya/metrics-harvester/internal/metric"
+	"github.com/sudeeya/metrics-harvester/internal/repository/database"
+	"github.com/sudeeya/metrics-harvester/internal/repository/snapshot"
+	"github.com/sudeeya/metrics-harvester/internal/repository/storage"
+)
+
+func TestSnapshotsEnabled(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   string
+		database bool
+		expected bool
+	}{
+		{name: "auto with storage", policy: SnapshotsAuto, expected: true},
+		{name: "auto with database", policy: SnapshotsAuto, database: true, expected: false},
+		{name: "on with database", policy: SnapshotsOn, database: true, expected: true},
+		{name: "off with storage", policy: SnapshotsOff, expected: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := &Config{Snapshots: test.policy}
+			if test.database {
+				require.Equal(t, test.expected, snapshotsEnabled(cfg, &database.Database{}))
+				return
+			}
+			require.Equal(t, test.expected, snapshotsEnabled(cfg, storage.NewMemStorage()))
+		})
+	}
+}
+
+func TestRestoreSnapshot(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	require.NoError(t, os.WriteFile(path, []byte(`[
+		{"id": "gauge", "type": "gauge", "value": 1.5},
+		{"id": "counter", "type": "counter", "delta": 3}
+	]`), 0666))
+
+	file := snapshot.NewFile(path, 1)
+	repository := storage.NewMemStorage()
+	s, err := restoreSnapshot(ctx, zap.NewNop(), repository, file)
+	require.NoError(t, err)
+	require.Len(t, s.Metrics, 2)
+	counter, err := repository.GetMetric(ctx, metric.Counter, "counter", nil)
+	require.NoError(t, err)
+	require.Equal(t, int64(3), *counter.Delta)
+
+	// Restoring twice would count the deltas twice.
+	_, err = restoreSnapshot(ctx, zap.NewNop(), repository, file)
+	require.ErrorIs(t, err, errRepositoryNotEmpty)
+	counter, err = repository.GetMetric(ctx, metric.Counter, "counter", nil)
+	require.NoError(t, err)
+	require.Equal(t, int64(3), *counter.Delta)
+
+	// Invalid metrics, such as the ones named before the names were restricted, are skipped.
+	invalid := filepath.Join(t.TempDir(), "invalid.json")
+	require.NoError(t, os.WriteFile(invalid, []byte(`[
+		{"id": "gauge", "type": "gauge"},
+		{"id": "cpu usage", "type": "gauge", "value": 1},
+		{"id": "counter", "type": "counter", "delta": 3}
+	]`), 0666))
+	repository = storage.NewMemStorage()
+	s, err = restoreSnapshot(ctx, zap.NewNop(), repository, snapshot.NewFile(invalid, 1))
+	require.NoError(t, err)
+	require.Len(t, s.Metrics, 1)
+	all, err := repository.GetAllMetrics(ctx)
+	require.NoError(t, err)
+	require.Len(t, all, 1)
+
+	_, err = restoreSnapshot(ctx, zap.NewNop(), storage.NewMemStorage(), snapshot.NewFile(filepath.Join(t.TempDir(), "missing.json"), 1))
+	require.ErrorIs(t, err, snapshot.ErrNoSnapshot)
+}
@@ -0,0 +1,162 @@
+// Package service implements the gRPC Metrics service.
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/sudeeya/metrics-harvester/internal/metric"
+	pb "github.com/sudeeya/metrics-harvester/internal/proto"
+	repo "github.com/sudeeya/metrics-harvester/internal/repository"
+)
+
+const limitInSeconds = 10
+
+// IdempotencyKey is the metadata key carrying a unique key of the batch.
+// It is the gRPC counterpart of the Idempotency-Key HTTP header.
+const IdempotencyKey = "idempotency-key"
+
+var _ pb.MetricsServer = (*MetricsService)(nil)
+
+// MetricsService implements the [pb.MetricsServer] interface.
+// It writes the received metrics to the same Repository as the HTTP handlers.
+type MetricsService struct {
+	pb.UnimplementedMetricsServer
+	logger     *zap.Logger
+	repository repo.Repository
+}
+
+func NewMetricsService(logger *zap.Logger, repository repo.Repository) *MetricsService {
+	return &MetricsService{
+		logger:     logger,
+		repository: repository,
+	}
+}
+
+// UpdateMetrics implements the [pb.MetricsServer] interface.
+func (s *MetricsService) UpdateMetrics(ctx context.Context, req *pb.UpdateMetricsRequest) (*pb.UpdateMetricsResponse, error) {
+	metrics := make([]metric.Metric, len(req.GetMetrics()))
+	for i, pm := range req.GetMetrics() {
+		metrics[i] = pm.ToMetric()
+	}
+	if err := s.putBatch(ctx, metrics); err != nil {
+		return nil, err
+	}
+	return &pb.UpdateMetricsResponse{}, nil
+}
+
+// StreamMetrics implements the [pb.MetricsServer] interface.
+func (s *MetricsService) StreamMetrics(stream pb.Metrics_StreamMetricsServer) error {
+	metrics := make([]metric.Metric, 0)
+	for {
+		pm, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		metrics = append(metrics, pm.ToMetric())
+	}
+	if err := s.putBatch(stream.Context(), metrics); err != nil {
+		return err
+	}
+	return stream.SendAndClose(&pb.UpdateMetricsResponse{})
+}
+
+// invalidArgument converts a validation error to codes.InvalidArgument
+// with the invalid fields attached as errdetails.BadRequest.
+func invalidArgument(err error) error {
+	st := status.New(codes.InvalidArgument, err.Error())
+	var verr *metric.ValidationError
+	if !errors.As(err, &verr) {
+		return st.Err()
+	}
+	violations := make([]*errdetails.BadRequest_FieldViolation, len(verr.Fields))
+	for i, f := range verr.Fields {
+		violations[i] = &errdetails.BadRequest_FieldViolation{Field: f.Field, Description: f.Message}
+	}
+	detailed, detailsErr := st.WithDetails(&errdetails.BadRequest{FieldViolations: violations})
+	if detailsErr != nil {
+		return st.Err()
+	}
+	return detailed.Err()
+}
+
+// rejectHistograms returns a validation error listing the histograms of the batch.
+func rejectHistograms(metrics []metric.Metric) error {
+	var verr metric.ValidationError
+	for i, m := range metrics {
+		if m.MType == metric.Histogram {
+			verr.Fields = append(verr.Fields, metric.FieldError{
+				Field:   fmt.Sprintf("[%d].type", i),
+				Message: "histograms are not supported over gRPC",
+			})
+		}
+	}
+	if len(verr.Fields) > 0 {
+		return &verr
+	}
+	return nil
+}
+
+// idempotencyKey returns the batch key from the incoming metadata.
+func idempotencyKey(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	if values := md.Get(IdempotencyKey); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// putBatch validates and stores metrics.
+// Histograms are rejected, since the Metric message cannot carry their buckets.
+// If the call has the idempotency-key metadata, the batch is applied only once
+// and repeated calls with the same key succeed without applying it again.
+// A call reusing the key for other metrics fails with codes.FailedPrecondition.
+func (s *MetricsService) putBatch(ctx context.Context, metrics []metric.Metric) error {
+	if err := rejectHistograms(metrics); err != nil {
+		s.logger.Error(err.Error())
+		return invalidArgument(err)
+	}
+	if err := metric.ValidateBatch(metrics); err != nil {
+		s.logger.Error(err.Error())
+		return invalidArgument(err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, limitInSeconds*time.Second)
+	defer cancel()
+
+	var err error
+	if key := idempotencyKey(ctx); key != "" {
+		err = s.repository.PutBatchOnce(ctx, key, metrics)
+		if errors.Is(err, repo.ErrDuplicateBatch) {
+			s.logger.Info("Batch " + key + " has already been applied")
+			err = nil
+		}
+	} else {
+		err = s.repository.PutBatch(ctx, metrics)
+	}
+	if err != nil {
+		s.logger.Error(err.Error())
+		if metric.IsConflict(err) || errors.Is(err, repo.ErrBatchKeyReused) {
+			return status.Error(codes.FailedPrecondition, err.Error())
+		}
+		return status.Error(codes.Internal, err.Error())
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		s.logger.Error(ctx.Err().Error())
+	}
+	return nil
+}
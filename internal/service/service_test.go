@@ -0,0 +1,237 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/sudeeya/metrics-harvester/internal/interceptor"
+	"github.com/sudeeya/metrics-harvester/internal/metric"
+	"github.com/sudeeya/metrics-harvester/internal/mocks"
+	pb "github.com/sudeeya/metrics-harvester/internal/proto"
+	repo "github.com/sudeeya/metrics-harvester/internal/repository"
+)
+
+var key = []byte("secret")
+
+func int64Ptr(i int64) *int64 {
+	return &i
+}
+
+func float64Ptr(f float64) *float64 {
+	return &f
+}
+
+func newTestClient(t *testing.T, repoMock *mocks.MockRepository) pb.MetricsClient {
+	listener := bufconn.Listen(1 << 20)
+	grpcServer := grpc.NewServer(
+		grpc.UnaryInterceptor(interceptor.UnarySigning(zap.NewNop(), key, true)),
+		grpc.StreamInterceptor(interceptor.StreamSigning(zap.NewNop(), key, true)),
+	)
+	pb.RegisterMetricsServer(grpcServer, NewMetricsService(zap.NewNop(), repoMock))
+	go func() {
+		_ = grpcServer.Serve(listener)
+	}()
+	t.Cleanup(grpcServer.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return pb.NewMetricsClient(conn)
+}
+
+func signedContext(t *testing.T, signKey []byte, messages ...any) context.Context {
+	signature, err := interceptor.Sign(signKey, messages...)
+	require.NoError(t, err)
+	return metadata.AppendToOutgoingContext(context.Background(), interceptor.HashKey, signature)
+}
+
+func TestUpdateMetrics(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	repoMock := mocks.NewMockRepository(ctrl)
+	metrics := []metric.Metric{
+		{ID: "gauge", MType: metric.Gauge, Value: float64Ptr(12.12)},
+		{ID: "counter", MType: metric.Counter, Delta: int64Ptr(12)},
+		{ID: "requests", MType: metric.Counter, Delta: int64Ptr(3), Labels: metric.Labels{"host": "a"}},
+	}
+	repoMock.EXPECT().
+		PutBatch(gomock.Any(), metrics).
+		Return(nil)
+	client := newTestClient(t, repoMock)
+
+	request := &pb.UpdateMetricsRequest{}
+	for _, m := range metrics {
+		request.Metrics = append(request.Metrics, pb.FromMetric(m))
+	}
+	tests := []struct {
+		name string
+		ctx  context.Context
+		code codes.Code
+	}{
+		{
+			name: "signed request",
+			ctx:  signedContext(t, key, request),
+			code: codes.OK,
+		},
+		{
+			name: "unsigned request",
+			ctx:  context.Background(),
+			code: codes.InvalidArgument,
+		},
+		{
+			name: "malformed signature",
+			ctx:  metadata.AppendToOutgoingContext(context.Background(), interceptor.HashKey, "dummy"),
+			code: codes.InvalidArgument,
+		},
+		{
+			name: "wrong signature",
+			ctx:  signedContext(t, []byte("dummy"), request),
+			code: codes.InvalidArgument,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var header metadata.MD
+			_, err := client.UpdateMetrics(test.ctx, request, grpc.Header(&header))
+			require.Equal(t, test.code, status.Code(err))
+			if test.code == codes.OK {
+				require.NotEmpty(t, header.Get(interceptor.HashKey))
+			}
+		})
+	}
+}
+
+func TestStreamMetrics(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	repoMock := mocks.NewMockRepository(ctrl)
+	metrics := []metric.Metric{
+		{ID: "gauge", MType: metric.Gauge, Value: float64Ptr(12.12)},
+		{ID: "counter", MType: metric.Counter, Delta: int64Ptr(12)},
+	}
+	repoMock.EXPECT().
+		PutBatch(gomock.Any(), metrics).
+		Return(nil)
+	client := newTestClient(t, repoMock)
+
+	messages := make([]any, len(metrics))
+	for i, m := range metrics {
+		messages[i] = pb.FromMetric(m)
+	}
+	tests := []struct {
+		name string
+		ctx  context.Context
+		code codes.Code
+	}{
+		{
+			name: "signed stream",
+			ctx:  signedContext(t, key, messages...),
+			code: codes.OK,
+		},
+		{
+			name: "stream signed without the last message",
+			ctx:  signedContext(t, key, messages[:1]...),
+			code: codes.InvalidArgument,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stream, err := client.StreamMetrics(test.ctx)
+			require.NoError(t, err)
+			for _, message := range messages {
+				require.NoError(t, stream.Send(message.(*pb.Metric)))
+			}
+			_, err = stream.CloseAndRecv()
+			require.Equal(t, test.code, status.Code(err))
+		})
+	}
+}
+
+func TestUpdateMetrics_Invalid(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	client := newTestClient(t, mocks.NewMockRepository(ctrl))
+
+	tests := []struct {
+		name    string
+		metrics []*pb.Metric
+		field   string
+	}{
+		{
+			name:    "gauge without value",
+			metrics: []*pb.Metric{{Id: "gauge", Type: metric.Gauge}},
+			field:   "[0].value",
+		},
+		{
+			name: "histogram",
+			metrics: []*pb.Metric{
+				{Id: "counter", Type: metric.Counter, Delta: int64Ptr(1)},
+				{Id: "latency", Type: metric.Histogram},
+			},
+			field: "[1].type",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := &pb.UpdateMetricsRequest{Metrics: test.metrics}
+			_, err := client.UpdateMetrics(signedContext(t, key, request), request)
+			st := status.Convert(err)
+			require.Equal(t, codes.InvalidArgument, st.Code())
+			require.Len(t, st.Details(), 1)
+			badRequest, ok := st.Details()[0].(*errdetails.BadRequest)
+			require.True(t, ok)
+			require.Equal(t, test.field, badRequest.GetFieldViolations()[0].GetField())
+		})
+	}
+}
+
+func TestUpdateMetrics_Conflict(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	repoMock := mocks.NewMockRepository(ctrl)
+	repoMock.EXPECT().
+		PutBatch(gomock.Any(), gomock.Any()).
+		Return(fmt.Errorf("%w: latency", metric.ErrBucketsConflict))
+	client := newTestClient(t, repoMock)
+
+	request := &pb.UpdateMetricsRequest{
+		Metrics: []*pb.Metric{{Id: "counter", Type: metric.Counter, Delta: int64Ptr(1)}},
+	}
+	_, err := client.UpdateMetrics(signedContext(t, key, request), request)
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
+
+func TestUpdateMetrics_ReusedKey(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	repoMock := mocks.NewMockRepository(ctrl)
+	repoMock.EXPECT().
+		PutBatchOnce(gomock.Any(), "key", gomock.Any()).
+		Return(repo.ErrBatchKeyReused)
+	client := newTestClient(t, repoMock)
+
+	request := &pb.UpdateMetricsRequest{
+		Metrics: []*pb.Metric{{Id: "counter", Type: metric.Counter, Delta: int64Ptr(1)}},
+	}
+	ctx := metadata.AppendToOutgoingContext(signedContext(t, key, request), IdempotencyKey, "key")
+	_, err := client.UpdateMetrics(ctx, request)
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+}